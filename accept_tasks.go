@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/datatogether/task_mgmt/taskdefs/gist"
@@ -10,10 +15,12 @@ import (
 	"github.com/datatogether/task_mgmt/taskdefs/pod"
 	"github.com/datatogether/task_mgmt/taskdefs/sciencebase"
 	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
 	"github.com/streadway/amqp"
 )
 
 func configureTasks() {
+	cfg := currentConfig()
 	tasks.RegisterTaskdef("ipfs.addurl", ipfs.NewTaskAdd)
 	tasks.RegisterTaskdef("ipfs.addcollection", ipfs.NewAddCollection)
 	tasks.RegisterTaskdef("kiwix.updateSources", kiwix.NewTaskUpdateSources)
@@ -25,21 +32,287 @@ func configureTasks() {
 	ipfs.IpfsApiServerUrl = cfg.IpfsApiUrl
 	pod.IpfsApiServerUrl = cfg.IpfsApiUrl
 	sciencebase.IpfsApiServerUrl = cfg.IpfsApiUrl
+
+	tasks.UniqueTitles = cfg.UniqueTitles
+	tasks.LockFinishedDefinitions = cfg.LockFinishedTaskDefinitions
+	tasks.NormalizeTitles = cfg.NormalizeTaskTitles
+	tasks.NormalizeUrls = cfg.NormalizeTaskUrls
+	tasks.TrimUrlTrailingSlashes = cfg.TrimTaskUrlTrailingSlashes
+	tasks.UniqueUrls = cfg.UniqueTaskUrls
+	tasks.MaxTitleLength = cfg.TaskMaxTitleLength
+	tasks.MaxErrorLength = cfg.TaskMaxErrorLength
+	if cfg.TimestampFormat != "" {
+		tasks.TimestampFormat = cfg.TimestampFormat
+	}
+	if cfg.TaskTitleTemplate != "" {
+		tasks.TitleTemplate = cfg.TaskTitleTemplate
+	}
+
+	// publish status changes, initConfig has already checked the settings
+	if publisher, err := newEventPublisher(cfg.TaskEventsPublisher, cfg.TaskEventsChannel); err != nil {
+		log.Infoln(err.Error())
+	} else {
+		events = publisher
+	}
+	tasks.StatusChanged = taskStatusChanged
+}
+
+// taskStatusChanged is called each time a saved task changes status
+func taskStatusChanged(t *tasks.Task, from tasks.Status) {
+	if t.StatusString() == tasks.StatusFinished && t.Succeeded != nil {
+		lastTaskSuccess.Set(t.Succeeded.Unix())
+	}
+	publishTaskEvent(t, from)
+}
+
+// workerId returns the identifier this server uses when
+// claiming tasks, falling back to the hostname if unconfigured
+func workerId() string {
+	if id := currentConfig().WorkerId; id != "" {
+		return id
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return host
+}
+
+// runTaskOnce reads the task identified by id from store & performs it on
+// this server, writing progress & the finished task as JSON to w. it
+// returns an error if the task can't be read or fails
+func runTaskOnce(store datastore.Datastore, id string, w io.Writer) error {
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		return fmt.Errorf("error reading task %s: %s", id, err.Error())
+	}
+
+	tc := make(chan *tasks.Task, 10)
+	progress := make(chan struct{})
+	go func() {
+		defer close(progress)
+		for t := range tc {
+			fmt.Fprintln(w, t.Progress.String())
+		}
+	}()
+
+	task.Claim(workerId())
+	err := trackRun(func() error { return task.Do(store, tc) })
+	close(tc)
+	<-progress
+
+	data, jerr := json.MarshalIndent(task, "", "  ")
+	if jerr != nil {
+		return jerr
+	}
+	fmt.Fprintln(w, string(data))
+	return err
+}
+
+// TaskQueue performs tasks delivered from an amqp queue, one at a time
+type TaskQueue struct {
+	store datastore.Datastore
+	msgs  <-chan amqp.Delivery
+	// closed by Shutdown to stop accepting new tasks
+	stop chan struct{}
+	// closed when the queue has stopped & no task is in-flight
+	done chan struct{}
+	// close tears down the queue's connection, may be nil
+	close func()
+
+	lock sync.Mutex
+	// delivery for the in-flight task, nil if the queue is idle
+	current *amqp.Delivery
+	// set when shutdown has requeued the in-flight task
+	requeued bool
+	// stops the in-flight task, nil if the queue is idle
+	cancelRun context.CancelFunc
 }
 
-// start accepting tasks from the queue, if setup doesn't error,
-// it returns a stop channel writing to stop will teardown the
-// func and stop accepting tasks
-func acceptTasks() (stop chan bool, err error) {
-	stop = make(chan bool)
+// newTaskQueue creates a TaskQueue that reads tasks from store as
+// deliveries arrive on msgs. call run to start performing tasks
+func newTaskQueue(store datastore.Datastore, msgs <-chan amqp.Delivery) *TaskQueue {
+	return &TaskQueue{
+		store: store,
+		msgs:  msgs,
+		stop:  make(chan struct{}),
+		done:  make(chan struct{}),
+	}
+}
+
+// run performs tasks as they're delivered until Shutdown is called or
+// msgs is closed
+func (q *TaskQueue) run() {
+	defer close(q.done)
+	for {
+		select {
+		case <-q.stop:
+			return
+		case msg, ok := <-q.msgs:
+			if !ok {
+				return
+			}
+			select {
+			case <-q.stop:
+				// shutdown started while waiting, leave this task for another worker
+				msg.Nack(false, true)
+				return
+			default:
+			}
+			q.perform(msg)
+		}
+	}
+}
+
+// perform runs the task for a single delivery, acknowledging the delivery
+// when the task is complete
+func (q *TaskQueue) perform(msg amqp.Delivery) {
+	task, err := tasks.TaskFromDelivery(q.store, msg)
+	if err != nil {
+		log.Errorf("task error: %s", err.Error())
+		msg.Nack(false, false)
+		return
+	}
+	if task.Succeeded != nil || task.Failed != nil {
+		// cancelled while it was queued
+		log.Infof("skipping finished task: %s", task.Id)
+		msg.Ack(false)
+		return
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	q.lock.Lock()
+	q.current = &msg
+	q.requeued = false
+	q.cancelRun = cancel
+	q.lock.Unlock()
+
+	tc := make(chan *tasks.Task, 10)
+	progress := make(chan struct{})
+	// accept tasks
+	go func() {
+		defer close(progress)
+		for t := range tc {
+			if err := PublishTaskProgress(rpool, t); err != nil && err != ErrNoRedisConn {
+				log.Infoln(err.Error())
+			}
+		}
+	}()
+
+	task.Claim(workerId())
+	log.Infof("starting task %s,%s on worker %s", task.Id, task.Type, task.WorkerId)
+	err = trackRun(func() error { return task.DoContext(ctx, q.store, tc) })
+	close(tc)
+	<-progress
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.current = nil
+	q.cancelRun = nil
+	if q.requeued {
+		// shutdown has already returned this task to the queue
+		return
+	}
+
+	if err == context.Canceled {
+		// acknowledge the cancel request by failing the task
+		if err := task.Cancel(); err != nil {
+			log.Errorf("error cancelling task %s: %s", task.Id, err.Error())
+		} else if err := task.Save(q.store); err != nil {
+			log.Errorf("error saving cancelled task %s: %s", task.Id, err.Error())
+		}
+		log.Infof("cancelled task: %s", task.Id)
+		msg.Ack(false)
+		return
+	}
+
+	if err != nil {
+		log.Errorf("task error: %s", err.Error())
+		msg.Nack(false, false)
+	} else {
+		log.Infof("completed task: %s, %s", task.Id, msg.Type)
+		msg.Ack(false)
+	}
+}
+
+// Cancel stops the in-flight task if it's taskId, failing it with
+// tasks.CancelledError. it reports whether the task was in-flight
+func (q *TaskQueue) Cancel(taskId string) bool {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.current == nil || q.current.CorrelationId != taskId || q.cancelRun == nil {
+		return false
+	}
+	log.Infof("cancel requested for in-flight task: %s", taskId)
+	q.cancelRun()
+	return true
+}
+
+// Shutdown stops accepting new tasks & waits for the in-flight task to
+// finish. If ctx expires first the in-flight task is stopped, marked as
+// queued & returned to the queue for another worker to pick up, returning
+// ctx.Err()
+func (q *TaskQueue) Shutdown(ctx context.Context) error {
+	close(q.stop)
+	if q.close != nil {
+		defer q.close()
+	}
+
+	select {
+	case <-q.done:
+		return nil
+	case <-ctx.Done():
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.current == nil {
+		return ctx.Err()
+	}
+
+	// stop the run first, so it can't save it's result over the requeued task
+	if q.cancelRun != nil {
+		q.cancelRun()
+	}
+
+	// read a fresh copy, the in-flight task may have been saved since it started
+	t := &tasks.Task{Id: q.current.CorrelationId}
+	if err := t.Read(q.store); err != nil {
+		log.Errorf("error reading in-flight task %s: %s", t.Id, err.Error())
+	} else {
+		t.Started = nil
+		t.WorkerId = ""
+		t.Progress = nil
+		if err := t.Save(q.store); err != nil {
+			log.Errorf("error requeuing task %s: %s", t.Id, err.Error())
+		}
+	}
+
+	log.Infof("shutdown requeued in-flight task: %s", t.Id)
+	q.current.Nack(false, true)
+	q.requeued = true
+	return ctx.Err()
+}
+
+// start accepting tasks from the queue, if setup doesn't error, it returns
+// a TaskQueue that's performing tasks. call Shutdown on the returned queue
+// to stop accepting tasks. acceptTasks returns a nil queue if no amqp url
+// is configured
+func acceptTasks() (*TaskQueue, error) {
+	cfg := currentConfig()
 	if cfg.AmqpUrl == "" {
 		log.Infoln("no amqp url specified, queue listening disabled")
-		return stop, nil
+		return nil, nil
 	}
 
 	log.Printf("connecting to: %s", cfg.AmqpUrl)
 
-	var conn *amqp.Connection
+	var (
+		conn *amqp.Connection
+		err  error
+	)
 	for i := 0; i <= 1000; i++ {
 		conn, err = amqp.Dial(cfg.AmqpUrl)
 		if err != nil {
@@ -85,42 +358,18 @@ func acceptTasks() (stop chan bool, err error) {
 		return nil, fmt.Errorf("", err)
 	}
 
-	go func() {
-		for msg := range msgs {
-			// tasks.Tas
-			task, err := tasks.TaskFromDelivery(store, msg)
-			if err != nil {
-				log.Errorf("task error: %s", err.Error())
-				msg.Nack(false, false)
-				continue
-			}
-
-			tc := make(chan *tasks.Task, 10)
-			// accept tasks
-			go func() {
-				for t := range tc {
-					if err := PublishTaskProgress(rpool, t); err != nil && err != ErrNoRedisConn {
-						log.Infoln(err.Error())
-					}
-				}
-			}()
-
-			log.Infof("starting task %s,%s", task.Id, task.Type)
-			if err := task.Do(store, tc); err != nil {
-				log.Errorf("task error: %s", err.Error())
-				msg.Nack(false, false)
-			} else {
-				log.Infof("completed task: %s, %s", task.Id, msg.Type)
-				msg.Ack(false)
-			}
-
-		}
-		// TODO - figure out a way to bail out of the above loop
-		// if stop is ever published to
-		<-stop
+	queue := newTaskQueue(store, msgs)
+	queue.close = func() {
 		ch.Close()
 		conn.Close()
-	}()
+	}
+	go queue.run()
+
+	// let the sweeper know this worker is alive, so tasks it's
+	// running aren't requeued, & pick up cancel requests
+	if timeout := cfg.WorkerHeartbeatTimeoutSeconds; timeout > 0 {
+		go sendHeartbeats(time.Duration(timeout)*time.Second/3, func(taskId string) { queue.Cancel(taskId) })
+	}
 
-	return stop, nil
+	return queue, nil
 }
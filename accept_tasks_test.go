@@ -0,0 +1,303 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/streadway/amqp"
+)
+
+// blockingTaskable signals started when it begins, then blocks until release is closed
+type blockingTaskable struct {
+	started, release chan struct{}
+}
+
+func (b blockingTaskable) Valid() error { return nil }
+
+func (b blockingTaskable) Do(updates chan tasks.Progress) {
+	close(b.started)
+	<-b.release
+	updates <- tasks.Progress{Done: true}
+}
+
+// recordingAcknowledger records the acknowledgements made to a delivery
+type recordingAcknowledger struct {
+	lock                   sync.Mutex
+	acked, nacked, requeue bool
+}
+
+func (r *recordingAcknowledger) Ack(tag uint64, multiple bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.acked = true
+	return nil
+}
+
+func (r *recordingAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.nacked = true
+	r.requeue = requeue
+	return nil
+}
+
+func (r *recordingAcknowledger) Reject(tag uint64, requeue bool) error {
+	return r.Nack(tag, false, requeue)
+}
+
+func TestTaskQueueShutdownRequeuesInFlightTask(t *testing.T) {
+	b := blockingTaskable{started: make(chan struct{}), release: make(chan struct{})}
+	tasks.RegisterTaskdef("test.blocking", func() tasks.Taskable { return &blockingTaskable{b.started, b.release} })
+
+	store := datastore.NewMapDatastore()
+	task := &tasks.Task{Type: "test.blocking"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msgs := make(chan amqp.Delivery, 1)
+	ack := &recordingAcknowledger{}
+	msgs <- amqp.Delivery{Acknowledger: ack, CorrelationId: task.Id}
+
+	q := newTaskQueue(store, msgs)
+	go q.run()
+
+	select {
+	case <-b.started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for task to start")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := q.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to time out waiting for the in-flight task, got: %v", err)
+	}
+
+	ack.lock.Lock()
+	if !ack.nacked || !ack.requeue || ack.acked {
+		t.Errorf("expected in-flight task to be returned to the queue. acked: %t, nacked: %t, requeue: %t", ack.acked, ack.nacked, ack.requeue)
+	}
+	ack.lock.Unlock()
+
+	requeued := &tasks.Task{Id: task.Id}
+	if err := requeued.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if requeued.Started != nil || requeued.WorkerId != "" {
+		t.Errorf("expected requeued task to have no start time or worker. started: %v, worker: %s", requeued.Started, requeued.WorkerId)
+	}
+
+	// the in-flight run's context is cancelled, so perform returns without
+	// waiting for the taskable
+	select {
+	case <-q.done:
+	case <-time.After(time.Second):
+		t.Fatal("expected shutdown to cancel the in-flight run")
+	}
+
+	// a taskable that finishes late can't save over the requeued task
+	close(b.release)
+	time.Sleep(10 * time.Millisecond)
+	if err := requeued.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if requeued.Succeeded != nil || requeued.Started != nil {
+		t.Errorf("expected requeued task to be unchanged by the cancelled run. succeeded: %v, started: %v", requeued.Succeeded, requeued.Started)
+	}
+}
+
+func TestTaskQueueCancel(t *testing.T) {
+	b := blockingTaskable{started: make(chan struct{}), release: make(chan struct{})}
+	tasks.RegisterTaskdef("test.blocking", func() tasks.Taskable { return &blockingTaskable{b.started, b.release} })
+	defer close(b.release)
+
+	store := datastore.NewMapDatastore()
+	task := &tasks.Task{Type: "test.blocking"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msgs := make(chan amqp.Delivery, 1)
+	ack := &recordingAcknowledger{}
+	msgs <- amqp.Delivery{Acknowledger: ack, CorrelationId: task.Id}
+
+	q := newTaskQueue(store, msgs)
+	go q.run()
+	defer q.Shutdown(context.Background())
+
+	select {
+	case <-b.started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for task to start")
+	}
+
+	if q.Cancel("9e1c2d3f-6a7b-4c8d-9e0f-1a2b3c4d5e6f") {
+		t.Errorf("expected cancelling a task that isn't in-flight to do nothing")
+	}
+	if !q.Cancel(task.Id) {
+		t.Fatal("expected cancelling the in-flight task to succeed")
+	}
+	waitForAck(t, ack)
+
+	ack.lock.Lock()
+	if !ack.acked || ack.nacked {
+		t.Errorf("expected cancelled task's delivery to be acknowledged. acked: %t, nacked: %t", ack.acked, ack.nacked)
+	}
+	ack.lock.Unlock()
+
+	cancelled := &tasks.Task{Id: task.Id}
+	if err := cancelled.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if cancelled.Failed == nil || cancelled.Error != tasks.CancelledError {
+		t.Errorf("expected cancelled task to fail with error '%s', got: '%s'", tasks.CancelledError, cancelled.Error)
+	}
+}
+
+// waitForAck waits up to a second for ack to record an acknowledgement
+func waitForAck(t *testing.T, ack *recordingAcknowledger) {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		ack.lock.Lock()
+		done := ack.acked || ack.nacked
+		ack.lock.Unlock()
+		if done {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for delivery to be acknowledged")
+}
+
+func TestTaskQueueShutdownIdle(t *testing.T) {
+	q := newTaskQueue(datastore.NewMapDatastore(), make(chan amqp.Delivery))
+	go q.run()
+
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Errorf("expected idle queue to shut down cleanly, got: %s", err.Error())
+	}
+}
+
+func TestTrackRun(t *testing.T) {
+	before := activeRuns.Value()
+	started, release, done := make(chan struct{}), make(chan struct{}), make(chan error)
+	for i := 0; i < 2; i++ {
+		go func() {
+			done <- trackRun(func() error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	<-started
+	<-started
+
+	if got := activeRuns.Value(); got != before+2 {
+		t.Errorf("expected %d active runs while tasks are in-flight, got: %d", before+2, got)
+	}
+
+	close(release)
+	for i := 0; i < 2; i++ {
+		if err := <-done; err != nil {
+			t.Error(err.Error())
+		}
+	}
+	if got := activeRuns.Value(); got != before {
+		t.Errorf("expected %d active runs once tasks finish, got: %d", before, got)
+	}
+}
+
+// progressTaskable reports a single step, then finishes. it fails with Err if set
+type progressTaskable struct {
+	Err string `json:"err"`
+}
+
+func (p progressTaskable) Valid() error { return nil }
+
+func (p progressTaskable) Do(updates chan tasks.Progress) {
+	updates <- tasks.Progress{Step: 1, Steps: 2, Status: "working"}
+	if p.Err != "" {
+		updates <- tasks.Progress{Error: errors.New(p.Err)}
+		return
+	}
+	updates <- tasks.Progress{Step: 2, Steps: 2, Done: true}
+}
+
+func TestRunTaskOnce(t *testing.T) {
+	tasks.RegisterTaskdef("test.progress", func() tasks.Taskable { return &progressTaskable{} })
+
+	store := datastore.NewMapDatastore()
+	task := &tasks.Task{Type: "test.progress", Title: "one shot", Params: map[string]interface{}{}}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := runTaskOnce(store, task.Id, buf); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(buf.String(), "working") || !strings.Contains(buf.String(), "one shot") {
+		t.Errorf("expected output to include progress & the finished task, got: %s", buf.String())
+	}
+
+	got := &tasks.Task{Id: task.Id}
+	if err := got.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got.Succeeded == nil || got.WorkerId == "" {
+		t.Errorf("expected task to be saved as succeeded by this worker. succeeded: %v, worker: %s", got.Succeeded, got.WorkerId)
+	}
+
+	task = &tasks.Task{Type: "test.progress", Params: map[string]interface{}{"err": "boom"}}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := runTaskOnce(store, task.Id, &bytes.Buffer{}); err == nil || err.Error() != "boom" {
+		t.Errorf("expected failed task to return it's error, got: %v", err)
+	}
+
+	if err := runTaskOnce(store, "9e1c2d3f-6a7b-4c8d-9e0f-1a2b3c4d5e6f", &bytes.Buffer{}); err == nil {
+		t.Errorf("expected running a missing task to error")
+	}
+}
+
+func TestTaskStatusChangedRecordsSuccess(t *testing.T) {
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+	prevEvents, prevHook := events, tasks.StatusChanged
+	events, tasks.StatusChanged = noopPublisher{}, taskStatusChanged
+	defer func() { events, tasks.StatusChanged = prevEvents, prevHook }()
+	defer lastTaskSuccess.Set(lastTaskSuccess.Value())
+	lastTaskSuccess.Set(0)
+
+	store := datastore.NewMapDatastore()
+	task := &tasks.Task{Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now()
+	task.Started, task.Failed = &now, &now
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got := expvar.Get("last_task_success_timestamp").String(); got != "0" {
+		t.Errorf("expected failed task not to update the gauge, got: %s", got)
+	}
+
+	succeeded := now.Add(time.Minute)
+	task.Failed, task.Succeeded = nil, &succeeded
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if got, expect := expvar.Get("last_task_success_timestamp").String(), strconv.FormatInt(succeeded.Unix(), 10); got != expect {
+		t.Errorf("expected gauge to be the success time %s, got: %s", expect, got)
+	}
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/pborman/uuid"
+)
+
+// TaskAuditEntry records an administrative change to a task. audit entries
+// are kept after the task they describe is archived or deleted
+type TaskAuditEntry struct {
+	// id of the task that was changed
+	TaskId string `json:"taskId"`
+	// time the change was made
+	Created time.Time `json:"created"`
+	// who made the change
+	Actor string `json:"actor"`
+	// status of the task before & after the change
+	FromStatus tasks.Status `json:"fromStatus"`
+	ToStatus   tasks.Status `json:"toStatus"`
+	// why the change was made
+	Reason string `json:"reason"`
+}
+
+// AddTaskAuditEntry writes e to the audit log
+func AddTaskAuditEntry(db sqlExecable, e *TaskAuditEntry) error {
+	_, err := db.Exec(qTaskAuditInsert, e.TaskId, e.Created.In(time.UTC), e.Actor, string(e.FromStatus), string(e.ToStatus), e.Reason)
+	return err
+}
+
+// ReadTaskAuditEntries reads a task's audit log in chronological order
+func ReadTaskAuditEntries(db sqlQueryable, taskId string) ([]*TaskAuditEntry, error) {
+	rows, err := db.Query(qTaskAuditEntries, taskId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []*TaskAuditEntry{}
+	for rows.Next() {
+		var (
+			e        = &TaskAuditEntry{}
+			from, to string
+		)
+		if err := rows.Scan(&e.TaskId, &e.Created, &e.Actor, &from, &to, &e.Reason); err != nil {
+			return nil, err
+		}
+		// entries written before a status was renamed store it's old name
+		e.FromStatus, e.ToStatus = tasks.Status(from).Canonical(), tasks.Status(to).Canonical()
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// ReadRawTask reads a task's row as it's stored, keyed by column name. null
+// columns are nil, & text, json & array columns are their text in the db.
+// returns sql.ErrNoRows if the task doesn't exist
+func ReadRawTask(db sqlQueryable, id string) (map[string]interface{}, error) {
+	rows, err := db.Query(qTaskRaw, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, sql.ErrNoRows
+	}
+
+	cols, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	vals := make([]interface{}, len(cols))
+	ptrs := make([]interface{}, len(cols))
+	for i := range vals {
+		ptrs[i] = &vals[i]
+	}
+	if err := rows.Scan(ptrs...); err != nil {
+		return nil, err
+	}
+
+	row := make(map[string]interface{}, len(cols))
+	for i, col := range cols {
+		// the driver returns text of most types as bytes, which would
+		// otherwise marshal to base64
+		if b, ok := vals[i].([]byte); ok {
+			row[col] = string(b)
+		} else {
+			row[col] = vals[i]
+		}
+	}
+	return row, rows.Err()
+}
+
+// RawTaskHandler responds with a task's row exactly as it's stored, for
+// debugging data problems the task API's formatting would hide
+func RawTaskHandler(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(r) {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("admin authorization required"))
+		return
+	}
+
+	id, _ := taskPathParams(r.URL.Path)
+	if uuid.Parse(id) == nil {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, fmt.Errorf("task not found"))
+		return
+	}
+
+	row, err := ReadRawTask(newQueryLogger(appDB), id)
+	if err == sql.ErrNoRows {
+		apiutil.WriteErrResponse(w, http.StatusNotFound, fmt.Errorf("task not found"))
+		return
+	} else if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, row)
+}
+
+// BulkSetTaskStatus sets every task matching q to status, writing an audit
+// entry by actor for each. Call it inside a transaction: matching tasks are
+// locked, & if any task can't make the transition none of them should.
+// It returns an event for each change, to publish once the transaction commits
+func BulkSetTaskStatus(db sqlQueryExecable, q tasks.TaskQuery, status tasks.Status, reason, actor string) ([]*TaskEvent, error) {
+	matches, err := tasks.QueryTasksForUpdate(db, q)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]*TaskEvent, len(matches))
+	for i, t := range matches {
+		from := t.StatusString()
+		if err := t.SetStatus(status, reason); err != nil {
+			return nil, err
+		}
+		if err := tasks.UpdateRunState(db, t); err != nil {
+			return nil, err
+		}
+		entry := &TaskAuditEntry{
+			TaskId:     t.Id,
+			Created:    t.Updated,
+			Actor:      actor,
+			FromStatus: from,
+			ToStatus:   status,
+			Reason:     reason,
+		}
+		if err := AddTaskAuditEntry(db, entry); err != nil {
+			return nil, err
+		}
+		changes[i] = newTaskEvent(t, from)
+	}
+	return changes, nil
+}
+
+// BulkTaskStatusHandler corrects the status of many tasks at once, for
+// cleaning up after data issues. Admins POST a json object with a "filter"
+// selecting tasks, a target "status" of finished or failed & a "reason".
+// All matching tasks are changed or, if any can't be, none are
+func BulkTaskStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		NotFoundHandler(w, r)
+		return
+	}
+	if !adminAuthorized(r) {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("admin authorization required"))
+		return
+	}
+
+	body := struct {
+		Filter struct {
+			Status        string     `json:"status"`
+			Type          string     `json:"type"`
+			UserId        string     `json:"userId"`
+			CreatedAfter  *time.Time `json:"createdAfter"`
+			CreatedBefore *time.Time `json:"createdBefore"`
+		} `json:"filter"`
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	}{}
+	if err := decodeJSONBody(w, r, &body); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	filterStatus, err := tasks.ParseStatus(body.Filter.Status)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	q := tasks.TaskQuery{
+		Status:        filterStatus,
+		Type:          body.Filter.Type,
+		UserId:        body.Filter.UserId,
+		CreatedAfter:  body.Filter.CreatedAfter,
+		CreatedBefore: body.Filter.CreatedBefore,
+		OrderBy:       "created ASC",
+	}
+	// an empty filter would change every task, which is never a correction
+	if q.Status == "" && q.Type == "" && q.UserId == "" && q.CreatedAfter == nil && q.CreatedBefore == nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("filter must match on at least one field"))
+		return
+	}
+
+	status := tasks.Status(body.Status)
+	if status != tasks.StatusFinished && status != tasks.StatusFailed {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("status must be either '%s' or '%s'", tasks.StatusFinished, tasks.StatusFailed))
+		return
+	}
+	if strings.TrimSpace(body.Reason) == "" {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("reason is required"))
+		return
+	}
+
+	var changes []*TaskEvent
+	err = WithTx(r.Context(), appDB, func(tx *sql.Tx) (err error) {
+		changes, err = BulkSetTaskStatus(newQueryLoggerContext(r.Context(), tx), q, status, body.Reason, "admin")
+		return
+	})
+	if err != nil {
+		if errors.Is(err, tasks.ErrInvalidTask) {
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	ids := make([]string, len(changes))
+	for i, e := range changes {
+		publishEvent(e)
+		ids[i] = e.TaskId
+	}
+	apiutil.WriteMessageResponse(w, fmt.Sprintf("set %d tasks to %s", len(ids), status), map[string]interface{}{
+		"taskIds": ids,
+	})
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/task_mgmt/tasks"
+)
+
+func TestBulkTaskStatusHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks", "task_audit")
+	if err := resetTestData(appDB, "task_audit"); err != nil {
+		t.Fatal(err.Error())
+	}
+	prev := currentConfig()
+	c := *prev
+	c.AdminApiKey = "admin_key"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	running := []string{"2a6f1c3e-0000-4000-8000-000000000001", "2a6f1c3e-0000-4000-8000-000000000002"}
+	now := time.Now().In(time.UTC)
+	for _, id := range running {
+		if _, err := appDB.Exec("INSERT INTO tasks (id, created, updated, type, user_id, enqueued, started, worker_id) VALUES ($1, $2, $2, 'ipfs.add', 'bulk_owner', $2, $2, 'lost_worker')", id, now); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	post := func(token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/admin/tasks/bulk-status", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		BulkTaskStatusHandler(rr, req)
+		return rr
+	}
+
+	valid := `{"filter":{"status":"running","userId":"bulk_owner"},"status":"failed","reason":"worker lost"}`
+	cases := []struct {
+		token, body string
+		expect      int
+	}{
+		{"", valid, http.StatusUnauthorized},
+		{"wrong", valid, http.StatusUnauthorized},
+		{"admin_key", `{"filter":{},"status":"failed","reason":"everything"}`, http.StatusBadRequest},
+		{"admin_key", `{"filter":{"userId":"bulk_owner"},"status":"queued","reason":"requeue"}`, http.StatusBadRequest},
+		{"admin_key", `{"filter":{"userId":"bulk_owner"},"status":"failed"}`, http.StatusBadRequest},
+	}
+	for i, c := range cases {
+		if rr := post(c.token, c.body); rr.Code != c.expect {
+			t.Errorf("case %d: expected status %d, got: %d. body: %s", i, c.expect, rr.Code, rr.Body.String())
+		}
+	}
+
+	rr := post("admin_key", valid)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	res := struct {
+		Data struct {
+			TaskIds []string `json:"taskIds"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.Data.TaskIds) != len(running) {
+		t.Errorf("expected %d tasks to change, got: %v", len(running), res.Data.TaskIds)
+	}
+
+	for _, id := range running {
+		task := &tasks.Task{Id: id}
+		if err := task.Read(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		if task.StatusString() != tasks.StatusFailed || task.Error != "worker lost" {
+			t.Errorf("task %s: expected failed with error 'worker lost', got: %s, '%s'", id, task.StatusString(), task.Error)
+		}
+
+		entries, err := ReadTaskAuditEntries(appDB, id)
+		if err != nil {
+			t.Fatal(err.Error())
+		}
+		if len(entries) != 1 {
+			t.Fatalf("task %s: expected 1 audit entry, got: %d", id, len(entries))
+		}
+		e := entries[0]
+		if e.Actor != "admin" || e.FromStatus != tasks.StatusRunning || e.ToStatus != tasks.StatusFailed || e.Reason != "worker lost" {
+			t.Errorf("task %s: audit entry mismatch: %+v", id, e)
+		}
+	}
+
+	// failing already-failed tasks is an invalid transition, & changes nothing
+	if _, err := appDB.Exec("UPDATE tasks SET failed = NULL, error = '' WHERE id = $1", running[0]); err != nil {
+		t.Fatal(err.Error())
+	}
+	rr = post("admin_key", `{"filter":{"userId":"bulk_owner"},"status":"failed","reason":"again"}`)
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected invalid transition to return %d, got: %d. body: %s", http.StatusConflict, rr.Code, rr.Body.String())
+	}
+	task := &tasks.Task{Id: running[0]}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Failed != nil {
+		t.Errorf("expected bulk update to roll back when any transition is invalid")
+	}
+	entries, err := ReadTaskAuditEntries(appDB, running[0])
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected rolled back update to add no audit entries, got: %d", len(entries))
+	}
+}
+
+func TestRawTaskHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	prev := currentConfig()
+	c := *prev
+	c.AdminApiKey = "admin_key"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "2a6f1c3e-0000-4000-8000-000000000010"
+	if _, err := appDB.Exec("INSERT INTO tasks (id, type, title) VALUES ($1, 'ipfs.add', '')", id); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	get := func(token, id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/tasks/"+id+"/raw", nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rr := httptest.NewRecorder()
+		TaskHandler(rr, req)
+		return rr
+	}
+
+	if rr := get("", id); rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected unauthenticated request to be refused, got: %d", rr.Code)
+	}
+	if rr := get("admin_key", "2a6f1c3e-0000-4000-8000-0000000000ff"); rr.Code != http.StatusNotFound {
+		t.Errorf("expected missing task to 404, got: %d", rr.Code)
+	}
+
+	rr := get("admin_key", id)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected 200, got: %d %s", rr.Code, rr.Body.String())
+	}
+	res := struct {
+		Data map[string]json.RawMessage `json:"data"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err.Error())
+	}
+	expect := map[string]string{
+		"id":        `"` + id + `"`,
+		"type":      `"ipfs.add"`,
+		"title":     `""`,
+		"error":     `""`,
+		"params":    `null`,
+		"enqueued":  `null`,
+		"started":   `null`,
+		"succeeded": `null`,
+		"failed":    `null`,
+	}
+	for col, val := range expect {
+		if got := string(res.Data[col]); got != val {
+			t.Errorf("column %s mismatch. expected: %s, got: %s", col, val, got)
+		}
+	}
+}
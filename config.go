@@ -3,8 +3,14 @@ package main
 import (
 	"fmt"
 	conf "github.com/datatogether/config"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/joho/godotenv"
+	"net/mail"
 	"os"
 	"path/filepath"
+	"regexp"
+	"strings"
+	"sync/atomic"
 )
 
 // server modes
@@ -27,32 +33,241 @@ const (
 type config struct {
 	// port to listen on, will be read from PORT env variable if present.
 	Port string
+	// host address to listen on, eg: 127.0.0.1. empty listens on all interfaces
+	ListenAddr string
 	// root url
 	UrlRoot string
 	// port to listen on for RPC calls
 	RpcPort string
 	// url of postgres app db
 	PostgresDbUrl string
+	// url of an optional postgres read replica, read-only queries
+	// use the primary db when empty
+	PostgresReadReplicaUrl string
 	// url of message que server
 	AmqpUrl string
+	// name of an amqp queue to create tasks from, see TaskRequest for the
+	// message format. requires AmqpUrl, task requests aren't consumed if empty
+	TaskRequestQueue string
 	// url for IPFS api methods
 	IpfsApiUrl string
 	// redis connection URL
 	RedisUrl string
 	// Public Key to use for signing. required.
 	PublicKey string
+	// WorkerSecret authenticates requests from task workers, which must
+	// send it as a bearer token. worker requests are refused if empty
+	WorkerSecret string
+	// additional worker secrets that are also accepted, for rotating secrets
+	// without downtime: add the new secret here, move workers over to it,
+	// then make it the WorkerSecret & remove the old one
+	WorkerSecrets []string
+	// AdminApiKey authenticates automation as an admin when sent as a bearer
+	// token. admin access is disabled if empty
+	AdminApiKey string
+	// number of times idempotent outbound http requests are retried after a
+	// network error, 5xx or 429 response, default 3
+	HttpMaxRetries int
+	// identifies this server when it claims tasks from the queue,
+	// defaults to the machine's hostname
+	WorkerId string
+	// seconds a worker can go without sending a heartbeat before it's
+	// considered dead & it's running tasks are requeued. queue workers
+	// check for cancel requests with each heartbeat. 0 disables requeuing
+	// & cancelling running tasks, default 120
+	WorkerHeartbeatTimeoutSeconds int
+	// days after finishing that tasks, with their logs, artifacts & notes,
+	// are moved to the archive tables. 0 disables archiving. default 0
+	TaskArchiveAfterDays int
+	// minutes between checks that sources still match their checksums,
+	// 0 disables drift checks. default 0
+	SourceDriftCheckMinutes int
+	// number of randomly chosen sources re-fetched on each drift check,
+	// default 10
+	SourceDriftSampleSize int
+	// maximum number of tasks performed at once when no AmqpUrl is set,
+	// 0 is unlimited. default 0
+	MaxActiveRuns int
+	// what to do with new runs while MaxActiveRuns tasks are running, either
+	// "reject" to respond 429 Too Many Requests, "block" to accept the task
+	// & wait for a free slot, or "fair" to wait like block, with waiting tasks
+	// taking turns by owner instead of in order. default reject
+	QueueFullBehavior string
+	// maximum number of unstarted tasks a single owner can have, new tasks
+	// past the cap are rejected with 429 Too Many Requests. 0 is unlimited.
+	// default 0
+	MaxReadyTasksPerOwner int
+	// seconds that must pass after a task was last enqueued before it can
+	// be retried, 0 allows immediate retries. default 0
+	MinRerunIntervalSeconds int
+	// ordering of task listings that don't specify orderBy, a sortable
+	// column optionally followed by ASC or DESC. default "created DESC"
+	TaskListOrder string
+	// number of results listings return when a request doesn't specify,
+	// default 50
+	DefaultPageSize int
+	// largest number of results a listing will return, larger requests
+	// are clamped to this size. default 200
+	MaxPageSize int
+	// seconds to wait for in-flight requests & tasks when shutting down,
+	// tasks still running after the timeout are requeued. default 30
+	ShutdownTimeoutSeconds int
 	// TLS (HTTPS) enable support via LetsEncrypt, default false
 	// not needed if operating behind a TLS proxy
 	TLS bool
+	// minimum TLS version accepted when TLS is enabled, "1.2" or "1.3".
+	// default 1.2
+	TlsMinVersion string
+	// names of the TLS 1.2 cipher suites offered when TLS is enabled, as
+	// listed by crypto/tls. defaults to forward-secret AEAD suites
+	TlsCipherSuites []string
 	// if true, requests that have X-Forwarded-Proto: http will be redirected
 	// to their https variant, useful if operating behind a TLS proxy
 	ProxyForceHttps bool
 	// key for sending emails
 	PostmarkKey string
+	// verified sender address for outgoing email, required if PostmarkKey is set
+	PostmarkFromAddress string
+	// postmark message stream to send email on, default is postmark's "outbound" stream
+	PostmarkMessageStream string
 	// list of email addresses that should get notifications
 	EmailNotificationRecipients []string
+	// when true, a task's notifyEmails are notified instead of
+	// EmailNotificationRecipients, rather than as well as. default false
+	TaskNotifyEmailsReplace bool
+	// when true, only tasks that set notifyEmails are notified about,
+	// instead of every task. default false
+	TaskNotifyOptIn bool
+	// number of emails that can be sent at once, default 2
+	EmailConcurrency int
+	// maximum number of emails to send per second, 0 is unlimited. default 10
+	EmailRateLimit int
 	// CertbotResponse is only for doing manual SSL certificate generation via LetsEncrypt.
 	CertbotResponse string
+	// milliseconds a postgres statement can run before the server aborts it,
+	// 0 means no limit. default 60000
+	DbStatementTimeoutMs int
+	// isolation level of transactions, one of "read committed",
+	// "repeatable read" or "serializable". the enqueue & retry-now handlers
+	// read & save tasks in a transaction, other handlers that write through
+	// the datastore don't. default is the database's default
+	DbTxIsolation string
+	// times a transaction is retried when it fails to serialize with a
+	// concurrent transaction, default 3
+	DbTxMaxRetries int
+	// LogQueries will log every SQL statement & it's duration when true, default false
+	LogQueries bool
+	// PrettyJson indents every JSON response when true, instead of only
+	// responses to requests with a pretty=true param. default false
+	PrettyJson bool
+	// RequestTimeoutSeconds is the maximum duration of a request before
+	// it's cancelled & responds with a 503, default 30
+	RequestTimeoutSeconds int
+	// seconds each external dependency has to respond to the startup self
+	// check, 0 skips the self check. default 5
+	SelfCheckTimeoutSeconds int
+	// refuse to start in production if the self check finds postgres or
+	// amqp unreachable, default false
+	SelfCheckRequired bool
+	// largest JSON request body the API will read, in bytes. 0 means
+	// no limit. default 1048576
+	MaxRequestBodyBytes int
+	// requests that take longer than SlowRequestThresholdMs milliseconds
+	// are logged as warnings, 0 disables slow request logging. default 1000
+	SlowRequestThresholdMs int
+	// StaticMaxAgeSeconds sets the Cache-Control max-age for static assets, default 86400
+	StaticMaxAgeSeconds int
+	// minutes /healthz allows queued tasks to wait without any task
+	// succeeding before reporting the server unhealthy. 0 disables, default 0
+	HealthTaskSuccessWindowMinutes int
+	// require every task to have a unique title, default false
+	UniqueTitles bool
+	// collapse whitespace in the titles of new tasks, default false
+	NormalizeTaskTitles bool
+	// normalize the "url" param of new tasks, lowercasing the host & removing
+	// default ports, so equivalent urls match. default false
+	NormalizeTaskUrls bool
+	// also remove trailing slashes when normalizing urls, default false
+	TrimTaskUrlTrailingSlashes bool
+	// refuse new tasks that share a type & url with a task that hasn't
+	// finished or failed, comparing normalized urls. default false
+	UniqueTaskUrls bool
+	// refuse changes to the type or params of finished & failed tasks,
+	// which must be retried or cloned instead. default false
+	LockFinishedTaskDefinitions bool
+	// maximum number of characters in a task title & error message,
+	// tasks that exceed either are rejected. 0 means no limit.
+	// defaults are 500 & 10000
+	TaskMaxTitleLength int
+	TaskMaxErrorLength int
+	// format of task timestamps in API responses, either "rfc3339" or "unix".
+	// default rfc3339
+	TimestampFormat string
+	// text/template for generating titles of tasks saved without one,
+	// see tasks.TitleTemplate for the default
+	TaskTitleTemplate string
+	// where to publish an event each time a task changes status, either
+	// "none" or "redis". redis events are published to TaskEventsChannel
+	// using RedisUrl. default none
+	TaskEventsPublisher string
+	// redis channel task events are published to, default task_events
+	TaskEventsChannel string
+	// User-Agent header sent with outbound http requests, default task-mgmt/[version]
+	UserAgent string
+	// FaviconPath is the file to serve for /favicon.ico, default public/favicon.ico
+	FaviconPath string
+	// html/template file for the 404 page served outside the API, templates
+	// are passed the requested .Path. a built-in page is used when empty
+	NotFoundTemplate string
+}
+
+// cfgValue holds the global configuration for the server. It's read in at startup from
+// .env files and enviornment variables. Access it with currentConfig & setConfig,
+// which are safe for concurrent use
+var cfgValue atomic.Value
+
+// currentConfig returns the active server configuration. The returned config
+// must be treated as read-only, use setConfig to replace it
+func currentConfig() *config {
+	cfg, _ := cfgValue.Load().(*config)
+	return cfg
+}
+
+// setConfig replaces the active server configuration
+func setConfig(cfg *config) {
+	cfgValue.Store(cfg)
+}
+
+// configDefaults are set as environment variables before config is read,
+// unless the variable is already set. config can't read empty values
+// into non-string fields, so every non-string field should have a default here
+var configDefaults = map[string]string{
+	"REQUEST_TIMEOUT_SECONDS":            "30",
+	"SELF_CHECK_TIMEOUT_SECONDS":         "5",
+	"MAX_REQUEST_BODY_BYTES":             "1048576",
+	"SLOW_REQUEST_THRESHOLD_MS":          "1000",
+	"EMAIL_CONCURRENCY":                  "2",
+	"EMAIL_RATE_LIMIT":                   "10",
+	"STATIC_MAX_AGE_SECONDS":             "86400",
+	"FAVICON_PATH":                       "public/favicon.ico",
+	"USER_AGENT":                         "task-mgmt/" + version,
+	"TASK_EVENTS_CHANNEL":                "task_events",
+	"HTTP_MAX_RETRIES":                   "3",
+	"WORKER_HEARTBEAT_TIMEOUT_SECONDS":   "120",
+	"TASK_MAX_TITLE_LENGTH":              "500",
+	"TASK_MAX_ERROR_LENGTH":              "10000",
+	"SHUTDOWN_TIMEOUT_SECONDS":           "30",
+	"DB_STATEMENT_TIMEOUT_MS":            "60000",
+	"DB_TX_MAX_RETRIES":                  "3",
+	"TASK_ARCHIVE_AFTER_DAYS":            "0",
+	"SOURCE_DRIFT_CHECK_MINUTES":         "0",
+	"SOURCE_DRIFT_SAMPLE_SIZE":           "10",
+	"MAX_ACTIVE_RUNS":                    "0",
+	"MAX_READY_TASKS_PER_OWNER":          "0",
+	"MIN_RERUN_INTERVAL_SECONDS":         "0",
+	"HEALTH_TASK_SUCCESS_WINDOW_MINUTES": "0",
+	"DEFAULT_PAGE_SIZE":                  "50",
+	"MAX_PAGE_SIZE":                      "200",
 }
 
 // initConfig pulls configuration from config.json
@@ -61,15 +276,16 @@ func initConfig(mode string) (cfg *config, err error) {
 
 	if path := configFilePath(mode, cfg); path != "" {
 		log.Infof("loading config file: %s", filepath.Base(path))
-		if err := conf.Load(cfg, path); err != nil {
-			log.Info("error loading config:", err)
-		}
-	} else {
-		if err := conf.Load(cfg); err != nil {
+		if err := loadConfigFile(path); err != nil {
 			log.Info("error loading config:", err)
 		}
 	}
 
+	setConfigDefaults()
+	if err := conf.Load(cfg); err != nil {
+		log.Info("error loading config:", err)
+	}
+
 	// make sure port is set
 	if cfg.Port == "" {
 		cfg.Port = "8080"
@@ -80,6 +296,58 @@ func initConfig(mode string) (cfg *config, err error) {
 		"POSTGRES_DB_URL": cfg.PostgresDbUrl,
 	})
 
+	// drop any malformed notification addresses, refusing to start in production
+	recipients, rerr := parseRecipients(strings.Join(cfg.EmailNotificationRecipients, ","))
+	if rerr != nil {
+		if mode == PRODUCTION_MODE && err == nil {
+			err = rerr
+		}
+		log.Info(rerr.Error())
+	}
+	cfg.EmailNotificationRecipients = recipients
+
+	switch cfg.TimestampFormat {
+	case "", tasks.TimestampRFC3339, tasks.TimestampUnix:
+	default:
+		if err == nil {
+			err = fmt.Errorf("TIMESTAMP_FORMAT must be either '%s' or '%s'", tasks.TimestampRFC3339, tasks.TimestampUnix)
+		}
+	}
+
+	if _, _, oerr := (tasks.TaskQuery{OrderBy: cfg.TaskListOrder}).SQL(); oerr != nil && err == nil {
+		err = fmt.Errorf("TASK_LIST_ORDER is invalid: %s", oerr.Error())
+	}
+
+	if _, ok := txIsolationLevels[cfg.DbTxIsolation]; !ok && err == nil {
+		err = fmt.Errorf("DB_TX_ISOLATION must be one of 'read committed', 'repeatable read' or 'serializable'")
+	}
+
+	if cfg.TLS {
+		if _, terr := serverTLSConfig(cfg); terr != nil && err == nil {
+			err = terr
+		}
+	}
+
+	if _, perr := newEventPublisher(cfg.TaskEventsPublisher, cfg.TaskEventsChannel); perr != nil && err == nil {
+		err = perr
+	}
+
+	switch cfg.QueueFullBehavior {
+	case "", QueueFullReject, QueueFullBlock, QueueFullFair:
+	default:
+		if err == nil {
+			err = fmt.Errorf("QUEUE_FULL_BEHAVIOR must be one of '%s', '%s' or '%s'", QueueFullReject, QueueFullBlock, QueueFullFair)
+		}
+	}
+
+	if cfg.TaskRequestQueue != "" && cfg.AmqpUrl == "" && err == nil {
+		err = fmt.Errorf("AMQP_URL env variable or config key must be set when TASK_REQUEST_QUEUE is set")
+	}
+
+	if cfg.PostmarkKey != "" && cfg.PostmarkFromAddress == "" && err == nil {
+		err = fmt.Errorf("POSTMARK_FROM_ADDRESS env variable or config key must be set when POSTMARK_KEY is set")
+	}
+
 	// output to stdout in dev mode
 	if mode == DEVELOP_MODE {
 		log.Out = os.Stdout
@@ -88,6 +356,16 @@ func initConfig(mode string) (cfg *config, err error) {
 	return
 }
 
+// setConfigDefaults writes configDefaults to the environment for
+// any variables that aren't already set
+func setConfigDefaults() {
+	for key, value := range configDefaults {
+		if os.Getenv(key) == "" {
+			os.Setenv(key, value)
+		}
+	}
+}
+
 func packagePath(path string) string {
 	return filepath.Join(os.Getenv("GOPATH"), "src/github.com/datatogether/task_mgmt", path)
 }
@@ -103,6 +381,31 @@ func requireConfigStrings(values map[string]string) error {
 	return nil
 }
 
+// parseRecipients splits a comma-separated list of email addresses,
+// returning all valid addresses. If any entries fail to parse, the returned
+// error lists them
+func parseRecipients(raw string) ([]string, error) {
+	recipients := []string{}
+	invalid := []string{}
+	for _, entry := range strings.Split(raw, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		addr, err := mail.ParseAddress(entry)
+		if err != nil {
+			invalid = append(invalid, entry)
+			continue
+		}
+		recipients = append(recipients, addr.Address)
+	}
+
+	if len(invalid) > 0 {
+		return recipients, fmt.Errorf("invalid email notification recipients: %s", strings.Join(invalid, ", "))
+	}
+	return recipients, nil
+}
+
 // checks for .[mode].env file to read configuration from if the file exists
 // defaults to .env, returns "" if no file is present
 func configFilePath(mode string, cfg *config) string {
@@ -116,6 +419,95 @@ func configFilePath(mode string, cfg *config) string {
 	return fileName
 }
 
+// rxEnvRef matches ${VAR} references in config file values
+var rxEnvRef = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// loadConfigFile reads a .env file into the environment, expanding ${VAR}
+// references in values. references resolve to the environment first, then
+// to other keys in the same file, regardless of the order keys are listed.
+// Referenced variables that aren't set expand to an empty string, references
+// that form a cycle are an error. Like godotenv.Load, variables that are
+// already set aren't overwritten
+func loadConfigFile(path string) error {
+	env, err := godotenv.Read(path)
+	if err != nil {
+		return err
+	}
+
+	r := &envResolver{file: env, resolved: map[string]string{}, resolving: map[string]bool{}}
+	for key := range env {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		value, err := r.resolve(key)
+		if err != nil {
+			return err
+		}
+		os.Setenv(key, value)
+	}
+	return nil
+}
+
+// envResolver expands the values of a config file
+type envResolver struct {
+	// raw values read from the file
+	file map[string]string
+	// expanded values of file keys
+	resolved map[string]string
+	// file keys currently being expanded, for detecting cycles
+	resolving map[string]bool
+}
+
+// resolve returns the expanded value of the file key name
+func (r *envResolver) resolve(name string) (string, error) {
+	if value, ok := r.resolved[name]; ok {
+		return value, nil
+	}
+	if r.resolving[name] {
+		return "", fmt.Errorf("config file reference cycle at: %s", name)
+	}
+	r.resolving[name] = true
+	defer delete(r.resolving, name)
+
+	value, err := expandEnvRefs(r.file[name], r.lookup)
+	if err != nil {
+		return "", err
+	}
+	r.resolved[name] = value
+	return value, nil
+}
+
+// lookup reads a referenced variable from the environment, falling back to
+// the file
+func (r *envResolver) lookup(name string) (string, bool, error) {
+	if value, ok := os.LookupEnv(name); ok {
+		return value, true, nil
+	}
+	if _, ok := r.file[name]; ok {
+		value, err := r.resolve(name)
+		return value, true, err
+	}
+	return "", false, nil
+}
+
+// expandEnvRefs replaces ${VAR} references in s with values from lookup.
+// other uses of $ are left as-is
+func expandEnvRefs(s string, lookup func(name string) (string, bool, error)) (string, error) {
+	var err error
+	expanded := rxEnvRef.ReplaceAllStringFunc(s, func(ref string) string {
+		name := rxEnvRef.FindStringSubmatch(ref)[1]
+		value, ok, lerr := lookup(name)
+		if lerr != nil && err == nil {
+			err = lerr
+		}
+		if !ok {
+			log.Infof("config references unset environment variable: %s", name)
+		}
+		return value
+	})
+	return expanded, err
+}
+
 // Does this file exist?
 func fileExists(path string) bool {
 	_, err := os.Stat(path)
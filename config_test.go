@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestParseRecipients(t *testing.T) {
+	cases := []struct {
+		raw    string
+		expect []string
+		err    bool
+	}{
+		{"", []string{}, false},
+		{"a@b.com", []string{"a@b.com"}, false},
+		{"a@b.com, Jane Doe <jane@b.com>", []string{"a@b.com", "jane@b.com"}, false},
+		{"not_an_email", []string{}, true},
+		{"a@b.com,not_an_email,c@d.org", []string{"a@b.com", "c@d.org"}, true},
+	}
+
+	for i, c := range cases {
+		got, err := parseRecipients(c.raw)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if len(got) != len(c.expect) {
+			t.Errorf("case %d length mismatch. expected: %d, got: %d", i, len(c.expect), len(got))
+			continue
+		}
+		for j, addr := range c.expect {
+			if got[j] != addr {
+				t.Errorf("case %d recipient %d mismatch. expected: %s, got: %s", i, j, addr, got[j])
+			}
+		}
+	}
+}
+
+func TestConcurrentConfigAccess(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+
+	done := make(chan bool)
+	for i := 0; i < 10; i++ {
+		go func() {
+			for j := 0; j < 100; j++ {
+				if cfg := currentConfig(); cfg == nil {
+					t.Errorf("expected config to be set")
+				}
+			}
+			done <- true
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		setConfig(&config{Port: "8080"})
+	}
+
+	for i := 0; i < 10; i++ {
+		<-done
+	}
+}
+
+func TestInitConfigRequiresPostmarkFromAddress(t *testing.T) {
+	prev := map[string]string{}
+	for _, key := range []string{"POSTGRES_DB_URL", "POSTMARK_KEY", "POSTMARK_FROM_ADDRESS"} {
+		prev[key] = os.Getenv(key)
+	}
+	defer func() {
+		for key, val := range prev {
+			os.Setenv(key, val)
+		}
+	}()
+
+	os.Setenv("POSTGRES_DB_URL", "postgres://localhost")
+	os.Setenv("POSTMARK_KEY", "test_key")
+	os.Setenv("POSTMARK_FROM_ADDRESS", "")
+	if _, err := initConfig(TEST_MODE); err == nil {
+		t.Errorf("expected missing from address with postmark key to error")
+	}
+
+	os.Setenv("POSTMARK_FROM_ADDRESS", "tasks@datatogether.org")
+	if _, err := initConfig(TEST_MODE); err != nil {
+		t.Errorf("unexpected error: %s", err.Error())
+	}
+}
+
+func TestLoadConfigFile(t *testing.T) {
+	keys := []string{"TEST_CFG_SECRET", "TEST_CFG_MISSING", "TEST_CFG_INTERPOLATED", "TEST_CFG_LITERAL", "TEST_CFG_DOLLAR", "TEST_CFG_UNSET_REF", "TEST_CFG_HOST", "TEST_CFG_URL", "TEST_CFG_URL_PATH"}
+	for _, key := range keys {
+		prev, set := os.LookupEnv(key)
+		os.Unsetenv(key)
+		defer func(key, prev string, set bool) {
+			if set {
+				os.Setenv(key, prev)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key, prev, set)
+	}
+	os.Setenv("TEST_CFG_SECRET", "postgres://secret@localhost")
+
+	f, err := ioutil.TempFile("", "task_mgmt_test_env")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`TEST_CFG_INTERPOLATED="${TEST_CFG_SECRET}?sslmode=disable"
+TEST_CFG_LITERAL=plain_value
+TEST_CFG_DOLLAR=pa$$word$TEST_CFG_SECRET
+TEST_CFG_UNSET_REF=${TEST_CFG_MISSING}
+TEST_CFG_URL_PATH=${TEST_CFG_URL}/path
+TEST_CFG_URL=http://${TEST_CFG_HOST}
+TEST_CFG_HOST=localhost
+`)
+	f.Close()
+
+	if err := loadConfigFile(f.Name()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := map[string]string{
+		"TEST_CFG_INTERPOLATED": "postgres://secret@localhost?sslmode=disable",
+		"TEST_CFG_LITERAL":      "plain_value",
+		"TEST_CFG_DOLLAR":       "pa$$word$TEST_CFG_SECRET",
+		"TEST_CFG_UNSET_REF":    "",
+		"TEST_CFG_URL":          "http://localhost",
+		"TEST_CFG_URL_PATH":     "http://localhost/path",
+	}
+	for key, value := range expect {
+		if got := os.Getenv(key); got != value {
+			t.Errorf("%s mismatch. expected: %q, got: %q", key, value, got)
+		}
+	}
+}
+
+func TestLoadConfigFileCycle(t *testing.T) {
+	for _, key := range []string{"TEST_CFG_CYCLE_A", "TEST_CFG_CYCLE_B"} {
+		os.Unsetenv(key)
+		defer os.Unsetenv(key)
+	}
+
+	f, err := ioutil.TempFile("", "task_mgmt_test_env")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.Remove(f.Name())
+	f.WriteString(`TEST_CFG_CYCLE_A=${TEST_CFG_CYCLE_B}
+TEST_CFG_CYCLE_B=${TEST_CFG_CYCLE_A}
+`)
+	f.Close()
+
+	if err := loadConfigFile(f.Name()); err == nil {
+		t.Errorf("expected a reference cycle to error")
+	}
+}
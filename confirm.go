@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// confirmations holds tokens for confirming dangerous actions
+var confirmations = newConfirmationTokens(time.Minute)
+
+// confirmationTokens issues short-lived, single-use tokens that must be
+// presented to perform dangerous actions like deleting a task. This keeps
+// a stray link or a crawler from performing the action in one request
+type confirmationTokens struct {
+	sync.Mutex
+	// how long a token is valid for
+	ttl time.Duration
+	// clock, overridable for testing
+	now func() time.Time
+	// map of token to the action & expiry it was issued for
+	tokens map[string]confirmation
+}
+
+type confirmation struct {
+	action  string
+	expires time.Time
+}
+
+func newConfirmationTokens(ttl time.Duration) *confirmationTokens {
+	return &confirmationTokens{
+		ttl:    ttl,
+		now:    time.Now,
+		tokens: map[string]confirmation{},
+	}
+}
+
+// Issue creates a new token for action, returning the token & it's expiry
+func (c *confirmationTokens) Issue(action string) (string, time.Time, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", time.Time{}, err
+	}
+	token := hex.EncodeToString(buf)
+
+	c.Lock()
+	defer c.Unlock()
+
+	now := c.now()
+	// drop any expired tokens while we're here
+	for t, conf := range c.tokens {
+		if now.After(conf.expires) {
+			delete(c.tokens, t)
+		}
+	}
+
+	expires := now.Add(c.ttl)
+	c.tokens[token] = confirmation{action: action, expires: expires}
+	return token, expires, nil
+}
+
+// Redeem checks that token was issued for action & hasn't expired.
+// tokens can only be redeemed once
+func (c *confirmationTokens) Redeem(token, action string) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	conf, ok := c.tokens[token]
+	if !ok {
+		return false
+	}
+	delete(c.tokens, token)
+	return conf.action == action && !c.now().After(conf.expires)
+}
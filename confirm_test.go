@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfirmationTokens(t *testing.T) {
+	now := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := newConfirmationTokens(time.Minute)
+	c.now = func() time.Time { return now }
+
+	token, expires, err := c.Issue("delete:a")
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if !expires.Equal(now.Add(time.Minute)) {
+		t.Errorf("expiry mismatch. expected: %s, got: %s", now.Add(time.Minute), expires)
+	}
+
+	if c.Redeem("not_a_token", "delete:a") {
+		t.Errorf("expected unknown token to be refused")
+	}
+	if !c.Redeem(token, "delete:a") {
+		t.Errorf("expected valid token to be accepted")
+	}
+	if c.Redeem(token, "delete:a") {
+		t.Errorf("expected token to only be redeemable once")
+	}
+
+	token, _, _ = c.Issue("delete:a")
+	if c.Redeem(token, "delete:b") {
+		t.Errorf("expected token for a different action to be refused")
+	}
+
+	token, _, _ = c.Issue("delete:a")
+	now = now.Add(time.Minute + time.Second)
+	if c.Redeem(token, "delete:a") {
+		t.Errorf("expected expired token to be refused")
+	}
+}
@@ -1,88 +1,153 @@
 // transactional email handled by postmark
 package main
 
-// import (
-// 	"encoding/json"
-// 	"fmt"
-// 	"github.com/datatogether/task_mgmt/tasks"
-// 	"io"
-// 	"io/ioutil"
-// 	"net/http"
-// 	"strings"
-// )
-
-// // SendTaskRequestEmail sends an email to cfg.EmailNotificationRecipients
-// // with details for a newly requested task
-// func SendTaskRequestEmail(t *tasks.Task) error {
-// 	if len(cfg.EmailNotificationRecipients) == 0 {
-// 		return fmt.Errorf("no recipients are set to send email to")
-// 	}
-
-// 	body := fmt.Sprintf(`{
-//     "From" : "brendan@qri.io",
-//     "To" : "%s",
-//     "Tag" : "feedback",
-//     "Subject" : "Injest Request: %s",
-//     "TextBody" : "requested: %s\nsource url: %s\n"
-//   }`,
-// 		strings.Join(cfg.EmailNotificationRecipients, ","),
-// 		t.Title,
-// 		t.Request,
-// 		t.SourceUrl,
-// 	)
-
-// 	return sendEmail(strings.NewReader(body))
-// }
-
-// // SendTaskRequestEmail sends an email to cfg.EmailNotificationRecipients
-// // notifying them of a cancelled request
-// func SendTaskCancelEmail(t *tasks.Task) error {
-// 	if len(cfg.EmailNotificationRecipients) == 0 {
-// 		return fmt.Errorf("no recipients are set to send email to")
-// 	}
-
-// 	body := fmt.Sprintf(`{
-//     "From" : "brendan@qri.io",
-//     "To" : "%s",
-//     "Tag" : "feedback",
-//     "Subject" : "Request Cancelled: %s",
-//     "TextBody" : "requested: %s\nsource url: %s\ncancelled: %s"
-//   }`,
-// 		strings.Join(cfg.EmailNotificationRecipients, ","),
-// 		t.Title,
-// 		t.Request,
-// 		t.SourceUrl,
-// 		t.Fail,
-// 	)
-
-// 	return sendEmail(strings.NewReader(body))
-// }
-
-// // send an email using postmark transactional email service
-// // postmarkapp.com
-// func sendEmail(jsonBody io.Reader) error {
-// 	if cfg.PostmarkKey == "" {
-// 		return fmt.Errorf("missing postmark key for sending email")
-// 	}
-
-// 	url := "https://api.postmarkapp.com/email/"
-
-// 	req, err := http.NewRequest("POST", url, jsonBody)
-// 	if err != nil {
-// 		return err
-// 	}
-// 	req.Header.Add("X-Postmark-Server-Token", cfg.PostmarkKey)
-// 	req.Header.Add("Accept", "application/json")
-// 	req.Header.Add("Content-Type", "application/json")
-// 	req.Body = ioutil.NopCloser(jsonBody)
-
-// 	res, err := http.DefaultClient.Do(req)
-// 	// if the server responds with an error, process & log out
-// 	if res.StatusCode == 422 {
-// 		responseBody := map[string]interface{}{}
-// 		json.NewDecoder(res.Body).Decode(&responseBody)
-// 		log.Info(responseBody)
-// 	}
-
-// 	return err
-// }
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/datatogether/task_mgmt/tasks"
+)
+
+// emailMessage is a single outgoing email, fields match the postmark api
+type emailMessage struct {
+	From     string `json:"From"`
+	To       string `json:"To"`
+	Tag      string `json:"Tag,omitempty"`
+	Subject  string `json:"Subject"`
+	TextBody string `json:"TextBody"`
+	// postmark message stream, the default stream is used if empty
+	MessageStream string `json:"MessageStream,omitempty"`
+	// id of the task this message is about, if any. used for logging
+	taskId string
+}
+
+// emailSender is anything that can send an email message
+type emailSender interface {
+	SendEmail(msg *emailMessage) error
+}
+
+// mailer is the emailSender used for task notifications
+var mailer emailSender = postmarkSender{ApiUrl: "https://api.postmarkapp.com/email"}
+
+// postmarkSender sends email using postmark transactional email service
+// postmarkapp.com
+type postmarkSender struct {
+	// url to post messages to
+	ApiUrl string
+}
+
+// SendEmail posts msg to the postmark api, using the configured from address
+// & message stream for any message that doesn't specify them
+func (p postmarkSender) SendEmail(msg *emailMessage) error {
+	cfg := currentConfig()
+	if cfg.PostmarkKey == "" {
+		return fmt.Errorf("missing postmark key for sending email")
+	}
+
+	m := *msg
+	if m.From == "" {
+		m.From = cfg.PostmarkFromAddress
+	}
+	if m.MessageStream == "" {
+		m.MessageStream = cfg.PostmarkMessageStream
+	}
+
+	body, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", p.ApiUrl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("X-Postmark-Server-Token", cfg.PostmarkKey)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// if the server responds with an error, process & return it
+	if res.StatusCode != http.StatusOK {
+		responseBody := map[string]interface{}{}
+		json.NewDecoder(res.Body).Decode(&responseBody)
+		return fmt.Errorf("postmark error %d: %v", res.StatusCode, responseBody["Message"])
+	}
+
+	return nil
+}
+
+// SendTaskRequestEmail sends an email to the task's recipients
+// with details for a newly requested task. see taskRecipients
+func SendTaskRequestEmail(sender emailSender, t *tasks.Task) error {
+	recipients := taskRecipients(currentConfig(), t)
+	if len(recipients) == 0 {
+		return fmt.Errorf("no recipients are set to send email to")
+	}
+
+	return sender.SendEmail(&emailMessage{
+		To:       strings.Join(recipients, ","),
+		Tag:      "task-request",
+		Subject:  fmt.Sprintf("Task Request: %s", t.Title),
+		TextBody: fmt.Sprintf("requested: %s\ntype: %s\nuser: %s\n", t.Created, t.Type, t.UserId),
+		taskId:   t.Id,
+	})
+}
+
+// taskRecipients returns the addresses notified about t: the task's own
+// NotifyEmails added to cfg.EmailNotificationRecipients, or in place of them
+// if cfg.TaskNotifyEmailsReplace is true & the task sets any
+func taskRecipients(cfg *config, t *tasks.Task) []string {
+	if cfg.TaskNotifyEmailsReplace && len(t.NotifyEmails) > 0 {
+		return t.NotifyEmails
+	}
+
+	recipients := append([]string{}, cfg.EmailNotificationRecipients...)
+	for _, addr := range t.NotifyEmails {
+		dup := false
+		for _, r := range recipients {
+			if strings.EqualFold(r, addr) {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			recipients = append(recipients, addr)
+		}
+	}
+	return recipients
+}
+
+// emailConfigured reports whether cfg has what's needed to send notifications
+// about t, it's common for development setups to have neither a postmark key
+// or recipients
+func emailConfigured(cfg *config, t *tasks.Task) bool {
+	return cfg != nil && cfg.PostmarkKey != "" && len(taskRecipients(cfg, t)) > 0
+}
+
+// notifyTaskRequest sends a task request email, logging & counting any failure.
+// notifications are best-effort, a failed send shouldn't interrupt the task.
+// notifyTaskRequest does nothing if email isn't configured, or for tasks
+// that don't set NotifyEmails when cfg.TaskNotifyOptIn is true
+func notifyTaskRequest(sender emailSender, t *tasks.Task) {
+	cfg := currentConfig()
+	if cfg != nil && cfg.TaskNotifyOptIn && len(t.NotifyEmails) == 0 {
+		log.Debugf("task hasn't opted in to notifications, skipping task request email. task: %s", t.Id)
+		return
+	}
+	if !emailConfigured(cfg, t) {
+		log.Debugf("email isn't configured, skipping task request email. task: %s", t.Id)
+		return
+	}
+	if err := SendTaskRequestEmail(sender, t); err != nil {
+		emailSendFailures.Add(1)
+		log.Errorf("error sending task request email. task: %s, recipients: %d, error: %s", t.Id, len(taskRecipients(cfg, t)), err.Error())
+	}
+}
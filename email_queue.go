@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clock abstracts time for components that wait, so tests can use a fake
+type clock interface {
+	Now() time.Time
+	Sleep(d time.Duration)
+}
+
+// realClock is a clock backed by the time package
+type realClock struct{}
+
+func (realClock) Now() time.Time        { return time.Now() }
+func (realClock) Sleep(d time.Duration) { time.Sleep(d) }
+
+// emailQueue is an emailSender that queues messages instead of sending
+// them immediately, delivering them in the order they're queued with a bounded
+// number of concurrent sends, at no more than a set number of messages per second.
+// Send failures are logged & counted, as callers have already moved on
+type emailQueue struct {
+	sender emailSender
+	clock  clock
+	// minimum duration between the start of two sends, 0 is unlimited
+	interval time.Duration
+	msgs     chan *emailMessage
+	wg       sync.WaitGroup
+
+	// guards closed, held for reading while queueing a message
+	closeLock sync.RWMutex
+	// set once the queue stops accepting messages
+	closed bool
+
+	// guards last
+	lock sync.Mutex
+	// start time of the most recent send
+	last time.Time
+}
+
+// newEmailQueue starts a queue that sends with concurrency workers, at no more than
+// perSecond messages per second. perSecond <= 0 disables rate limiting
+func newEmailQueue(sender emailSender, concurrency, perSecond int, c clock) *emailQueue {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	q := &emailQueue{
+		sender: sender,
+		clock:  c,
+		msgs:   make(chan *emailMessage, 100),
+	}
+	if perSecond > 0 {
+		q.interval = time.Second / time.Duration(perSecond)
+	}
+
+	q.wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer q.wg.Done()
+			for msg := range q.msgs {
+				q.wait()
+				q.send(msg)
+			}
+		}()
+	}
+
+	return q
+}
+
+// wait blocks until the rate limit allows another send
+func (q *emailQueue) wait() {
+	if q.interval <= 0 {
+		return
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.last.IsZero() {
+		if wait := q.interval - q.clock.Now().Sub(q.last); wait > 0 {
+			q.clock.Sleep(wait)
+		}
+	}
+	q.last = q.clock.Now()
+}
+
+// errEmailQueueClosed is returned when sending to a queue that's shut down
+var errEmailQueueClosed = fmt.Errorf("email queue is closed")
+
+// SendEmail adds msg to the queue, blocking only if the queue is full
+func (q *emailQueue) SendEmail(msg *emailMessage) error {
+	q.closeLock.RLock()
+	defer q.closeLock.RUnlock()
+	if q.closed {
+		return errEmailQueueClosed
+	}
+	q.msgs <- msg
+	return nil
+}
+
+// Close stops accepting messages & waits for queued messages to send
+func (q *emailQueue) Close() {
+	q.closeLock.Lock()
+	if !q.closed {
+		q.closed = true
+		close(q.msgs)
+	}
+	q.closeLock.Unlock()
+	q.wg.Wait()
+}
+
+// Shutdown stops accepting messages & waits for queued messages to send,
+// returning ctx.Err() if ctx expires first. messages still queued then
+// are dropped when the process exits
+func (q *emailQueue) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		q.Close()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (q *emailQueue) send(msg *emailMessage) {
+	if err := q.sender.SendEmail(msg); err != nil {
+		emailSendFailures.Add(1)
+		log.Errorf("error sending email. task: %s, recipients: %d, error: %s", msg.taskId, len(strings.Split(msg.To, ",")), err.Error())
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClock only advances when slept
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// recordingSender records each message it's asked to send, along with the time
+type recordingSender struct {
+	sync.Mutex
+	clock    clock
+	subjects []string
+	to       []string
+	times    []time.Time
+}
+
+func (s *recordingSender) SendEmail(msg *emailMessage) error {
+	s.Lock()
+	defer s.Unlock()
+	s.subjects = append(s.subjects, msg.Subject)
+	s.to = append(s.to, msg.To)
+	s.times = append(s.times, s.clock.Now())
+	return nil
+}
+
+func TestEmailQueue(t *testing.T) {
+	c := &fakeClock{now: time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)}
+	sender := &recordingSender{clock: c}
+	q := newEmailQueue(sender, 1, 2, c)
+
+	for i := 0; i < 5; i++ {
+		q.SendEmail(&emailMessage{Subject: fmt.Sprintf("%d", i)})
+	}
+	q.Close()
+
+	if len(sender.subjects) != 5 {
+		t.Errorf("expected 5 sent messages, got: %d", len(sender.subjects))
+		return
+	}
+	for i, subject := range sender.subjects {
+		if subject != fmt.Sprintf("%d", i) {
+			t.Errorf("message %d sent out of order. got: %s", i, subject)
+		}
+		if i > 0 {
+			if gap := sender.times[i].Sub(sender.times[i-1]); gap < time.Millisecond*500 {
+				t.Errorf("messages %d & %d sent %s apart, expected at least 500ms", i-1, i, gap)
+			}
+		}
+	}
+}
+
+// blockingSender blocks every send until release is closed
+type blockingSender struct {
+	release chan struct{}
+}
+
+func (s blockingSender) SendEmail(msg *emailMessage) error {
+	<-s.release
+	return nil
+}
+
+func TestEmailQueueShutdown(t *testing.T) {
+	sender := &recordingSender{clock: realClock{}}
+	q := newEmailQueue(sender, 2, 0, realClock{})
+	for i := 0; i < 5; i++ {
+		q.SendEmail(&emailMessage{Subject: fmt.Sprintf("%d", i)})
+	}
+	if err := q.Shutdown(context.Background()); err != nil {
+		t.Fatalf("unexpected shutdown error: %s", err)
+	}
+	if len(sender.subjects) != 5 {
+		t.Errorf("expected shutdown to send all queued messages, sent: %d", len(sender.subjects))
+	}
+	if err := q.SendEmail(&emailMessage{}); err != errEmailQueueClosed {
+		t.Errorf("expected sending after shutdown to error, got: %v", err)
+	}
+	// closing twice is harmless
+	q.Close()
+
+	release := make(chan struct{})
+	defer close(release)
+	stuck := newEmailQueue(blockingSender{release}, 1, 0, realClock{})
+	stuck.SendEmail(&emailMessage{})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := stuck.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected shutdown to give up when ctx expires, got: %v", err)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/datatogether/task_mgmt/tasks"
+)
+
+type failingSender struct{}
+
+func (failingSender) SendEmail(msg *emailMessage) error {
+	return fmt.Errorf("postmark is down")
+}
+
+func TestNotifyTaskRequestFailure(t *testing.T) {
+	prev := currentConfig()
+	c := *prev
+	c.PostmarkKey = "test_key"
+	c.EmailNotificationRecipients = []string{"a@b.com"}
+	setConfig(&c)
+	defer setConfig(prev)
+
+	before := emailSendFailures.Value()
+	notifyTaskRequest(failingSender{}, &tasks.Task{Id: "test_task", Title: "test"})
+	if got := emailSendFailures.Value(); got != before+1 {
+		t.Errorf("expected email send failures to increment to %d, got: %d", before+1, got)
+	}
+}
+
+func TestNotifyTaskRequestUnconfigured(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+
+	cases := []config{
+		{},
+		{PostmarkKey: "test_key"},
+		{EmailNotificationRecipients: []string{"a@b.com"}},
+	}
+	for i, c := range cases {
+		setConfig(&c)
+		sender := &recordingSender{clock: &fakeClock{}}
+		before := emailSendFailures.Value()
+		notifyTaskRequest(sender, &tasks.Task{Id: "test_task", Title: "test"})
+		if len(sender.subjects) != 0 {
+			t.Errorf("case %d: expected no email to be sent, sent: %d", i, len(sender.subjects))
+		}
+		if got := emailSendFailures.Value(); got != before {
+			t.Errorf("case %d: expected unconfigured email not to count as a failure", i)
+		}
+	}
+
+	c := config{PostmarkKey: "test_key", EmailNotificationRecipients: []string{"a@b.com"}}
+	setConfig(&c)
+	sender := &recordingSender{clock: &fakeClock{}}
+	notifyTaskRequest(sender, &tasks.Task{Id: "test_task", Title: "test"})
+	if len(sender.subjects) != 1 {
+		t.Errorf("expected configured email to be sent, sent: %d", len(sender.subjects))
+	}
+}
+
+func TestNotifyTaskRequestOptIn(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+	setConfig(&config{PostmarkKey: "test_key", EmailNotificationRecipients: []string{"ops@example.com"}, TaskNotifyOptIn: true})
+
+	sender := &recordingSender{clock: &fakeClock{}}
+	before := emailSendFailures.Value()
+	notifyTaskRequest(sender, &tasks.Task{Id: "test_task", Title: "test"})
+	if len(sender.to) != 0 {
+		t.Errorf("expected no email for a task that hasn't opted in, sent to: %v", sender.to)
+	}
+	if got := emailSendFailures.Value(); got != before {
+		t.Errorf("expected a task that hasn't opted in not to count as a failure")
+	}
+
+	notifyTaskRequest(sender, &tasks.Task{Id: "test_task", Title: "test", NotifyEmails: []string{"team@example.com"}})
+	if len(sender.to) != 1 || sender.to[0] != "ops@example.com,team@example.com" {
+		t.Errorf("expected opted in task to be notified, sent to: %v", sender.to)
+	}
+}
+
+func TestNotifyTaskRequestTaskRecipients(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+
+	cases := []struct {
+		recipients   []string
+		replace      bool
+		notifyEmails []string
+		expect       string
+	}{
+		{[]string{"ops@example.com"}, false, nil, "ops@example.com"},
+		{[]string{"ops@example.com"}, false, []string{"team@example.com"}, "ops@example.com,team@example.com"},
+		{[]string{"ops@example.com"}, false, []string{"OPS@example.com", "team@example.com"}, "ops@example.com,team@example.com"},
+		{[]string{"ops@example.com"}, true, []string{"team@example.com"}, "team@example.com"},
+		{[]string{"ops@example.com"}, true, nil, "ops@example.com"},
+		{nil, false, []string{"team@example.com"}, "team@example.com"},
+		{nil, false, nil, ""},
+	}
+
+	for i, c := range cases {
+		setConfig(&config{PostmarkKey: "test_key", EmailNotificationRecipients: c.recipients, TaskNotifyEmailsReplace: c.replace})
+		sender := &recordingSender{clock: &fakeClock{}}
+		notifyTaskRequest(sender, &tasks.Task{Id: "test_task", Title: "test", NotifyEmails: c.notifyEmails})
+
+		if c.expect == "" {
+			if len(sender.to) != 0 {
+				t.Errorf("case %d: expected no email to be sent, sent to: %v", i, sender.to)
+			}
+			continue
+		}
+		if len(sender.to) != 1 || sender.to[0] != c.expect {
+			t.Errorf("case %d: recipient mismatch. expected: %s, got: %v", i, c.expect, sender.to)
+		}
+	}
+}
+
+func TestPostmarkSenderPayload(t *testing.T) {
+	prev := currentConfig()
+	c := *prev
+	c.PostmarkKey = "test_key"
+	c.PostmarkFromAddress = "tasks@datatogether.org"
+	c.PostmarkMessageStream = "notifications"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	var (
+		got   emailMessage
+		token string
+	)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token = r.Header.Get("X-Postmark-Server-Token")
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer s.Close()
+
+	sender := postmarkSender{ApiUrl: s.URL}
+	if err := sender.SendEmail(&emailMessage{To: "a@b.com", Subject: "test"}); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if token != "test_key" {
+		t.Errorf("server token mismatch. expected: %s, got: %s", "test_key", token)
+	}
+	if got.From != "tasks@datatogether.org" {
+		t.Errorf("From mismatch. expected: %s, got: %s", "tasks@datatogether.org", got.From)
+	}
+	if got.MessageStream != "notifications" {
+		t.Errorf("MessageStream mismatch. expected: %s, got: %s", "notifications", got.MessageStream)
+	}
+}
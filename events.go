@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/datatogether/task_mgmt/tasks"
+)
+
+const (
+	// EventsPublisherNone discards task events
+	EventsPublisherNone = "none"
+	// EventsPublisherRedis publishes task events to a redis pub/sub channel
+	EventsPublisherRedis = "redis"
+)
+
+// TaskEvent describes a task changing status, published for other services
+// to consume
+type TaskEvent struct {
+	// kind of event, always "task.status"
+	Type string `json:"type"`
+	// id of the task that changed
+	TaskId string `json:"taskId"`
+	// status before & after the change. new tasks change from ""
+	From tasks.Status `json:"from"`
+	To   tasks.Status `json:"to"`
+	// time of the change
+	Time time.Time `json:"time"`
+	// the task as of the change
+	Task *tasks.Task `json:"task"`
+}
+
+// newTaskEvent creates an event for t changing from status from to it's
+// current status
+func newTaskEvent(t *tasks.Task, from tasks.Status) *TaskEvent {
+	task := *t
+	return &TaskEvent{
+		Type:   "task.status",
+		TaskId: t.Id,
+		From:   from,
+		To:     t.StatusString(),
+		Time:   time.Now().In(time.UTC),
+		Task:   &task,
+	}
+}
+
+// EventPublisher sends task events to an external broker
+type EventPublisher interface {
+	Publish(e *TaskEvent) error
+}
+
+// noopPublisher discards events
+type noopPublisher struct{}
+
+func (noopPublisher) Publish(e *TaskEvent) error { return nil }
+
+// redisPublisher publishes events as JSON to a redis pub/sub channel
+type redisPublisher struct {
+	channel string
+}
+
+func (p redisPublisher) Publish(e *TaskEvent) error {
+	// rpool connects in the background, read it when publishing
+	if rpool == nil {
+		return ErrNoRedisConn
+	}
+
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	c := rpool.Get()
+	defer c.Close()
+	_, err = c.Do("PUBLISH", p.channel, data)
+	return err
+}
+
+// newEventPublisher creates the EventPublisher named by kind, one of
+// EventsPublisherNone or EventsPublisherRedis. "" is the same as none
+func newEventPublisher(kind, channel string) (EventPublisher, error) {
+	switch kind {
+	case "", EventsPublisherNone:
+		return noopPublisher{}, nil
+	case EventsPublisherRedis:
+		if channel == "" {
+			return nil, fmt.Errorf("redis task events need a channel")
+		}
+		return redisPublisher{channel: channel}, nil
+	default:
+		return nil, fmt.Errorf("TASK_EVENTS_PUBLISHER must be either '%s' or '%s'", EventsPublisherNone, EventsPublisherRedis)
+	}
+}
+
+// events publishes task events, set from config at startup
+var events EventPublisher = noopPublisher{}
+
+// publishTaskEvent publishes t's change from status from. failing to
+// publish is logged & counted, but never fails the change itself
+func publishTaskEvent(t *tasks.Task, from tasks.Status) {
+	publishEvent(newTaskEvent(t, from))
+}
+
+func publishEvent(e *TaskEvent) {
+	if err := events.Publish(e); err != nil {
+		eventPublishFailures.Add(1)
+		log.Infof("error publishing event for task %s: %s", e.TaskId, err.Error())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+)
+
+// recordingPublisher captures published events, failing when err is set
+type recordingPublisher struct {
+	events []*TaskEvent
+	err    error
+}
+
+func (p *recordingPublisher) Publish(e *TaskEvent) error {
+	p.events = append(p.events, e)
+	return p.err
+}
+
+func TestPublishTaskEvents(t *testing.T) {
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+	pub := &recordingPublisher{}
+	prevEvents, prevHook := events, tasks.StatusChanged
+	events, tasks.StatusChanged = pub, publishTaskEvent
+	defer func() { events, tasks.StatusChanged = prevEvents, prevHook }()
+
+	s := datastore.NewMapDatastore()
+	task := &tasks.Task{Type: "test"}
+	if err := task.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	task.Claim("worker")
+	if err := task.Save(s); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := task.Cancel(); err != nil {
+		t.Fatal(err.Error())
+	}
+	// a failing publisher mustn't fail the save
+	pub.err = fmt.Errorf("broker down")
+	failures := eventPublishFailures.Value()
+	if err := task.Save(s); err != nil {
+		t.Fatalf("expected save to succeed when publishing fails, got: %s", err)
+	}
+	if eventPublishFailures.Value() != failures+1 {
+		t.Errorf("expected publish failure to be counted")
+	}
+
+	expect := []struct{ from, to tasks.Status }{
+		{"", tasks.StatusReady},
+		{tasks.StatusReady, tasks.StatusRunning},
+		{tasks.StatusRunning, tasks.StatusCancelled},
+	}
+	if len(pub.events) != len(expect) {
+		t.Fatalf("expected %d events, got: %d", len(expect), len(pub.events))
+	}
+	for i, c := range expect {
+		e := pub.events[i]
+		if e.Type != "task.status" || e.TaskId != task.Id || e.From != c.from || e.To != c.to {
+			t.Errorf("event %d mismatch. expected %s -> %s for task %s, got: %+v", i, c.from, c.to, task.Id, e)
+		}
+		if e.Task == nil || e.Task.StatusString() != c.to {
+			t.Errorf("event %d: expected a snapshot of the task as of the change", i)
+		}
+	}
+}
+
+func TestNewEventPublisher(t *testing.T) {
+	cases := []struct {
+		kind, channel string
+		err           bool
+	}{
+		{"", "", false},
+		{"none", "", false},
+		{"redis", "task_events", false},
+		{"redis", "", true},
+		{"kafka", "task_events", true},
+	}
+	for i, c := range cases {
+		if _, err := newEventPublisher(c.kind, c.channel); (err != nil) != c.err {
+			t.Errorf("case %d: expected error: %t, got: %v", i, c.err, err)
+		}
+	}
+}
@@ -1,13 +1,22 @@
 package main
 
 import (
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/datatogether/api/apiutil"
 	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"html/template"
 	"io"
 	"net/http"
+	"os"
+	"path"
+	"path/filepath"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -24,39 +33,82 @@ func TasksHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func EnqueueTaskHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
 	t := &tasks.Task{}
-	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+	if err := decodeJSONBody(w, r, t); err != nil {
 		log.Infoln(err)
-		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		writeBodyError(w, err)
 		return
 	}
 
-	// perform the task raw if no amqp url is specified
-	if cfg.AmqpUrl == "" {
-		now := time.Now()
-		t.Enqueued = &now
-		if err := t.Save(store); err != nil {
-			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
-			return
+	// fail fast instead of piling up tasks this server can't get to
+	if cfg.AmqpUrl == "" && localRuns.rejecting() {
+		writeQueueFull(w)
+		return
+	}
+
+	// checking the owner's ready tasks & saving the task happen in one
+	// transaction, so concurrent requests can't push an owner past
+	// MaxReadyTasksPerOwner when DbTxIsolation is serializable. the
+	// transaction may be retried, each attempt starts from the request body
+	var (
+		body = *t
+		// status for errors other than conflicts & invalid tasks
+		code int
+	)
+	err := WithTx(r.Context(), appDB, func(tx *sql.Tx) error {
+		*t = body
+		db := newQueryLoggerContext(r.Context(), tx)
+		txStore := tasks.SQLStore{DB: db}
+
+		if (t.Id == "" || r.URL.Path == "/tasks") && !adminAuthorized(r) {
+			code = http.StatusInternalServerError
+			if err := checkReadyTasks(db, cfg.MaxReadyTasksPerOwner, t.UserId); err != nil {
+				return err
+			}
+		}
+
+		// tasks performed raw when no amqp url is specified are enqueued
+		// now, otherwise Enqueue saves the task again once it's published
+		code = http.StatusBadRequest
+		if cfg.AmqpUrl == "" {
+			code = http.StatusInternalServerError
+			now := time.Now()
+			t.Enqueued = &now
+		}
+
+		// tasks posted to /tasks are always new. a client-supplied id that's
+		// already taken is a conflict, instead of an update to the existing task
+		if r.URL.Path == "/tasks" && t.Id != "" {
+			code = http.StatusBadRequest
+			return t.Create(txStore)
+		}
+		return t.Save(txStore)
+	})
+	if err != nil {
+		switch {
+		case err == errTooManyReadyTasks:
+			apiutil.WriteErrResponse(w, http.StatusTooManyRequests, fmt.Errorf("owner '%s' already has the maximum of %d tasks waiting to start", t.UserId, cfg.MaxReadyTasksPerOwner))
+		case err == tasks.ErrConflict || err == tasks.ErrNotRunnable:
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+		case errors.Is(err, tasks.ErrInvalidTask):
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		default:
+			log.Infoln(err)
+			apiutil.WriteErrResponse(w, code, err)
 		}
+		return
+	}
 
+	if cfg.AmqpUrl == "" {
 		task := tasks.Task{Id: t.Id}
 		if err := task.Read(store); err != nil {
 			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 			return
 		}
 
-		go func() {
-			tc := make(chan *tasks.Task, 10)
-			go func() {
-				if err := task.Do(store, tc); err != nil {
-					log.Println(err.Error())
-				}
-			}()
-			for t := range tc {
-				fmt.Println(t.Progress.String())
-			}
-		}()
+		go notifyTaskRequest(mailer, t)
+		runTask(&task)
 
 		apiutil.WriteMessageResponse(w, "task is running", nil)
 		return
@@ -64,37 +116,587 @@ func EnqueueTaskHandler(w http.ResponseWriter, r *http.Request) {
 
 	if err := t.Enqueue(store, cfg.AmqpUrl); err != nil {
 		log.Infoln(err)
+		if err == tasks.ErrConflict || err == tasks.ErrNotRunnable {
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+			return
+		}
 		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
 		return
 	}
 
+	go notifyTaskRequest(mailer, t)
 	apiutil.WriteMessageResponse(w, "successfully enqueued task", t)
 }
 
+// runTask performs a saved task in the background on this server,
+// for use when no amqp url is configured. the task waits for a free
+// slot if localRuns is full
+func runTask(task *tasks.Task) {
+	go performTask(store, task)
+}
+
+// performTask performs task, holding a localRuns slot until it finishes &
+// publishing progress updates as it runs
+func performTask(store datastore.Datastore, task *tasks.Task) {
+	localRuns.acquireFor(task.UserId)
+	defer localRuns.release()
+
+	tc := make(chan *tasks.Task, 10)
+	progress := make(chan struct{})
+	go func() {
+		defer close(progress)
+		for t := range tc {
+			if err := PublishTaskProgress(rpool, t); err != nil && err != ErrNoRedisConn {
+				log.Infoln(err.Error())
+			}
+		}
+	}()
+
+	if err := trackRun(func() error { return task.Do(store, tc) }); err != nil {
+		log.Infof("task %s error: %s", task.Id, err.Error())
+	}
+	close(tc)
+	<-progress
+}
+
 func TaskHandler(w http.ResponseWriter, r *http.Request) {
-	switch r.Method {
-	case "GET":
+	_, action := taskPathParams(r.URL.Path)
+	switch {
+	case r.Method == "GET" && action == "":
 		ReadTaskHandler(w, r)
-	case "POST":
+	case r.Method == "POST" && action == "":
 		EnqueueTaskHandler(w, r)
+	case r.Method == "PATCH" && action == "":
+		PatchTaskHandler(w, r)
+	case r.Method == "POST" && action == "clone":
+		CloneTaskHandler(w, r)
+	case r.Method == "POST" && action == "retry-now":
+		RetryTaskHandler(w, r)
+	case action == "delete":
+		DeleteTaskHandler(w, r)
+	case action == "logs":
+		TaskLogsHandler(w, r)
+	case action == "artifacts":
+		TaskArtifactsHandler(w, r)
+	case action == "notes":
+		TaskNotesHandler(w, r)
+	case r.Method == "POST" && action == "cancel":
+		CancelTaskHandler(w, r)
+	case r.Method == "GET" && action == "raw":
+		RawTaskHandler(w, r)
 	default:
 		NotFoundHandler(w, r)
 	}
 }
 
+// errTooManyReadyTasks is returned by checkReadyTasks for owners at the cap
+var errTooManyReadyTasks = fmt.Errorf("too many tasks waiting to start")
+
+// checkReadyTasks returns errTooManyReadyTasks if userId already has max
+// unstarted tasks. max of 0 & tasks without an owner are unlimited
+func checkReadyTasks(db sqlQueryable, max int, userId string) error {
+	if max <= 0 || userId == "" {
+		return nil
+	}
+	count, err := tasks.CountReadyTasks(db, userId)
+	if err != nil {
+		return err
+	}
+	if count >= max {
+		return errTooManyReadyTasks
+	}
+	return nil
+}
+
+// taskPathParams splits a /tasks/{id}/{action} url path into it's
+// id & action components. action is "" for /tasks/{id}
+func taskPathParams(path string) (id, action string) {
+	spl := strings.SplitN(strings.Trim(strings.TrimPrefix(path, "/tasks/"), "/"), "/", 2)
+	id = spl[0]
+	if len(spl) == 2 {
+		action = spl[1]
+	}
+	return
+}
+
 func ReadTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
 	t := &tasks.Task{
-		Id: r.URL.Path[len("/tasks/"):],
+		Id: id,
 	}
+	if err := t.Read(readStore()); err != nil {
+		if err != datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+
+		// fall back to tasks that have been moved to the archive
+		archived, err := tasks.ReadArchivedTask(newQueryLogger(readDB()), id)
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		} else if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		t = archived
+	} else {
+		artifacts, err := tasks.ReadTaskArtifacts(newQueryLogger(readDB()), t.Id)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		t.Artifacts = artifacts
+	}
+
+	apiutil.WriteResponse(w, t)
+}
+
+// readTaskForMethod reads the task a logs or notes request is for. GET
+// requests fall back to archived tasks, which keep their logs & notes but
+// can't be added to
+func readTaskForMethod(method, id string) (*tasks.Task, error) {
+	t := &tasks.Task{Id: id}
+	err := t.Read(store)
+	if err != datastore.ErrNotFound || method != "GET" {
+		return t, err
+	}
+	return tasks.ReadArchivedTask(newQueryLogger(readDB()), id)
+}
+
+// PatchTaskHandler updates only the fields of a task provided in the request body
+func PatchTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	t := &tasks.Task{Id: id}
 	if err := t.Read(store); err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
 		return
 	}
 
+	// Patch checks for unknown fields itself
+	var data json.RawMessage
+	if err := decodeJSONBody(w, r, &data); err != nil {
+		writeBodyError(w, err)
+		return
+	}
+
+	if err := t.Patch(data); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	if err := t.Save(store); err != nil {
+		if err == tasks.ErrNotRunnable {
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
 	apiutil.WriteResponse(w, t)
 }
 
+// CloneTaskHandler creates a new task from an existing task's definition.
+// request bodies may optionally provide params to override the originals
+func CloneTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	t := &tasks.Task{Id: id}
+	if err := t.Read(store); err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	clone := t.Clone()
+
+	overrides := struct {
+		Params map[string]interface{} `json:"params"`
+	}{}
+	if err := json.NewDecoder(r.Body).Decode(&overrides); err != nil && err != io.EOF {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	if len(overrides.Params) > 0 && clone.Params == nil {
+		clone.Params = map[string]interface{}{}
+	}
+	for key, val := range overrides.Params {
+		clone.Params[key] = val
+	}
+
+	if err := clone.Save(store); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	apiutil.WriteMessageResponse(w, "task cloned", clone)
+}
+
+// RetryTaskHandler immediately re-runs a failed task. Tasks that are queued
+// or running conflict, & finished tasks can't be retried
+func RetryTaskHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
+	id, _ := taskPathParams(r.URL.Path)
+	local := cfg.AmqpUrl == ""
+
+	// reading, checking & resetting the task happen in one transaction, so
+	// concurrent retries can't both start a run when DbTxIsolation is set
+	var (
+		t    *tasks.Task
+		wait time.Duration
+	)
+	err := WithTx(r.Context(), appDB, func(tx *sql.Tx) error {
+		txStore := tasks.SQLStore{DB: newQueryLoggerContext(r.Context(), tx)}
+		t = &tasks.Task{Id: id}
+		if err := t.Read(txStore); err != nil {
+			return err
+		}
+		wait = rerunWait(t, time.Duration(cfg.MinRerunIntervalSeconds)*time.Second, time.Now())
+		if wait > 0 && !adminAuthorized(r) {
+			return nil
+		}
+		wait = 0
+		if err := t.Retry(); err != nil {
+			return err
+		}
+		if local {
+			if localRuns.rejecting() {
+				return errQueueFull
+			}
+			now := time.Now()
+			t.Enqueued = &now
+		}
+		return t.Save(txStore)
+	})
+	if err != nil {
+		if err == errQueueFull {
+			writeQueueFull(w)
+			return
+		}
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		if err == tasks.ErrConflict {
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+			return
+		}
+		if errors.Is(err, tasks.ErrInvalidTask) {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if wait > 0 {
+		secs := int((wait + time.Second - 1) / time.Second)
+		w.Header().Set("Retry-After", strconv.Itoa(secs))
+		apiutil.WriteErrResponse(w, http.StatusTooManyRequests, fmt.Errorf("task was run too recently, try again in %d seconds", secs))
+		return
+	}
+
+	if local {
+		task := *t
+		runTask(&task)
+		apiutil.WriteMessageResponse(w, "task is running", t)
+		return
+	}
+
+	if err := t.Enqueue(store, cfg.AmqpUrl); err != nil {
+		log.Infoln(err)
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteMessageResponse(w, "task requeued", t)
+}
+
+// rerunWait returns how long until t can be run again if at least interval
+// must pass between runs, 0 if it can be run now
+func rerunWait(t *tasks.Task, interval time.Duration, now time.Time) time.Duration {
+	if interval <= 0 || t.Enqueued == nil {
+		return 0
+	}
+	if wait := t.Enqueued.Add(interval).Sub(now); wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// DeleteTaskHandler deletes a task in two steps. A GET request responds with a
+// short-lived confirmation token, which must be sent back as the "token" param
+// of a POST request to actually delete the task
+func DeleteTaskHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	t := &tasks.Task{Id: id}
+	if err := t.Read(store); err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	action := "delete:" + t.Id
+	switch r.Method {
+	case "GET":
+		token, expires, err := confirmations.Issue(action)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteMessageResponse(w, "POST this token to confirm deleting this task", map[string]interface{}{
+			"token":   token,
+			"expires": expires,
+		})
+	case "POST":
+		if !confirmations.Redeem(r.FormValue("token"), action) {
+			apiutil.WriteErrResponse(w, http.StatusForbidden, fmt.Errorf("invalid or expired confirmation token"))
+			return
+		}
+		if err := t.Delete(store); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteMessageResponse(w, "task deleted", t)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// TaskLogsHandler reads & appends to a task's log. Reads accept optional "limit" &
+// "tail" params, with tail=true returning the last limit lines. Appending is
+// restricted to workers, who POST a json object with a "lines" array of strings
+func TaskLogsHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	if r.Method == "POST" && !workerAuthorized(r) {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("worker authorization required"))
+		return
+	}
+
+	t, err := readTaskForMethod(r.Method, id)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit, err := pageSizeParam(r, "limit")
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		tail, _ := reqParamBool("tail", r)
+
+		var logs []*TaskLog
+		if tail {
+			logs, err = TailTaskLogs(newQueryLogger(readDB()), t.Id, limit)
+		} else {
+			logs, err = ReadTaskLogs(newQueryLogger(readDB()), t.Id, limit, 0)
+		}
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteResponse(w, logs)
+	case "POST":
+		body := struct {
+			Lines []string `json:"lines"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		// append all lines or none
+		var logs []*TaskLog
+		err := WithTx(r.Context(), appDB, func(tx *sql.Tx) (err error) {
+			logs, err = AppendTaskLogs(newQueryLoggerContext(r.Context(), tx), t.Id, body.Lines)
+			return
+		})
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteResponse(w, logs)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// TaskNotesHandler lists & adds notes on a task. Adding a note requires admin
+// or worker credentials, which identify the note's author. notes can't be
+// edited or removed
+func TaskNotesHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	author := requestAuthor(r)
+	if r.Method == "POST" && author == "" {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("admin or worker authorization required"))
+		return
+	}
+
+	t, err := readTaskForMethod(r.Method, id)
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		p, err := pageFromRequest(r)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		notes, err := ReadTaskNotes(newQueryLogger(readDB()), t.Id, p.Limit(), p.Offset())
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteResponse(w, notes)
+	case "POST":
+		body := struct {
+			Body string `json:"body"`
+		}{}
+		if err := decodeJSONBody(w, r, &body); err != nil {
+			writeBodyError(w, err)
+			return
+		}
+		if strings.TrimSpace(body.Body) == "" {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, fmt.Errorf("note body is required"))
+			return
+		}
+		note, err := AddTaskNote(newQueryLogger(appDB), t.Id, author, body.Body)
+		if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+		apiutil.WriteResponse(w, note)
+	default:
+		NotFoundHandler(w, r)
+	}
+}
+
+// requestAuthor names the credentials a request was made with, "admin" or
+// "worker", or "" for unauthenticated requests
+func requestAuthor(r *http.Request) string {
+	switch {
+	case adminAuthorized(r):
+		return "admin"
+	case workerAuthorized(r):
+		return "worker"
+	default:
+		return ""
+	}
+}
+
+// TaskArtifactsHandler lists & registers the artifacts a task produced.
+// Registering is restricted to workers, who POST a json object with an
+// "artifacts" array. artifacts replace any existing artifact of the same name
+func TaskArtifactsHandler(w http.ResponseWriter, r *http.Request) {
+	id, _ := taskPathParams(r.URL.Path)
+	if r.Method == "POST" && !workerAuthorized(r) {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("worker authorization required"))
+		return
+	}
+
+	t := &tasks.Task{Id: id}
+	if err := t.Read(store); err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// list from the replica unless artifacts were just registered on the primary
+	db := readDB()
+	switch r.Method {
+	case "GET":
+	case "POST":
+		db = appDB
+		body := struct {
+			Artifacts []*tasks.TaskArtifact `json:"artifacts"`
+		}{}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		}
+		// register all artifacts or none
+		err := WithTx(r.Context(), appDB, func(tx *sql.Tx) error {
+			return tasks.AddTaskArtifacts(newQueryLoggerContext(r.Context(), tx), t.Id, body.Artifacts)
+		})
+		if errors.Is(err, tasks.ErrInvalidTask) {
+			apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+			return
+		} else if err != nil {
+			apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+			return
+		}
+	default:
+		NotFoundHandler(w, r)
+		return
+	}
+
+	artifacts, err := tasks.ReadTaskArtifacts(newQueryLogger(db), t.Id)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteResponse(w, artifacts)
+}
+
+// WorkerHandler handles /workers/{id}/{action} requests. currently the only
+// action is POST /workers/{id}/heartbeat, which workers must call regularly
+// to keep the tasks they're running from being requeued. The response lists
+// any of the worker's tasks that should be cancelled
+func WorkerHandler(w http.ResponseWriter, r *http.Request) {
+	spl := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/workers/"), "/"), "/")
+	if r.Method != "POST" || len(spl) != 2 || spl[0] == "" || spl[1] != "heartbeat" {
+		NotFoundHandler(w, r)
+		return
+	}
+	if !workerAuthorized(r) {
+		apiutil.WriteErrResponse(w, http.StatusUnauthorized, fmt.Errorf("worker authorization required"))
+		return
+	}
+
+	now := time.Now()
+	if err := RecordWorkerHeartbeat(newQueryLogger(appDB), spl[0], now); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	cancel, err := WorkerCancelRequests(newQueryLogger(appDB), spl[0])
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	apiutil.WriteMessageResponse(w, "heartbeat recorded", map[string]interface{}{
+		"workerId": spl[0],
+		"lastSeen": now,
+		"cancel":   cancel,
+	})
+}
+
 func EnqueueIpfsAddHandler(w http.ResponseWriter, r *http.Request) {
+	cfg := currentConfig()
 	t := &tasks.Task{
 		Type: "ipfs.add",
 		Params: map[string]interface{}{
@@ -117,13 +719,80 @@ func reqParamInt(key string, r *http.Request) (int, error) {
 	return int(i), err
 }
 
+// pageFromRequest reads "page" & "pageSize" params, page defaults to 1.
+// see pageSizeParam for how sizes are read
+func pageFromRequest(r *http.Request) (apiutil.Page, error) {
+	number := 1
+	if s := r.FormValue("page"); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return apiutil.Page{}, fmt.Errorf("invalid page param: '%s'", s)
+		}
+		if i > 0 {
+			number = i
+		}
+	}
+
+	size, err := pageSizeParam(r, "pageSize")
+	if err != nil {
+		return apiutil.Page{}, err
+	}
+	return apiutil.NewPage(number, size), nil
+}
+
+// pageSizeParam reads a page size from the request param key. missing or zero
+// sizes use cfg.DefaultPageSize & sizes larger than cfg.MaxPageSize are clamped.
+// negative sizes are an error
+func pageSizeParam(r *http.Request, key string) (int, error) {
+	cfg := currentConfig()
+	size := 0
+	if s := r.FormValue(key); s != "" {
+		i, err := strconv.Atoi(s)
+		if err != nil || i < 0 {
+			return 0, fmt.Errorf("invalid %s param: '%s'", key, s)
+		}
+		size = i
+	}
+
+	if size == 0 {
+		size = cfg.DefaultPageSize
+	}
+	if cfg.MaxPageSize > 0 && size > cfg.MaxPageSize {
+		size = cfg.MaxPageSize
+	}
+	return size, nil
+}
+
 func reqParamBool(key string, r *http.Request) (bool, error) {
 	return strconv.ParseBool(r.FormValue(key))
 }
 
 func ListTasksHandler(w http.ResponseWriter, r *http.Request) {
-	p := apiutil.PageFromRequest(r)
-	ts, err := tasks.ReadTasks(store, "created DESC", p.Limit(), p.Offset())
+	p, err := pageFromRequest(r)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+	q, err := taskQueryFromRequest(r, p)
+	if err != nil {
+		apiutil.WriteErrResponse(w, http.StatusBadRequest, err)
+		return
+	}
+
+	// let polling clients skip listings that haven't changed
+	updated, err := tasks.LastUpdated(newQueryLogger(readDB()), q)
+	if err != nil {
+		log.Infoln(err.Error())
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+	if updated != nil {
+		if notModified(w, r, *updated) {
+			return
+		}
+	}
+
+	ts, err := tasks.QueryTasks(newQueryLogger(readDB()), q)
 	if err != nil {
 		log.Infoln(err.Error())
 		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
@@ -133,28 +802,180 @@ func ListTasksHandler(w http.ResponseWriter, r *http.Request) {
 	apiutil.WritePageResponse(w, ts, r, p)
 }
 
-// TODO - restore
+// notModified sets the Last-Modified header to lastModified, responding
+// 304 Not Modified & returning true if the request's If-Modified-Since
+// header shows the client already has the latest version
+func notModified(w http.ResponseWriter, r *http.Request, lastModified time.Time) bool {
+	// http dates only have second precision
+	lastModified = lastModified.UTC().Truncate(time.Second)
+	w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	if err != nil || lastModified.After(since) {
+		return false
+	}
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// TaskStatsHandler reports the number of tasks in each status, along with
+// the number of tasks this server is performing right now
+func TaskStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		NotFoundHandler(w, r)
+		return
+	}
+
+	counts, err := tasks.CountTasks(newQueryLogger(readDB()))
+	if err != nil {
+		log.Infoln(err.Error())
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	apiutil.WriteResponse(w, map[string]interface{}{
+		"statuses":   counts,
+		"activeRuns": activeRuns.Value(),
+	})
+}
+
+// taskQueryFromRequest builds a task listing query from request params
+func taskQueryFromRequest(r *http.Request, p apiutil.Page) (tasks.TaskQuery, error) {
+	status, err := tasks.ParseStatus(r.FormValue("status"))
+	if err != nil {
+		return tasks.TaskQuery{}, err
+	}
+
+	orderBy := r.FormValue("orderBy")
+	if orderBy == "" {
+		orderBy = currentConfig().TaskListOrder
+	}
+
+	q := tasks.TaskQuery{
+		Status:  status,
+		Type:    r.FormValue("type"),
+		UserId:  r.FormValue("userId"),
+		OrderBy: orderBy,
+		Limit:   p.Limit(),
+		Offset:  p.Offset(),
+
+		SourceUrl:       r.FormValue("sourceUrl"),
+		SourceUrlPrefix: r.FormValue("sourceUrlPrefix") == "true",
+	}
+
+	if s := r.FormValue("createdAfter"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid createdAfter param: %s", err.Error())
+		}
+		q.CreatedAfter = &t
+	}
+	if s := r.FormValue("createdBefore"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return q, fmt.Errorf("invalid createdBefore param: %s", err.Error())
+		}
+		q.CreatedBefore = &t
+	}
+
+	return q, nil
+}
+
+// CancelTaskHandler stops a task. Queued tasks are cancelled right away,
+// running tasks get a cancel request that's passed on to their worker with
+// it's next heartbeat. The worker acknowledges by failing the task with
+// tasks.CancelledError
 func CancelTaskHandler(w http.ResponseWriter, r *http.Request) {
-	// t := &tasks.Task{
-	// 	Id: r.URL.Path[len("/tasks/cancel/"):],
-	// }
-	// if err := t.Read(store); err != nil {
-	// 	renderError(w, err)
-	// 	return
-	// }
+	id, _ := taskPathParams(r.URL.Path)
 
-	// if err := t.Cancel(store); err != nil {
-	// 	renderError(w, err)
-	// 	return
-	// }
+	// the task's row stays locked from the read until the cancellation is
+	// written, so a worker claiming the task can't overwrite it or be missed
+	var (
+		t         *tasks.Task
+		requested bool
+	)
+	err := WithTx(r.Context(), appDB, func(tx *sql.Tx) (err error) {
+		db := newQueryLoggerContext(r.Context(), tx)
+		t, err = tasks.ReadTaskForUpdate(db, id)
+		if err != nil {
+			return err
+		}
+		if t.Succeeded != nil || t.Failed != nil {
+			return tasks.ErrConflict
+		}
+		if t.Started != nil {
+			requested = true
+			return RequestTaskCancel(db, t.Id, time.Now())
+		}
+		if err := t.Cancel(); err != nil {
+			return err
+		}
+		return t.Save(tasks.SQLStore{DB: db})
+	})
+	if err != nil {
+		if err == datastore.ErrNotFound {
+			apiutil.WriteErrResponse(w, http.StatusNotFound, err)
+			return
+		}
+		if err == tasks.ErrConflict {
+			apiutil.WriteErrResponse(w, http.StatusConflict, err)
+			return
+		}
+		apiutil.WriteErrResponse(w, http.StatusInternalServerError, err)
+		return
+	}
 
-	// renderMessage(w, "Task Cancelled", "You've cancelled this task")
+	if requested {
+		apiutil.WriteMessageResponse(w, "cancel requested", t)
+		return
+	}
+	apiutil.WriteMessageResponse(w, "task cancelled", t)
 }
 
-// HealthCheckHandler is a basic "hey I'm fine" for load balancers & co
+// HealthCheckHandler is a basic "hey I'm fine" for load balancers & co.
+// if HealthTaskSuccessWindowMinutes is set it also responds 503 when tasks
+// have been waiting longer than the window, but none has succeeded within it
 // TODO - add Database connection & proper configuration checks here for more accurate
 // health reporting
 func HealthCheckHandler(w http.ResponseWriter, r *http.Request) {
+	if mins := currentConfig().HealthTaskSuccessWindowMinutes; mins > 0 {
+		var lastSuccess, oldestQueued *time.Time
+		if err := newQueryLogger(readDB()).QueryRow(qTaskSuccessHealth).Scan(&lastSuccess, &oldestQueued); err != nil {
+			apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, fmt.Errorf("error checking task health: %s", err.Error()))
+			return
+		}
+		window := time.Duration(mins) * time.Minute
+		if taskSuccessStalled(lastSuccess, oldestQueued, window, time.Now()) {
+			apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, fmt.Errorf("tasks are queued, but none has succeeded in the last %s", window))
+			return
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(`{ "status" : 200 }`))
+}
+
+// taskSuccessStalled reports whether a task has been queued for longer than
+// window without any task succeeding within it. lastSuccess & oldestQueued
+// are nil if no task has succeeded or is queued
+func taskSuccessStalled(lastSuccess, oldestQueued *time.Time, window time.Duration, now time.Time) bool {
+	if oldestQueued == nil || now.Sub(*oldestQueued) <= window {
+		return false
+	}
+	return lastSuccess == nil || now.Sub(*lastSuccess) > window
+}
+
+// ReadyHandler reports whether the server can serve traffic, responding 503
+// until postgres is connected & migrated, or if the database can't be reached.
+// use HealthCheckHandler to check if the process is alive
+func ReadyHandler(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&dbReady) == 0 {
+		apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, fmt.Errorf("database isn't ready"))
+		return
+	}
+	if err := appDB.Ping(); err != nil {
+		apiutil.WriteErrResponse(w, http.StatusServiceUnavailable, fmt.Errorf("database is unreachable: %s", err.Error()))
+		return
+	}
 	w.WriteHeader(http.StatusOK)
 	w.Write([]byte(`{ "status" : 200 }`))
 }
@@ -167,10 +988,76 @@ func EmptyOkHandler(w http.ResponseWriter, r *http.Request) {
 
 // CertbotHandler pipes the certbot response for manual certificate generation
 func CertbotHandler(w http.ResponseWriter, r *http.Request) {
-	io.WriteString(w, cfg.CertbotResponse)
+	io.WriteString(w, currentConfig().CertbotResponse)
+}
+
+// StaticHandler serves files from dir with cache headers, using
+// cfg.StaticMaxAgeSeconds as the max-age
+func StaticHandler(dir string) http.Handler {
+	fs := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		setCacheHeaders(w, filepath.Join(dir, filepath.FromSlash(path.Clean("/"+r.URL.Path))))
+		fs.ServeHTTP(w, r)
+	})
+}
+
+// FaviconHandler serves the file at cfg.FaviconPath
+func FaviconHandler(w http.ResponseWriter, r *http.Request) {
+	path := currentConfig().FaviconPath
+	setCacheHeaders(w, path)
+	http.ServeFile(w, r, path)
 }
 
+// setCacheHeaders sets Cache-Control & ETag headers for the file at path.
+// http.ServeContent takes care of Last-Modified & conditional requests
+func setCacheHeaders(w http.ResponseWriter, path string) {
+	fi, err := os.Stat(path)
+	if err != nil || fi.IsDir() {
+		return
+	}
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", currentConfig().StaticMaxAgeSeconds))
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, fi.ModTime().Unix(), fi.Size()))
+}
+
+// apiPathPrefixes are the url paths served by the JSON API
+var apiPathPrefixes = []string{"/tasks", "/workers", "/admin"}
+
+// notFoundPage is the 404 page for requests outside the API when
+// cfg.NotFoundTemplate isn't set
+var notFoundPage = template.Must(template.New("404").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Not Found</title></head>
+<body>
+  <h1>Not Found</h1>
+  <p>There's nothing at {{ .Path }}. The API lives under <a href="/tasks">/tasks</a>, see <a href="/openapi.json">/openapi.json</a> for details.</p>
+</body>
+</html>
+`))
+
+// NotFoundHandler responds with a JSON 404 for API paths & an html 404
+// page for everything else
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) {
+	for _, prefix := range apiPathPrefixes {
+		if r.URL.Path == prefix || strings.HasPrefix(r.URL.Path, prefix+"/") {
+			w.Header().Set("Content-Type", "application/json")
+			apiutil.WriteErrResponse(w, http.StatusNotFound, fmt.Errorf("not found"))
+			return
+		}
+	}
+
+	page := notFoundPage
+	if path := currentConfig().NotFoundTemplate; path != "" {
+		t, err := template.ParseFiles(path)
+		if err != nil {
+			log.Infof("error parsing not found template: %s", err.Error())
+		} else {
+			page = t
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
 	w.WriteHeader(http.StatusNotFound)
-	w.Write([]byte(`{ "status" :  "not found" }`))
+	if err := page.Execute(w, map[string]string{"Path": r.URL.Path}); err != nil {
+		log.Infof("error rendering not found page: %s", err.Error())
+	}
 }
@@ -0,0 +1,927 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStaticHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "static")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "app.js"), []byte("console.log('hi')"), os.ModePerm); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	prev := currentConfig()
+	c := *prev
+	c.StaticMaxAgeSeconds = 60
+	setConfig(&c)
+	defer setConfig(prev)
+
+	s := httptest.NewServer(http.StripPrefix("/js/", StaticHandler(dir)))
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/js/app.js")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if got := res.Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("Cache-Control mismatch. expected: %s, got: %s", "public, max-age=60", got)
+	}
+	if res.Header.Get("Last-Modified") == "" {
+		t.Errorf("expected Last-Modified header to be set")
+	}
+	etag := res.Header.Get("ETag")
+	if etag == "" {
+		t.Errorf("expected ETag header to be set")
+		return
+	}
+
+	req, err := http.NewRequest("GET", s.URL+"/js/app.js", nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("If-None-Match", etag)
+	res, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNotModified {
+		t.Errorf("expected matching ETag to return %d, got: %d", http.StatusNotModified, res.StatusCode)
+	}
+}
+
+func TestDeleteTaskHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	path := "/tasks/57220705-4954-4a42-9e02-e6aa53b6908e/delete"
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected delete without a token to return %d, got: %d", http.StatusForbidden, rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected confirmation request to return %d, got: %d", http.StatusOK, rr.Code)
+		return
+	}
+	res := struct {
+		Data struct {
+			Token string `json:"token"`
+		} `json:"data"`
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path+"?token="+res.Data.Token, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected delete with a valid token to return %d, got: %d", http.StatusOK, rr.Code)
+	}
+
+	task := &tasks.Task{Id: "57220705-4954-4a42-9e02-e6aa53b6908e"}
+	if err := task.Read(store); err != datastore.ErrNotFound {
+		t.Errorf("expected deleted task to be not found, got: %v", err)
+	}
+}
+
+type testTaskable struct{}
+
+func (testTaskable) Valid() error { return nil }
+
+func (testTaskable) Do(updates chan tasks.Progress) {
+	updates <- tasks.Progress{Done: true}
+}
+
+func TestRetryTaskHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.AmqpUrl = ""
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	path := "/tasks/" + id + "/retry-now"
+	if _, err := appDB.Exec("UPDATE tasks SET type = 'test', started = $2, failed = $2, error = 'boom' WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected retrying a failed task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Failed != nil || task.Error != "" {
+		t.Errorf("expected retried task to no longer be failed")
+	}
+
+	if _, err := appDB.Exec("UPDATE tasks SET started = $2, succeeded = NULL, failed = NULL WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected retrying a running task to return %d, got: %d", http.StatusConflict, rr.Code)
+	}
+}
+
+func TestRetryTaskHandlerSerializationConflict(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.AmqpUrl = ""
+	c.DbTxIsolation = "repeatable read"
+	c.DbTxMaxRetries = 3
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	if _, err := appDB.Exec("UPDATE tasks SET type = 'test', started = $2, failed = $2, error = 'boom' WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// another transaction changes the task while the handler is reading it
+	other, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer other.Rollback()
+	if _, err := other.Exec("UPDATE tasks SET title = 'renamed' WHERE id = $1", id); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	retries := txRetries.Value()
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		TaskHandler(rr, httptest.NewRequest("POST", "/tasks/"+id+"/retry-now", nil))
+		close(done)
+	}()
+
+	// commit once the handler is waiting to write the row it read
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var waiting int
+		if err := appDB.QueryRow("SELECT count(1) FROM pg_locks WHERE NOT granted").Scan(&waiting); err != nil {
+			t.Fatal(err.Error())
+		}
+		if waiting > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the handler to block on the task")
+		}
+	}
+	if err := other.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	<-done
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected retrying a failed task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if txRetries.Value() == retries {
+		t.Errorf("expected the handler's transaction to be retried after the conflict")
+	}
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Title != "renamed" {
+		t.Errorf("expected the concurrent change to be kept, got title: %s", task.Title)
+	}
+	if task.Error != "" {
+		t.Errorf("expected task to be retried, got error: %s", task.Error)
+	}
+}
+
+func TestEnqueueTaskHandlerTimeout(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.AmqpUrl = ""
+	setConfig(&c)
+	defer setConfig(prev)
+
+	// block inserts so the request times out while it's transaction is open
+	lock, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer lock.Rollback()
+	if _, err := lock.Exec("LOCK TABLE tasks IN EXCLUSIVE MODE"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	id := "3c1d2b7e-5a7f-4d0e-9c3b-6f2a8e4d1b90"
+	done := make(chan struct{})
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		EnqueueTaskHandler(w, r)
+	}
+	req := httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"id":"`+id+`","type":"test","title":"timed out"}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	timeoutHandler(handler, 100*time.Millisecond)(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected timed out enqueue to return %d, got: %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	// let the insert through, a handler that ignored the timeout would commit
+	lock.Rollback()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for handler to return")
+	}
+
+	exists, err := store.Has((&tasks.Task{Id: id}).Key())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if exists {
+		t.Errorf("expected timed out enqueue not to save the task")
+	}
+}
+
+func TestCancelTaskHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	path := "/tasks/" + id + "/cancel"
+
+	// queued tasks are cancelled right away
+	if _, err := appDB.Exec("UPDATE tasks SET type = 'test', enqueued = $2, started = NULL, succeeded = NULL, failed = NULL WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected cancelling a queued task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Failed == nil || task.Error != tasks.CancelledError {
+		t.Errorf("expected cancelled task to fail with error '%s', got: '%s'", tasks.CancelledError, task.Error)
+	}
+
+	// finished tasks can't be cancelled
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusConflict {
+		t.Errorf("expected cancelling a finished task to return %d, got: %d", http.StatusConflict, rr.Code)
+	}
+
+	// running tasks signal their worker
+	if _, err := appDB.Exec("UPDATE tasks SET started = $2, failed = NULL, error = '', worker_id = 'test_worker' WHERE id = $1", id, time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err.Error())
+	}
+	heartbeat := func() []string {
+		req := httptest.NewRequest("POST", "/workers/test_worker/heartbeat", nil)
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		WorkerHandler(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected heartbeat to return %d, got: %d", http.StatusOK, rr.Code)
+		}
+		res := struct {
+			Data struct {
+				Cancel []string `json:"cancel"`
+			} `json:"data"`
+		}{}
+		if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+			t.Fatal(err.Error())
+		}
+		return res.Data.Cancel
+	}
+
+	if ids := heartbeat(); len(ids) != 0 {
+		t.Errorf("expected no cancel requests before cancelling, got: %v", ids)
+	}
+
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected cancelling a running task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Failed != nil {
+		t.Errorf("expected running task to keep running until it's worker acknowledges")
+	}
+
+	if ids := heartbeat(); len(ids) != 1 || ids[0] != id {
+		t.Errorf("expected heartbeat to ask worker to cancel [%s], got: %v", id, ids)
+	}
+
+	// the worker acknowledges by failing the task
+	if err := task.Cancel(); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if ids := heartbeat(); len(ids) != 0 {
+		t.Errorf("expected acknowledged cancel to be cleared, got: %v", ids)
+	}
+}
+
+func TestCancelTaskHandlerConcurrentClaim(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	if _, err := appDB.Exec("UPDATE tasks SET type = 'test', enqueued = $2, started = NULL, succeeded = NULL, failed = NULL, error = '' WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// a worker claims the queued task while the handler is cancelling it
+	worker, err := appDB.Begin()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer worker.Rollback()
+	if _, err := worker.Exec("UPDATE tasks SET started = $2, worker_id = 'test_worker' WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	done := make(chan struct{})
+	go func() {
+		TaskHandler(rr, httptest.NewRequest("POST", "/tasks/"+id+"/cancel", nil))
+		close(done)
+	}()
+
+	// commit the claim once the handler is waiting to read the task
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		var waiting int
+		if err := appDB.QueryRow("SELECT count(1) FROM pg_locks WHERE NOT granted").Scan(&waiting); err != nil {
+			t.Fatal(err.Error())
+		}
+		if waiting > 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for the handler to block on the task")
+		}
+	}
+	if err := worker.Commit(); err != nil {
+		t.Fatal(err.Error())
+	}
+	<-done
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected cancelling a claimed task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Started == nil || task.WorkerId != "test_worker" {
+		t.Errorf("expected the worker's claim to be kept, got started: %v, worker: '%s'", task.Started, task.WorkerId)
+	}
+	if task.Failed != nil {
+		t.Errorf("expected claimed task to keep running until it's worker acknowledges")
+	}
+
+	req := httptest.NewRequest("POST", "/workers/test_worker/heartbeat", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	rr = httptest.NewRecorder()
+	WorkerHandler(rr, req)
+	res := struct {
+		Data struct {
+			Cancel []string `json:"cancel"`
+		} `json:"data"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.Data.Cancel) != 1 || res.Data.Cancel[0] != id {
+		t.Errorf("expected heartbeat to ask worker to cancel [%s], got: %v", id, res.Data.Cancel)
+	}
+}
+
+func TestRetryTaskHandlerTooSoon(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prev := currentConfig()
+	c := *prev
+	c.AmqpUrl = ""
+	c.MinRerunIntervalSeconds = 60
+	c.AdminApiKey = "admin_key"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	path := "/tasks/" + id + "/retry-now"
+	now := time.Now()
+	if _, err := appDB.Exec("UPDATE tasks SET type = 'test', enqueued = $2, started = $2, failed = $2, error = 'boom' WHERE id = $1", id, now.Add(-time.Second*10)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected retrying too soon to return %d, got: %d. body: %s", http.StatusTooManyRequests, rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") == "" {
+		t.Errorf("expected retrying too soon to set a Retry-After header")
+	}
+
+	if _, err := appDB.Exec("UPDATE tasks SET enqueued = $2 WHERE id = $1", id, now.Add(-time.Minute*2)); err != nil {
+		t.Fatal(err.Error())
+	}
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected retrying after the interval to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	// admins can rerun without waiting
+	if _, err := appDB.Exec("UPDATE tasks SET enqueued = $2, started = $2, failed = $2, error = 'boom' WHERE id = $1", id, now.Add(-time.Second*10)); err != nil {
+		t.Fatal(err.Error())
+	}
+	req := httptest.NewRequest("POST", path, nil)
+	req.Header.Set("Authorization", "Bearer admin_key")
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected admin retrying too soon to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+}
+
+func TestRerunWait(t *testing.T) {
+	now := time.Now()
+	recent := now.Add(-time.Second * 10)
+	old := now.Add(-time.Minute * 2)
+
+	cases := []struct {
+		enqueued *time.Time
+		interval time.Duration
+		expect   time.Duration
+	}{
+		{nil, time.Minute, 0},
+		{&recent, 0, 0},
+		{&recent, time.Minute, time.Second * 50},
+		{&old, time.Minute, 0},
+	}
+
+	for i, c := range cases {
+		got := rerunWait(&tasks.Task{Enqueued: c.enqueued}, c.interval, now)
+		if got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestTaskArtifactsHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	prev := currentConfig()
+	c := *prev
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	register := func(body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/tasks/"+id+"/artifacts", strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer secret")
+		rr := httptest.NewRecorder()
+		TaskHandler(rr, req)
+		return rr
+	}
+
+	if rr := register(`{ "artifacts": [{ "name": "archive.zim", "url": "https://example.com/archive.zim", "size": 1024 }, { "name": "index.json", "hash": "QmHash" }] }`); rr.Code != http.StatusOK {
+		t.Fatalf("expected registering artifacts to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	// registering an existing name replaces the artifact
+	if rr := register(`{ "artifacts": [{ "name": "index.json", "hash": "QmNewHash" }] }`); rr.Code != http.StatusOK {
+		t.Fatalf("expected re-registering an artifact to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if rr := register(`{ "artifacts": [{ "url": "https://example.com/unnamed" }] }`); rr.Code != http.StatusBadRequest {
+		t.Errorf("expected registering an unnamed artifact to return %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", "/tasks/"+id, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected reading task to return %d, got: %d", http.StatusOK, rr.Code)
+	}
+	res := struct {
+		Data *tasks.Task `json:"data"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []tasks.TaskArtifact{
+		{Name: "archive.zim", Url: "https://example.com/archive.zim", Size: 1024},
+		{Name: "index.json", Hash: "QmNewHash"},
+	}
+	if len(res.Data.Artifacts) != len(expect) {
+		t.Fatalf("artifact count mismatch. expected: %d, got: %d", len(expect), len(res.Data.Artifacts))
+	}
+	for i, a := range res.Data.Artifacts {
+		if *a != expect[i] {
+			t.Errorf("artifact %d mismatch. expected: %v, got: %v", i, expect[i], *a)
+		}
+	}
+}
+
+func TestReadArchivedTaskHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks_archive")
+	if err := resetTestData(appDB, "tasks_archive"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", "/tasks/8f0b7a1e-5c52-4f2e-9d1c-0c1c7a3e6b21", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected reading an archived task to return %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+	if !strings.Contains(rr.Body.String(), "Archived task") {
+		t.Errorf("expected response to contain the archived task, got: %s", rr.Body.String())
+	}
+
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", "/tasks/9e1c2d3f-6a7b-4c8d-9e0f-1a2b3c4d5e6f", nil))
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected reading a missing task to return %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+}
+
+func TestTaskStatsHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	if _, err := appDB.Exec("UPDATE tasks SET enqueued = $2, started = $2 WHERE id = $1", "57220705-4954-4a42-9e02-e6aa53b6908e", time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	rr := httptest.NewRecorder()
+	TaskStatsHandler(rr, httptest.NewRequest("GET", "/tasks/stats", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got: %d. body: %s", http.StatusOK, rr.Code, rr.Body.String())
+	}
+
+	res := struct {
+		Data struct {
+			Statuses   map[string]int
+			ActiveRuns *int64
+		}
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if res.Data.Statuses["running"] != 1 || res.Data.Statuses["queued"] != 0 {
+		t.Errorf("expected one running task, got: %v", res.Data.Statuses)
+	}
+	if res.Data.ActiveRuns == nil {
+		t.Errorf("expected response to include activeRuns")
+	}
+}
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2017, 1, 1, 0, 0, 0, 500, time.UTC)
+	cases := []struct {
+		ifModifiedSince string
+		expect          bool
+	}{
+		{"", false},
+		{"not a date", false},
+		{"Sat, 31 Dec 2016 23:59:59 GMT", false},
+		{"Sun, 01 Jan 2017 00:00:00 GMT", true},
+		{"Mon, 02 Jan 2017 00:00:00 GMT", true},
+	}
+
+	for i, c := range cases {
+		r := httptest.NewRequest("GET", "/tasks", nil)
+		if c.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", c.ifModifiedSince)
+		}
+		rr := httptest.NewRecorder()
+		if got := notModified(rr, r, lastModified); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+		if c.expect && rr.Code != http.StatusNotModified {
+			t.Errorf("case %d expected status %d, got: %d", i, http.StatusNotModified, rr.Code)
+		}
+		if lm := rr.Header().Get("Last-Modified"); lm != "Sun, 01 Jan 2017 00:00:00 GMT" {
+			t.Errorf("case %d Last-Modified mismatch, got: %s", i, lm)
+		}
+	}
+}
+
+func TestListTasksNotModified(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+
+	rr := httptest.NewRecorder()
+	ListTasksHandler(rr, httptest.NewRequest("GET", "/tasks", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got: %d", http.StatusOK, rr.Code)
+	}
+	lastModified := rr.Header().Get("Last-Modified")
+	if lastModified == "" {
+		t.Fatal("expected listing to set Last-Modified")
+	}
+
+	r := httptest.NewRequest("GET", "/tasks", nil)
+	r.Header.Set("If-Modified-Since", lastModified)
+	rr = httptest.NewRecorder()
+	ListTasksHandler(rr, r)
+	if rr.Code != http.StatusNotModified {
+		t.Errorf("expected unchanged listing to return %d, got: %d", http.StatusNotModified, rr.Code)
+	}
+
+	if _, err := appDB.Exec("INSERT INTO tasks (id, created, updated, type) VALUES ('4c7e0f2d-5a6b-4c8d-9e9f-0a1b2c3d4e5f', $1, $1, 'ipfs.add')", time.Now().In(time.UTC)); err != nil {
+		t.Fatal(err.Error())
+	}
+	rr = httptest.NewRecorder()
+	ListTasksHandler(rr, r)
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected listing with a new task to return %d, got: %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestQueryTasksStableOrder(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+
+	ids := []string{
+		"1b0e9a4c-0000-4000-8000-000000000001",
+		"1b0e9a4c-0000-4000-8000-000000000002",
+		"1b0e9a4c-0000-4000-8000-000000000003",
+		"1b0e9a4c-0000-4000-8000-000000000004",
+		"1b0e9a4c-0000-4000-8000-000000000005",
+	}
+	created := time.Now().In(time.UTC).Round(time.Second)
+	for _, id := range ids {
+		if _, err := appDB.Exec("INSERT INTO tasks (id, created, updated, type) VALUES ($1, $2, $2, 'tie')", id, created); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	read := func() []string {
+		got := []string{}
+		for offset := 0; offset < len(ids); offset += 2 {
+			ts, err := tasks.QueryTasks(appDB, tasks.TaskQuery{Type: "tie", Limit: 2, Offset: offset})
+			if err != nil {
+				t.Fatal(err.Error())
+			}
+			for _, task := range ts {
+				got = append(got, task.Id)
+			}
+		}
+		return got
+	}
+
+	for i := 0; i < 3; i++ {
+		got := read()
+		if len(got) != len(ids) {
+			t.Fatalf("run %d: expected %d tasks across pages, got: %v", i, len(ids), got)
+		}
+		// ties on created fall back to id, in the same direction
+		for j, id := range got {
+			if expect := ids[len(ids)-1-j]; id != expect {
+				t.Errorf("run %d: expected task %d to be %s, got: %s", i, j, expect, id)
+			}
+		}
+	}
+}
+
+func TestPageFromRequest(t *testing.T) {
+	prev := currentConfig()
+	c := *prev
+	c.DefaultPageSize = 50
+	c.MaxPageSize = 200
+	setConfig(&c)
+	defer setConfig(prev)
+
+	cases := []struct {
+		query        string
+		number, size int
+		err          bool
+	}{
+		{"", 1, 50, false},
+		{"?page=0&pageSize=0", 1, 50, false},
+		{"?page=3&pageSize=20", 3, 20, false},
+		{"?pageSize=200", 1, 200, false},
+		{"?pageSize=100000", 1, 200, false},
+		{"?pageSize=-1", 0, 0, true},
+		{"?page=-2", 0, 0, true},
+		{"?pageSize=lots", 0, 0, true},
+	}
+
+	for i, c := range cases {
+		p, err := pageFromRequest(httptest.NewRequest("GET", "/tasks"+c.query, nil))
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if p.Number != c.number || p.Size != c.size {
+			t.Errorf("case %d mismatch. expected page %d of size %d, got page %d of size %d", i, c.number, c.size, p.Number, p.Size)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	ListTasksHandler(rr, httptest.NewRequest("GET", "/tasks?pageSize=-5", nil))
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected negative page size to return %d, got: %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	prev := atomic.LoadInt32(&dbReady)
+	defer atomic.StoreInt32(&dbReady, prev)
+
+	atomic.StoreInt32(&dbReady, 0)
+	rr := httptest.NewRecorder()
+	ReadyHandler(rr, httptest.NewRequest("GET", "/ready", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d before migrations complete, got: %d", http.StatusServiceUnavailable, rr.Code)
+	}
+
+	atomic.StoreInt32(&dbReady, 1)
+	rr = httptest.NewRecorder()
+	ReadyHandler(rr, httptest.NewRequest("GET", "/ready", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d after migrations complete, got: %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestNotFoundHandler(t *testing.T) {
+	cases := []struct {
+		path, contentType string
+	}{
+		{"/tasks/123/nope", "application/json"},
+		{"/tasks", "application/json"},
+		{"/workers/nope", "application/json"},
+		{"/nope", "text/html; charset=utf-8"},
+		{"/tasksnope", "text/html; charset=utf-8"},
+	}
+
+	for i, c := range cases {
+		rr := httptest.NewRecorder()
+		NotFoundHandler(rr, httptest.NewRequest("GET", c.path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("case %d: expected status %d, got: %d", i, http.StatusNotFound, rr.Code)
+		}
+		if got := rr.Header().Get("Content-Type"); got != c.contentType {
+			t.Errorf("case %d: expected content type '%s', got: '%s'", i, c.contentType, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	NotFoundHandler(rr, httptest.NewRequest("GET", "/<b>nope</b>", nil))
+	if strings.Contains(rr.Body.String(), "<b>") {
+		t.Errorf("expected html 404 to escape the request path")
+	}
+
+	dir, err := ioutil.TempDir("", "not_found")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "404.html")
+	if err := ioutil.WriteFile(path, []byte("<p>lost: {{ .Path }}</p>"), 0644); err != nil {
+		t.Fatal(err.Error())
+	}
+	prev := currentConfig()
+	c := *prev
+	c.NotFoundTemplate = path
+	setConfig(&c)
+	defer setConfig(prev)
+
+	rr = httptest.NewRecorder()
+	NotFoundHandler(rr, httptest.NewRequest("GET", "/nope", nil))
+	if got := rr.Body.String(); got != "<p>lost: /nope</p>" {
+		t.Errorf("expected configured template to render, got: %s", got)
+	}
+}
+
+func TestCheckReadyTasks(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	ids := []string{"0d4fa2ae-0c0e-4ee1-9d43-1a1b4ee0c4b1", "5a5b8a7e-6b0b-4f2c-9f4e-4bb1d3e6a2c2"}
+	for _, id := range ids {
+		if _, err := appDB.Exec("INSERT INTO tasks (id, created, updated, title, user_id, type, enqueued) VALUES ($1, $2, $2, $1, 'owner', 'ipfs.add', $2)", id, time.Now()); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+	// finished tasks don't count toward the cap
+	if _, err := appDB.Exec("INSERT INTO tasks (id, created, updated, title, user_id, type, started, succeeded) VALUES ('9c1e2d7b-3a4f-4e8d-8b6a-2f5c7d9e1a03', $1, $1, 'done', 'owner', 'ipfs.add', $1, $1)", time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		max    int
+		userId string
+		expect error
+	}{
+		{0, "owner", nil},
+		{3, "owner", nil},
+		{2, "owner", errTooManyReadyTasks},
+		{1, "owner", errTooManyReadyTasks},
+		{1, "someone_else", nil},
+		{1, "", nil},
+	}
+	for i, c := range cases {
+		if err := checkReadyTasks(appDB, c.max, c.userId); err != c.expect {
+			t.Errorf("case %d: expected error: %v, got: %v", i, c.expect, err)
+		}
+	}
+
+	prev := currentConfig()
+	cfg := *prev
+	cfg.AmqpUrl = ""
+	cfg.MaxReadyTasksPerOwner = 2
+	setConfig(&cfg)
+	defer setConfig(prev)
+
+	req := httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"type":"ipfs.addurl","userId":"owner","params":{"url":"http://example.com"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	TasksHandler(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected owner at the cap to respond %d, got: %d. body: %s", http.StatusTooManyRequests, rr.Code, rr.Body.String())
+	}
+}
+
+func TestTaskSuccessStalled(t *testing.T) {
+	now := time.Now()
+	ago := func(d time.Duration) *time.Time {
+		t := now.Add(-d)
+		return &t
+	}
+	window := 30 * time.Minute
+
+	cases := []struct {
+		description               string
+		lastSuccess, oldestQueued *time.Time
+		stalled                   bool
+	}{
+		{"nothing queued, no successes", nil, nil, false},
+		{"nothing queued, old success", ago(time.Hour), nil, false},
+		{"recently queued, no successes", nil, ago(time.Minute), false},
+		{"recently queued, old success", ago(time.Hour), ago(time.Minute), false},
+		{"long queued, recent success", ago(time.Minute), ago(time.Hour), false},
+		{"long queued, old success", ago(time.Hour), ago(time.Hour), true},
+		{"long queued, no successes", nil, ago(time.Hour), true},
+	}
+	for i, c := range cases {
+		if got := taskSuccessStalled(c.lastSuccess, c.oldestQueued, window, now); got != c.stalled {
+			t.Errorf("case %d %s: expected stalled: %t, got: %t", i, c.description, c.stalled, got)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// maxRetryDelay caps the time retryTransport will wait between attempts,
+// including delays requested by a server's Retry-After header
+const maxRetryDelay = time.Minute
+
+// retryTransport wraps an http.RoundTripper, retrying requests that fail
+// with a network error, a 5xx, or a 429 response. only idempotent requests
+// are retried, see retryable. delays between attempts
+// back off exponentially from baseDelay with jitter, and 429 responses
+// that include a Retry-After header wait for as long as the server asks
+type retryTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+	baseDelay  time.Duration
+	// sleep is called to wait between attempts, returning early with
+	// ctx.Err() if ctx is done first. overridden in tests
+	sleep func(ctx context.Context, d time.Duration) error
+}
+
+// newRetryTransport wraps base, retrying failed requests up to maxRetries times.
+// a nil base uses http.DefaultTransport
+func newRetryTransport(base http.RoundTripper, maxRetries int) *retryTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &retryTransport{
+		base:       base,
+		maxRetries: maxRetries,
+		baseDelay:  500 * time.Millisecond,
+		sleep:      sleepContext,
+	}
+}
+
+// sleepContext waits for d, or until ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req
+	for attempt := 0; ; attempt++ {
+		res, err := t.base.RoundTrip(r)
+		if attempt >= t.maxRetries || !retryable(req) || !shouldRetry(res, err) || req.Context().Err() != nil {
+			return res, err
+		}
+
+		// requests with a body can only be retried if the body can be re-read
+		if req.Body != nil && req.Body != http.NoBody {
+			if req.GetBody == nil {
+				return res, err
+			}
+			body, berr := req.GetBody()
+			if berr != nil {
+				return res, err
+			}
+			r = req.Clone(req.Context())
+			r.Body = body
+		}
+
+		delay := t.backoff(attempt)
+		if res != nil {
+			if after, ok := retryAfter(res); ok {
+				delay = after
+			}
+			res.Body.Close()
+		}
+		if delay > maxRetryDelay {
+			delay = maxRetryDelay
+		}
+
+		log.Infof("retrying %s %s in %s, attempt %d of %d", req.Method, req.URL.String(), delay, attempt+1, t.maxRetries)
+		if err := t.sleep(req.Context(), delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// backoff returns the delay before retrying after attempt, doubling with each
+// attempt & jittered to between half & the full delay
+func (t *retryTransport) backoff(attempt int) time.Duration {
+	d := t.baseDelay << uint(attempt)
+	if d <= 0 || d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+	half := d / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// retryable reports whether req is safe to send more than once. a failed
+// POST may still have been handled (eg. an email sent before the response
+// timed out), so non-idempotent methods are only retried when the caller
+// marks the request with an Idempotency-Key header, following net/http
+func retryable(req *http.Request) bool {
+	switch req.Method {
+	case "", http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	_, ok := req.Header["Idempotency-Key"]
+	if !ok {
+		_, ok = req.Header["X-Idempotency-Key"]
+	}
+	return ok
+}
+
+// shouldRetry reports whether a request that produced res & err is worth retrying
+func shouldRetry(res *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	return res.StatusCode == http.StatusTooManyRequests || res.StatusCode >= 500
+}
+
+// retryAfter reads the delay requested by a 429 response's Retry-After header,
+// which can be either a number of seconds or an http date
+func retryAfter(res *http.Response) (time.Duration, bool) {
+	if res.StatusCode != http.StatusTooManyRequests {
+		return 0, false
+	}
+	value := res.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil {
+		if d := time.Until(date); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
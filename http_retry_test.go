@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRetryTransport(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		if string(body) != "hello" {
+			t.Errorf("attempt %d body mismatch. expected: %s, got: %s", calls, "hello", string(body))
+		}
+		switch calls {
+		case 1:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 2:
+			w.Header().Set("Retry-After", "7")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	defer s.Close()
+
+	var delays []time.Duration
+	rt := newRetryTransport(nil, 3)
+	rt.sleep = func(ctx context.Context, d time.Duration) error {
+		delays = append(delays, d)
+		return nil
+	}
+	cli := &http.Client{Transport: rt}
+
+	res, err := cli.Do(idempotentPost(t, s.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		t.Errorf("expected status %d, got: %d", http.StatusOK, res.StatusCode)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 attempts, got: %d", calls)
+	}
+	if len(delays) != 2 {
+		t.Fatalf("expected 2 delays, got: %d", len(delays))
+	}
+	if delays[0] < rt.baseDelay/2 || delays[0] > rt.baseDelay {
+		t.Errorf("expected first delay to be between %s and %s, got: %s", rt.baseDelay/2, rt.baseDelay, delays[0])
+	}
+	if delays[1] != 7*time.Second {
+		t.Errorf("expected Retry-After delay of %s, got: %s", 7*time.Second, delays[1])
+	}
+
+	calls = 0
+	rt.maxRetries = 1
+	res, err = cli.Do(idempotentPost(t, s.URL))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("expected retries to stop at max with status %d, got: %d", http.StatusTooManyRequests, res.StatusCode)
+	}
+
+	calls = 0
+	res, err = cli.Post(s.URL, "text/plain", bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if calls != 1 {
+		t.Errorf("expected a POST without an idempotency key to be attempted once, got: %d", calls)
+	}
+	if res.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected status %d, got: %d", http.StatusServiceUnavailable, res.StatusCode)
+	}
+}
+
+func TestRetryTransportCancelledDuringBackoff(t *testing.T) {
+	calls := 0
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer s.Close()
+
+	rt := newRetryTransport(nil, 3)
+	rt.baseDelay = maxRetryDelay
+	cli := &http.Client{Transport: rt}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	start := time.Now()
+	res, err := cli.Do(req.WithContext(ctx))
+	if err == nil {
+		res.Body.Close()
+		t.Fatal("expected cancelled request to return an error")
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected context deadline error, got: %s", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("expected backoff to stop when the request is cancelled, waited: %s", elapsed)
+	}
+	if calls != 1 {
+		t.Errorf("expected 1 attempt before the request was cancelled, got: %d", calls)
+	}
+}
+
+func idempotentPost(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest("POST", url, bytes.NewReader([]byte("hello")))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	req.Header.Set("Content-Type", "text/plain")
+	req.Header.Set("Idempotency-Key", "test")
+	return req
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/datatogether/api/apiutil"
+)
+
+// bodyError is a problem with a request body, status is the http status
+// code to respond with
+type bodyError struct {
+	status int
+	msg    string
+}
+
+func (e *bodyError) Error() string {
+	return e.msg
+}
+
+// strictUnmarshaler is implemented by types with their own UnmarshalJSON
+// method that can still reject unknown fields, like tasks.Task
+type strictUnmarshaler interface {
+	UnmarshalJSONStrict(data []byte) error
+}
+
+// decodeJSONBody reads a JSON request body into dst. the request must have a
+// Content-Type of application/json, a body no larger than
+// cfg.MaxRequestBodyBytes, & may only contain fields dst has. errors are *bodyError, which
+// writeBodyError responds to with a 415, 413 or 400 respectively
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, dst interface{}) error {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		return &bodyError{http.StatusUnsupportedMediaType, "Content-Type must be application/json"}
+	}
+
+	body := r.Body
+	max := int64(currentConfig().MaxRequestBodyBytes)
+	if max > 0 {
+		body = http.MaxBytesReader(w, body, max)
+	}
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return &bodyError{http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must not be larger than %d bytes", max)}
+		}
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("error reading request body: %s", err.Error())}
+	}
+
+	if len(bytes.TrimSpace(data)) == 0 {
+		return &bodyError{http.StatusBadRequest, "request body must not be empty"}
+	}
+	if !json.Valid(data) {
+		return &bodyError{http.StatusBadRequest, "request body must be a single, well-formed JSON value"}
+	}
+
+	if s, ok := dst.(strictUnmarshaler); ok {
+		err = s.UnmarshalJSONStrict(data)
+	} else {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(dst)
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &typeErr):
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("invalid value for field '%s': expected %s", typeErr.Field, typeErr.Type)}
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		return &bodyError{http.StatusBadRequest, fmt.Sprintf("unknown field: %s", strings.TrimPrefix(err.Error(), "json: unknown field "))}
+	default:
+		return &bodyError{http.StatusBadRequest, err.Error()}
+	}
+}
+
+// writeBodyError responds to an error returned by decodeJSONBody
+func writeBodyError(w http.ResponseWriter, err error) {
+	status := http.StatusBadRequest
+	if be, ok := err.(*bodyError); ok {
+		status = be.status
+	}
+	apiutil.WriteErrResponse(w, status, err)
+}
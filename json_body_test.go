@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/datatogether/task_mgmt/tasks"
+)
+
+func TestDecodeJSONBody(t *testing.T) {
+	prev := currentConfig()
+	c := *prev
+	c.MaxRequestBodyBytes = 64
+	setConfig(&c)
+	defer setConfig(prev)
+
+	type body struct {
+		Lines []string `json:"lines"`
+	}
+
+	cases := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"application/json", `{"lines":["a","b"]}`, 0},
+		{"application/json; charset=utf-8", `{"lines":["a"]}`, 0},
+		{"", `{"lines":["a"]}`, http.StatusUnsupportedMediaType},
+		{"text/plain", `{"lines":["a"]}`, http.StatusUnsupportedMediaType},
+		{"application/x-www-form-urlencoded", `lines=a`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"lines":["a"],"extra":true}`, http.StatusBadRequest},
+		{"application/json", `{"lines":"a"}`, http.StatusBadRequest},
+		{"application/json", `{"lines":["a"]`, http.StatusBadRequest},
+		{"application/json", `{"lines":["a"]} {}`, http.StatusBadRequest},
+		{"application/json", ``, http.StatusBadRequest},
+		{"application/json", `{"lines":["` + strings.Repeat("a", 64) + `"]}`, http.StatusRequestEntityTooLarge},
+	}
+
+	for i, c := range cases {
+		r := httptest.NewRequest("POST", "/tasks", strings.NewReader(c.body))
+		if c.contentType != "" {
+			r.Header.Set("Content-Type", c.contentType)
+		}
+		rr := httptest.NewRecorder()
+
+		err := decodeJSONBody(rr, r, &body{})
+		if c.status == 0 {
+			if err != nil {
+				t.Errorf("case %d unexpected error: %s", i, err.Error())
+			}
+			continue
+		}
+
+		be, ok := err.(*bodyError)
+		if !ok {
+			t.Errorf("case %d expected a *bodyError, got: %v", i, err)
+			continue
+		}
+		if be.status != c.status {
+			t.Errorf("case %d status mismatch. expected: %d, got: %d. error: %s", i, c.status, be.status, be.Error())
+		}
+
+		writeBodyError(rr, err)
+		if rr.Code != c.status {
+			t.Errorf("case %d response code mismatch. expected: %d, got: %d", i, c.status, rr.Code)
+		}
+	}
+}
+
+func TestDecodeJSONBodyTask(t *testing.T) {
+	r := httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"type":"test","typo":true}`))
+	r.Header.Set("Content-Type", "application/json")
+	err := decodeJSONBody(httptest.NewRecorder(), r, &tasks.Task{})
+	if err == nil || !strings.Contains(err.Error(), "unknown field") {
+		t.Errorf("expected task with an unknown field to error, got: %v", err)
+	}
+
+	r = httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"type":"test","params":{"url":"http://example.com"}}`))
+	r.Header.Set("Content-Type", "application/json")
+	task := &tasks.Task{}
+	if err := decodeJSONBody(httptest.NewRecorder(), r, task); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if task.Type != "test" || task.Params["url"] != "http://example.com" {
+		t.Errorf("expected task fields to be decoded, got type: %s, params: %v", task.Type, task.Params)
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// openLoggedDB opens a postgres connection pool that logs & measures every
+// query run on it, the same way a queryLogger does. sql_datastore only
+// accepts a *sql.DB, so store & the replica store are built on one of these
+// to record task & source reads & writes. queries run on a logged db should
+// not also be wrapped in a queryLogger
+func openLoggedDB(connString string) (*sql.DB, error) {
+	db := sql.OpenDB(loggedConnector{dsn: connString, driver: &pq.Driver{}})
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// loggedConnector opens loggedConns with driver
+type loggedConnector struct {
+	dsn    string
+	driver driver.Driver
+}
+
+func (c loggedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.driver.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return loggedConn{conn}, nil
+}
+
+func (c loggedConnector) Driver() driver.Driver {
+	return c.driver
+}
+
+// loggedConn records the queries run on a driver connection. database/sql
+// runs queries with QueryContext & ExecContext when a connection has them,
+// which postgres connections do
+type loggedConn struct {
+	driver.Conn
+}
+
+func (c loggedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	q, ok := c.Conn.(driver.QueryerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	rows, err := q.QueryContext(ctx, query, args)
+	recordDriverQuery(query, args, time.Since(start), err)
+	return rows, err
+}
+
+func (c loggedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	e, ok := c.Conn.(driver.ExecerContext)
+	if !ok {
+		return nil, driver.ErrSkip
+	}
+	start := time.Now()
+	res, err := e.ExecContext(ctx, query, args)
+	recordDriverQuery(query, args, time.Since(start), err)
+	return res, err
+}
+
+func (c loggedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	if b, ok := c.Conn.(driver.ConnBeginTx); ok {
+		return b.BeginTx(ctx, opts)
+	}
+	return c.Conn.Begin()
+}
+
+// recordDriverQuery records a query run on a loggedConn. ErrSkip means the
+// query will be retried as a prepared statement, & isn't recorded
+func recordDriverQuery(query string, args []driver.NamedValue, duration time.Duration, err error) {
+	if err == driver.ErrSkip {
+		return
+	}
+	values := make([]interface{}, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	q := &queryLogger{log: queryLog()}
+	q.record(query, values, duration, err)
+}
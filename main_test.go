@@ -4,6 +4,9 @@ import (
 	"database/sql"
 	"flag"
 	"fmt"
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/task_mgmt/source"
+	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/gchaincl/dotsql"
 	"os"
 	"testing"
@@ -12,11 +15,11 @@ import (
 func TestMain(m *testing.M) {
 	flag.Parse()
 
-	var err error
-	cfg, err = initConfig(TEST_MODE) // make sure we read env in test mode
+	cfg, err := initConfig(TEST_MODE) // make sure we read env in test mode
 	if err != nil {
 		panic(err)
 	}
+	setConfig(cfg)
 
 	teardown := setupTestDatabase()
 
@@ -27,7 +30,7 @@ func TestMain(m *testing.M) {
 
 func setupTestDatabase() func() {
 	var err error
-	appDB, err = SetupConnection(cfg.PostgresDbUrl)
+	appDB, err = SetupConnection(currentConfig().PostgresDbUrl)
 	if err != nil {
 		appDB.Close()
 		log.Panicln(err)
@@ -42,6 +45,16 @@ func setupTestDatabase() func() {
 		log.Panicln(err.Error())
 	}
 
+	storeDB, err := openLoggedDB(currentConfig().PostgresDbUrl)
+	if err != nil {
+		log.Panicln(err.Error())
+	}
+	sql_datastore.SetDB(storeDB)
+	store.Register(
+		&tasks.Task{},
+		&source.Source{},
+	)
+
 	return teardown
 }
 
@@ -60,9 +73,19 @@ func initializeAppSchema(db *sql.DB) (func(), error) {
 	for _, cmd := range []string{
 		"drop-all",
 		"create-tasks",
+		"create-tasks_archive",
 		"create-sources",
 		"create-repos",
 		"create-repo_sources",
+		"create-task_logs",
+		"create-task_artifacts",
+		"create-task_cancel_requests",
+		"create-task_notes",
+		"create-task_logs_archive",
+		"create-task_artifacts_archive",
+		"create-task_notes_archive",
+		"create-task_audit",
+		"create-worker_heartbeats",
 	} {
 		if _, err := schema.Exec(db, cmd); err != nil {
 			log.Info(cmd, "error:", err)
@@ -0,0 +1,154 @@
+// runtime metrics, published with the expvar package & served at /metrics
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// count of notification emails that failed to send
+	emailSendFailures = expvar.NewInt("email_send_failures_total")
+	// count of task events that failed to publish
+	eventPublishFailures = expvar.NewInt("event_publish_failures_total")
+	// count of transactions retried after a serialization failure
+	txRetries = expvar.NewInt("db_tx_retries_total")
+	// unix time the last task performed by this server succeeded, 0 if none has
+	lastTaskSuccess = expvar.NewInt("last_task_success_timestamp")
+	// number of tasks this server is performing right now
+	activeRuns = expvar.NewInt("task_active_runs")
+	// histograms of database query durations in milliseconds, keyed by operation
+	dbQueryDuration = expvar.NewMap("db_query_duration_ms")
+	// count of database queries that returned an error, keyed by operation
+	dbQueryErrors = expvar.NewMap("db_query_errors_total")
+)
+
+// queryDurationBuckets are the upper bounds of db query duration
+// histogram buckets, in milliseconds
+var queryDurationBuckets = []float64{1, 5, 10, 25, 50, 100, 250, 500, 1000, 2500, 5000}
+
+// trackRun counts f as an active task run while it executes
+func trackRun(f func() error) error {
+	activeRuns.Add(1)
+	defer activeRuns.Add(-1)
+	return f()
+}
+
+// observeQuery records the duration & outcome of a database query. queries
+// run through a queryLogger or on a db opened with openLoggedDB are observed
+func observeQuery(query string, duration time.Duration, err error) {
+	op := queryOperation(query)
+	queryHistogram(op).Observe(float64(duration) / float64(time.Millisecond))
+	if err != nil {
+		dbQueryErrors.Add(op, 1)
+	}
+}
+
+// queryHistogramsLock guards creating new dbQueryDuration entries
+var queryHistogramsLock sync.Mutex
+
+// queryHistogram returns the duration histogram for op, creating it if needed
+func queryHistogram(op string) *histogram {
+	if h, ok := dbQueryDuration.Get(op).(*histogram); ok {
+		return h
+	}
+	queryHistogramsLock.Lock()
+	defer queryHistogramsLock.Unlock()
+	if h, ok := dbQueryDuration.Get(op).(*histogram); ok {
+		return h
+	}
+	h := newHistogram(queryDurationBuckets)
+	dbQueryDuration.Set(op, h)
+	return h
+}
+
+// queryOperation classifies a sql statement as one of read, insert,
+// update, delete or other
+func queryOperation(query string) string {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return "other"
+	}
+	switch strings.ToLower(fields[0]) {
+	case "select", "with":
+		return "read"
+	case "insert":
+		return "insert"
+	case "update":
+		return "update"
+	case "delete":
+		return "delete"
+	}
+	return "other"
+}
+
+// histogram counts observed values into cumulative buckets, implementing
+// expvar.Var so it can be published alongside other metrics
+type histogram struct {
+	lock    sync.Mutex
+	bounds  []float64
+	buckets []int64
+	count   int64
+	sum     float64
+}
+
+// newHistogram creates a histogram with the given bucket upper bounds,
+// which must be in increasing order. values larger than the last bound
+// are counted in an implicit +Inf bucket
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]int64, len(bounds)+1),
+	}
+}
+
+// Observe records a single value
+func (h *histogram) Observe(v float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	i := 0
+	for ; i < len(h.bounds); i++ {
+		if v <= h.bounds[i] {
+			break
+		}
+	}
+	h.buckets[i]++
+	h.count++
+	h.sum += v
+}
+
+// Count returns the number of values observed
+func (h *histogram) Count() int64 {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	return h.count
+}
+
+// String implements the expvar.Var interface, writing the histogram as
+// JSON with cumulative counts for each bucket keyed by upper bound
+func (h *histogram) String() string {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	buckets := map[string]int64{}
+	var total int64
+	for i, n := range h.buckets {
+		total += n
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'f', -1, 64)
+		}
+		buckets[le] = total
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{
+		"buckets": buckets,
+		"count":   h.count,
+		"sum":     h.sum,
+	})
+	return string(data)
+}
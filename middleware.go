@@ -1,8 +1,14 @@
 package main
 
 import (
+	"bytes"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -19,6 +25,7 @@ func init() {
 func middleware(handler http.HandlerFunc) http.HandlerFunc {
 	// no-auth middware func
 	return func(w http.ResponseWriter, r *http.Request) {
+		cfg := currentConfig()
 		// poor man's logging:
 		log.Infoln(r.Method, r.URL.Path, time.Now())
 
@@ -41,10 +48,135 @@ func middleware(handler http.HandlerFunc) http.HandlerFunc {
 		// 	// If TLS is enabled, set 1 week strict TLS, 1 week for now to prevent catastrophic mess-ups
 		// 	w.Header().Add("Strict-Transport-Security", "max-age=604800")
 		// }
-		handler(w, r)
+		handler := jsonFormatHandler(timeoutHandler(handler, time.Duration(cfg.RequestTimeoutSeconds)*time.Second), cfg.PrettyJson)
+		slowRequestHandler(handler, time.Duration(cfg.SlowRequestThresholdMs)*time.Millisecond)(w, r)
 	}
 }
 
+// jsonFormatHandler compacts JSON responses written by handler, indenting
+// them instead if pretty is true or the request has a pretty=true param.
+// responses that aren't JSON are written unchanged
+func jsonFormatHandler(handler http.HandlerFunc, prettyDefault bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		pretty := prettyDefault
+		// read the query string only, parsing a form here would consume the body
+		if p, err := strconv.ParseBool(r.URL.Query().Get("pretty")); err == nil {
+			pretty = p
+		}
+
+		bw := &bufferedWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(bw, r)
+
+		body := bw.buf.Bytes()
+		if json.Valid(body) {
+			formatted := &bytes.Buffer{}
+			if pretty {
+				json.Indent(formatted, body, "", "  ")
+			} else {
+				json.Compact(formatted, body)
+			}
+			body = formatted.Bytes()
+		}
+
+		w.Header().Del("Content-Length")
+		w.WriteHeader(bw.status)
+		w.Write(body)
+	}
+}
+
+// bufferedWriter holds a response in memory until it's complete
+type bufferedWriter struct {
+	http.ResponseWriter
+	status int
+	buf    bytes.Buffer
+}
+
+func (bw *bufferedWriter) WriteHeader(status int) {
+	bw.status = status
+}
+
+func (bw *bufferedWriter) Write(p []byte) (int, error) {
+	return bw.buf.Write(p)
+}
+
+// slowRequestHandler logs a warning with the method, path, status & duration
+// of any request that handler takes longer than threshold to respond to. faster
+// requests are logged at debug level. a zero or negative threshold disables
+// slow request logging
+func slowRequestHandler(handler http.HandlerFunc, threshold time.Duration) http.HandlerFunc {
+	if threshold <= 0 {
+		return handler
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		handler(sw, r)
+		duration := time.Since(start)
+
+		entry := log.WithFields(logrus.Fields{
+			"method":   r.Method,
+			"path":     r.URL.Path,
+			"status":   sw.status,
+			"duration": duration,
+		})
+		if duration > threshold {
+			entry.Warnln("slow request")
+		} else {
+			entry.Debugln("request")
+		}
+	}
+}
+
+// statusWriter records the status code written to a ResponseWriter
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	sw.status = status
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+// timeoutHandler runs handler with a request context that is cancelled after d,
+// responding with a 503 if handler hasn't finished by then. a zero or negative
+// duration disables the timeout.
+// Long-lived streaming responses shouldn't be wrapped in a timeout.
+func timeoutHandler(handler http.HandlerFunc, d time.Duration) http.HandlerFunc {
+	if d <= 0 {
+		return handler
+	}
+	th := http.TimeoutHandler(handler, d, timeoutBody)
+	return func(w http.ResponseWriter, r *http.Request) {
+		th.ServeHTTP(&timeoutWriter{ResponseWriter: w}, r)
+	}
+}
+
+// timeoutBody is the error envelope apiutil.WriteErrResponse would write for
+// a timed out request
+var timeoutBody = func() string {
+	data, _ := json.MarshalIndent(map[string]interface{}{
+		"meta": map[string]interface{}{
+			"code":  http.StatusServiceUnavailable,
+			"error": "request timed out",
+		},
+	}, "", "  ")
+	return string(data)
+}()
+
+// timeoutWriter marks 503 responses without a Content-Type as JSON.
+// http.TimeoutHandler writes timeoutBody without setting one
+type timeoutWriter struct {
+	http.ResponseWriter
+}
+
+func (tw *timeoutWriter) WriteHeader(status int) {
+	if status == http.StatusServiceUnavailable && tw.Header().Get("Content-Type") == "" {
+		tw.Header().Set("Content-Type", "application/json")
+	}
+	tw.ResponseWriter.WriteHeader(status)
+}
+
 // authMiddleware checks for github auth
 // TODO - this is a carry-over from a former implementation of task_mgmt
 // that was specific to executing the kiwix zim task it should be shifted
@@ -112,13 +244,40 @@ func middleware(handler http.HandlerFunc) http.HandlerFunc {
 // 	}
 // }
 
+// workerAuthorized checks a request for a bearer token matching
+// cfg.WorkerSecret or any of cfg.WorkerSecrets
+func workerAuthorized(r *http.Request) bool {
+	cfg := currentConfig()
+	token := []byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+
+	authorized := false
+	for _, secret := range append([]string{cfg.WorkerSecret}, cfg.WorkerSecrets...) {
+		// empty secrets never match. every secret is compared so timing
+		// doesn't reveal which one matched
+		if secret != "" && subtle.ConstantTimeCompare(token, []byte(secret)) == 1 {
+			authorized = true
+		}
+	}
+	return authorized
+}
+
+// adminAuthorized checks a request for a bearer token matching
+// cfg.AdminApiKey. Admins can use /admin endpoints, & aren't subject to
+// per-owner task limits or the minimum rerun interval
+func adminAuthorized(r *http.Request) bool {
+	key := currentConfig().AdminApiKey
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	// an unset key never matches
+	return key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1
+}
+
 // addCORSHeaders adds CORS header info for whitelisted servers
 func addCORSHeaders(w http.ResponseWriter, r *http.Request) {
 	// origin := r.Header.Get("Origin")
 	// for _, o := range cfg.AllowedOrigins {
 	// 	if origin == o {
 	w.Header().Set("Access-Control-Allow-Origin", r.Header.Get("Origin"))
-	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, POST, DELETE, OPTIONS")
+	w.Header().Set("Access-Control-Allow-Methods", "GET, PUT, PATCH, POST, DELETE, OPTIONS")
 	w.Header().Set("Access-Control-Allow-Headers", "Content-Type,Authorization")
 	w.Header().Set("Access-Control-Allow-Credentials", "true")
 	// return
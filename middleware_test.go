@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/sirupsen/logrus"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeoutHandler(t *testing.T) {
+	cancelled := make(chan bool, 1)
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+			cancelled <- true
+		case <-time.After(time.Second):
+			cancelled <- false
+			w.WriteHeader(http.StatusOK)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	timeoutHandler(slow, time.Millisecond*10)(rr, httptest.NewRequest("GET", "/tasks", nil))
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected timed out request to return %d, got: %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if ct := rr.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("expected timed out response to be json, got content type: %s", ct)
+	}
+	res := struct {
+		Meta struct {
+			Code  int    `json:"code"`
+			Error string `json:"error"`
+		} `json:"meta"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil || res.Meta.Code != http.StatusServiceUnavailable || res.Meta.Error == "" {
+		t.Errorf("expected timed out response to be an error envelope, got: %s", rr.Body.String())
+	}
+	if !<-cancelled {
+		t.Errorf("expected timed out request context to be cancelled")
+	}
+
+	rr = httptest.NewRecorder()
+	timeoutHandler(EmptyOkHandler, time.Second)(rr, httptest.NewRequest("GET", "/tasks", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected fast request to return %d, got: %d", http.StatusOK, rr.Code)
+	}
+}
+
+func TestJsonFormatHandler(t *testing.T) {
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"meta": {"code": 201},  "data": [1, 2]}`))
+	}
+	text := func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("not json\n"))
+	}
+
+	cases := []struct {
+		handler http.HandlerFunc
+		pretty  bool
+		path    string
+		expect  string
+	}{
+		{handler, false, "/tasks", `{"meta":{"code":201},"data":[1,2]}`},
+		{handler, false, "/tasks?pretty=true", "{\n  \"meta\": {\n    \"code\": 201\n  },\n  \"data\": [\n    1,\n    2\n  ]\n}"},
+		{handler, true, "/tasks", "{\n  \"meta\": {\n    \"code\": 201\n  },\n  \"data\": [\n    1,\n    2\n  ]\n}"},
+		{handler, true, "/tasks?pretty=false", `{"meta":{"code":201},"data":[1,2]}`},
+		{text, false, "/tasks", "not json\n"},
+	}
+
+	for i, c := range cases {
+		rr := httptest.NewRecorder()
+		jsonFormatHandler(c.handler, c.pretty)(rr, httptest.NewRequest("GET", c.path, nil))
+		if got := rr.Body.String(); got != c.expect {
+			t.Errorf("case %d body mismatch. expected: %q, got: %q", i, c.expect, got)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	jsonFormatHandler(handler, false)(rr, httptest.NewRequest("GET", "/tasks", nil))
+	if rr.Code != http.StatusCreated {
+		t.Errorf("expected status to be kept. expected: %d, got: %d", http.StatusCreated, rr.Code)
+	}
+}
+
+func TestSlowRequestHandler(t *testing.T) {
+	prev := log
+	defer func() { log = prev }()
+
+	buf := &bytes.Buffer{}
+	log = logrus.New()
+	log.Out = buf
+	log.Level = logrus.InfoLevel
+	log.Formatter = &logrus.TextFormatter{DisableColors: true}
+
+	slow := func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Millisecond * 20)
+		w.WriteHeader(http.StatusAccepted)
+	}
+	slowRequestHandler(slow, time.Millisecond*5)(httptest.NewRecorder(), httptest.NewRequest("POST", "/tasks", nil))
+
+	out := buf.String()
+	if !strings.Contains(out, "slow request") {
+		t.Errorf("expected slow request to be logged, got: %s", out)
+	}
+	for _, field := range []string{"method=POST", "path=/tasks", "status=202", "duration="} {
+		if !strings.Contains(out, field) {
+			t.Errorf("expected slow request log to contain %s, got: %s", field, out)
+		}
+	}
+
+	buf.Reset()
+	slowRequestHandler(EmptyOkHandler, time.Second)(httptest.NewRecorder(), httptest.NewRequest("GET", "/tasks", nil))
+	if buf.Len() != 0 {
+		t.Errorf("expected fast request not to be logged at info level, got: %s", buf.String())
+	}
+}
+
+func TestAdminAuthorized(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+
+	cases := []struct {
+		key, header string
+		expect      bool
+	}{
+		{"", "", false},
+		{"", "Bearer ", false},
+		{"key", "Bearer key", true},
+		{"key", "Bearer wrong", false},
+		{"key", "Bearer key2", false},
+		{"key", "", false},
+		{"key", "key", true},
+	}
+
+	for i, c := range cases {
+		setConfig(&config{AdminApiKey: c.key})
+		r := httptest.NewRequest("GET", "/tasks", nil)
+		if c.header != "" {
+			r.Header.Set("Authorization", c.header)
+		}
+		if got := adminAuthorized(r); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
+
+func TestWorkerAuthorized(t *testing.T) {
+	prev := currentConfig()
+	defer setConfig(prev)
+
+	cases := []struct {
+		secret  string
+		secrets []string
+		token   string
+		expect  bool
+	}{
+		{"", nil, "", false},
+		{"", nil, "anything", false},
+		{"", []string{""}, "", false},
+		{"new", nil, "new", true},
+		{"new", []string{"old"}, "new", true},
+		{"new", []string{"old"}, "old", true},
+		{"new", []string{"old"}, "unknown", false},
+		{"new", []string{"old"}, "", false},
+		{"", []string{"old"}, "old", true},
+	}
+
+	for i, c := range cases {
+		setConfig(&config{WorkerSecret: c.secret, WorkerSecrets: c.secrets})
+		r := httptest.NewRequest("POST", "/workers/a/heartbeat", nil)
+		if c.token != "" {
+			r.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		if got := workerAuthorized(r); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %t, got: %t", i, c.expect, got)
+		}
+	}
+}
@@ -0,0 +1,682 @@
+package main
+
+import (
+	"net/http"
+)
+
+// OpenApiHandler serves an OpenAPI 3 description of the JSON API
+func OpenApiHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(openApiSpec))
+}
+
+// openApiSpec is maintained by hand, keep it in sync with NewServerRoutes
+// & the task model when changing the API
+const openApiSpec = `{
+  "openapi": "3.0.0",
+  "info": {
+    "title": "task-mgmt",
+    "description": "Manage tasks, tracking their state as they move through a queue. responses are compact JSON, add a pretty=true query param to any request for indented JSON",
+    "version": "0.1.0"
+  },
+  "paths": {
+    "/healthcheck": {
+      "get": {
+        "summary": "check that the server is up",
+        "responses": {
+          "200": { "description": "server is up" }
+        }
+      }
+    },
+    "/healthz": {
+      "get": {
+        "summary": "liveness check, responds 200 if the process is up. servers can be configured to also respond 503 when queued tasks have waited too long without any task succeeding",
+        "responses": {
+          "200": { "description": "server is up" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/ready": {
+      "get": {
+        "summary": "readiness check, responds 200 once the database is connected & migrated",
+        "responses": {
+          "200": { "description": "server is ready" },
+          "503": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks": {
+      "get": {
+        "summary": "list tasks",
+        "parameters": [
+          { "name": "page", "in": "query", "schema": { "type": "integer", "minimum": 0 } },
+          { "name": "pageSize", "in": "query", "description": "defaults to 50, sizes larger than 200 are clamped", "schema": { "type": "integer", "minimum": 0 } },
+          { "name": "status", "in": "query", "description": "the deprecated name enquing is accepted for ready", "schema": { "type": "string", "enum": ["ready", "queued", "running", "finished", "failed", "cancelled"] } },
+          { "name": "type", "in": "query", "schema": { "type": "string" } },
+          { "name": "userId", "in": "query", "schema": { "type": "string" } },
+          { "name": "sourceUrl", "in": "query", "description": "only list tasks with this \"url\" param. when the server normalizes urls tasks stored with either this spelling or its normalized form match", "schema": { "type": "string" } },
+          { "name": "sourceUrlPrefix", "in": "query", "description": "match tasks with urls starting with sourceUrl", "schema": { "type": "boolean" } },
+          { "name": "orderBy", "in": "query", "description": "column & optional direction, eg: \"created DESC\"", "schema": { "type": "string" } },
+          { "name": "createdAfter", "in": "query", "schema": { "type": "string", "format": "date-time" } },
+          { "name": "createdBefore", "in": "query", "schema": { "type": "string", "format": "date-time" } },
+          { "name": "If-Modified-Since", "in": "header", "description": "respond 304 if no matching task has been updated since this time", "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/TaskList" },
+          "304": { "description": "no matching task has been updated since If-Modified-Since" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "create & enqueue a task",
+        "requestBody": { "$ref": "#/components/requestBodies/Task" },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "409": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "415": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/QueueFull" }
+        }
+      }
+    },
+    "/tasks/stats": {
+      "get": {
+        "summary": "count tasks by status",
+        "responses": {
+          "200": {
+            "description": "task counts",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": {
+                      "type": "object",
+                      "properties": {
+                        "statuses": { "type": "object", "additionalProperties": { "type": "integer" } },
+                        "activeRuns": { "type": "integer", "description": "tasks this server is performing right now" }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "read a task, including tasks that have been archived",
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "500": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "patch": {
+        "summary": "update a task's title, type, params or notifyEmails. a task's owner can't be changed. if the server locks finished task definitions, changing the type or params of a finished or failed task conflicts",
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "title": { "type": "string" },
+                  "type": { "type": "string" },
+                  "params": { "type": "object" },
+                  "notifyEmails": { "type": "array", "items": { "type": "string", "format": "email" } }
+                },
+                "additionalProperties": false
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "409": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "415": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/clone": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "post": {
+        "summary": "create a new task with the same definition, optionally overriding params",
+        "requestBody": {
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": { "params": { "type": "object" } }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/retry-now": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "post": {
+        "summary": "immediately re-run a failed task",
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "409": { "$ref": "#/components/responses/Error" },
+          "429": { "$ref": "#/components/responses/QueueFull" }
+        }
+      }
+    },
+    "/tasks/{id}/cancel": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "post": {
+        "summary": "cancel a task. queued tasks fail right away, running tasks are asked to stop on their worker's next heartbeat",
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "409": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/delete": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "request a single-use token to confirm deleting a task",
+        "responses": {
+          "200": {
+            "description": "confirmation token",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": {
+                      "type": "object",
+                      "properties": {
+                        "token": { "type": "string" },
+                        "expires": { "type": "string", "format": "date-time" }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "delete a task",
+        "parameters": [
+          { "name": "token", "in": "query", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/Task" },
+          "403": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/logs": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "read a task's log output, including archived tasks",
+        "parameters": [
+          { "name": "limit", "in": "query", "description": "defaults to 50, limits larger than 200 are clamped", "schema": { "type": "integer", "minimum": 0 } },
+          { "name": "tail", "in": "query", "description": "return the last limit lines", "schema": { "type": "boolean" } }
+        ],
+        "responses": {
+          "200": { "$ref": "#/components/responses/TaskLogs" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "append lines to a task's log",
+        "security": [{ "worker": [] }],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "lines": { "type": "array", "items": { "type": "string" } }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/TaskLogs" },
+          "401": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/artifacts": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "list the artifacts a task produced",
+        "responses": {
+          "200": { "$ref": "#/components/responses/TaskArtifacts" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "register artifacts a task produced, replacing existing artifacts with the same name",
+        "security": [{ "worker": [] }],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "artifacts": { "type": "array", "items": { "$ref": "#/components/schemas/TaskArtifact" } }
+                }
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": { "$ref": "#/components/responses/TaskArtifacts" },
+          "400": { "$ref": "#/components/responses/Error" },
+          "401": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/notes": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "list notes left on a task, oldest first, including archived tasks",
+        "parameters": [
+          { "name": "page", "in": "query", "schema": { "type": "integer", "minimum": 0 } },
+          { "name": "pageSize", "in": "query", "schema": { "type": "integer", "minimum": 0 } }
+        ],
+        "responses": {
+          "200": {
+            "description": "a page of the task's notes",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": { "type": "array", "items": { "$ref": "#/components/schemas/TaskNote" } }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      },
+      "post": {
+        "summary": "add a note to a task. notes can't be changed once added, the author comes from the request's credentials",
+        "security": [{ "admin": [] }, { "worker": [] }],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "body": { "type": "string" }
+                },
+                "required": ["body"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "the added note",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": { "$ref": "#/components/schemas/TaskNote" }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "401": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "415": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/tasks/{id}/raw": {
+      "parameters": [{ "$ref": "#/components/parameters/TaskId" }],
+      "get": {
+        "summary": "read a task's row exactly as it's stored, for debugging. null columns are null, & other values aren't formatted",
+        "security": [{ "admin": [] }],
+        "responses": {
+          "200": {
+            "description": "the task's columns, keyed by column name",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": { "type": "object", "additionalProperties": true }
+                  }
+                }
+              }
+            }
+          },
+          "401": { "$ref": "#/components/responses/Error" },
+          "404": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/admin/tasks/bulk-status": {
+      "post": {
+        "summary": "correct the status of every task matching a filter, recording an audit entry for each. if any task can't make the change, none are changed",
+        "security": [{ "admin": [] }],
+        "requestBody": {
+          "required": true,
+          "content": {
+            "application/json": {
+              "schema": {
+                "type": "object",
+                "properties": {
+                  "filter": {
+                    "type": "object",
+                    "description": "must set at least one field",
+                    "properties": {
+                      "status": { "type": "string", "enum": ["ready", "queued", "running", "finished", "failed", "cancelled"] },
+                      "type": { "type": "string" },
+                      "userId": { "type": "string" },
+                      "createdAfter": { "type": "string", "format": "date-time" },
+                      "createdBefore": { "type": "string", "format": "date-time" }
+                    }
+                  },
+                  "status": { "type": "string", "enum": ["finished", "failed"] },
+                  "reason": { "type": "string", "description": "recorded in the audit log, & as the error of failed tasks" }
+                },
+                "required": ["filter", "status", "reason"]
+              }
+            }
+          }
+        },
+        "responses": {
+          "200": {
+            "description": "ids of the changed tasks",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": {
+                      "type": "object",
+                      "properties": {
+                        "taskIds": { "type": "array", "items": { "type": "string", "format": "uuid" } }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "400": { "$ref": "#/components/responses/Error" },
+          "401": { "$ref": "#/components/responses/Error" },
+          "409": { "$ref": "#/components/responses/Error" },
+          "413": { "$ref": "#/components/responses/Error" },
+          "415": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/workers/{id}/heartbeat": {
+      "post": {
+        "summary": "record that a worker is alive, workers that stop sending heartbeats have their running tasks requeued",
+        "security": [{ "worker": [] }],
+        "parameters": [
+          { "name": "id", "in": "path", "required": true, "schema": { "type": "string" } }
+        ],
+        "responses": {
+          "200": {
+            "description": "heartbeat recorded, cancel lists ids of the worker's tasks it should stop & fail with error \"cancelled\"",
+            "content": {
+              "application/json": {
+                "schema": {
+                  "type": "object",
+                  "properties": {
+                    "meta": { "$ref": "#/components/schemas/Meta" },
+                    "data": {
+                      "type": "object",
+                      "properties": {
+                        "workerId": { "type": "string" },
+                        "lastSeen": { "type": "string", "format": "date-time" },
+                        "cancel": { "type": "array", "items": { "type": "string" } }
+                      }
+                    }
+                  }
+                }
+              }
+            }
+          },
+          "401": { "$ref": "#/components/responses/Error" }
+        }
+      }
+    },
+    "/openapi.json": {
+      "get": {
+        "summary": "this document",
+        "responses": {
+          "200": { "description": "OpenAPI 3 document" }
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "worker": { "type": "http", "scheme": "bearer" },
+      "admin": { "type": "http", "scheme": "bearer", "description": "AdminApiKey, required for /admin endpoints & exempts requests from per-owner task limits & the minimum rerun interval" }
+    },
+    "parameters": {
+      "TaskId": { "name": "id", "in": "path", "required": true, "schema": { "type": "string", "format": "uuid" } }
+    },
+    "requestBodies": {
+      "Task": {
+        "required": true,
+        "content": {
+          "application/json": { "schema": { "$ref": "#/components/schemas/Task" } }
+        }
+      }
+    },
+    "responses": {
+      "Task": {
+        "description": "a task",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" },
+                "data": { "$ref": "#/components/schemas/Task" }
+              }
+            }
+          }
+        }
+      },
+      "TaskList": {
+        "description": "a page of tasks",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" },
+                "data": { "type": "array", "items": { "$ref": "#/components/schemas/Task" } },
+                "pagination": {
+                  "type": "object",
+                  "properties": { "nextUrl": { "type": "string" } }
+                }
+              }
+            }
+          }
+        }
+      },
+      "TaskLogs": {
+        "description": "task log lines in chronological order",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" },
+                "data": { "type": "array", "items": { "$ref": "#/components/schemas/TaskLog" } }
+              }
+            }
+          }
+        }
+      },
+      "TaskArtifacts": {
+        "description": "a task's artifacts in the order they were registered",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" },
+                "data": { "type": "array", "items": { "$ref": "#/components/schemas/TaskArtifact" } }
+              }
+            }
+          }
+        }
+      },
+      "QueueFull": {
+        "description": "the server is already running as many tasks as it can, the task was run too recently, or its owner has too many tasks waiting to start",
+        "headers": {
+          "Retry-After": { "description": "seconds to wait before retrying", "schema": { "type": "integer" } }
+        },
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" }
+              }
+            }
+          }
+        }
+      },
+      "Error": {
+        "description": "an error",
+        "content": {
+          "application/json": {
+            "schema": {
+              "type": "object",
+              "properties": {
+                "meta": { "$ref": "#/components/schemas/Meta" }
+              }
+            }
+          }
+        }
+      }
+    },
+    "schemas": {
+      "Meta": {
+        "type": "object",
+        "properties": {
+          "code": { "type": "integer" },
+          "message": { "type": "string" },
+          "error": { "type": "string" }
+        },
+        "required": ["code"]
+      },
+      "Task": {
+        "type": "object",
+        "properties": {
+          "id": { "type": "string", "format": "uuid", "description": "generated if not supplied when creating a task" },
+          "created": { "type": "string", "format": "date-time", "readOnly": true },
+          "updated": { "type": "string", "format": "date-time", "readOnly": true },
+          "title": { "type": "string" },
+          "userId": { "type": "string" },
+          "type": { "type": "string" },
+          "params": { "type": "object" },
+          "status": { "type": "string", "readOnly": true },
+          "error": { "type": "string", "readOnly": true },
+          "enqueued": { "type": "string", "format": "date-time", "readOnly": true },
+          "started": { "type": "string", "format": "date-time", "readOnly": true },
+          "succeeded": { "type": "string", "format": "date-time", "readOnly": true },
+          "failed": { "type": "string", "format": "date-time", "readOnly": true },
+          "workerId": { "type": "string", "readOnly": true },
+          "notifyEmails": { "type": "array", "items": { "type": "string", "format": "email" }, "description": "notified about this task as well as, or instead of, the server's recipients" },
+          "definitionHash": { "type": "string", "readOnly": true, "description": "sha256 checksum of the task's type & params, unchanged by run state" },
+          "progress": { "$ref": "#/components/schemas/Progress" },
+          "artifacts": { "type": "array", "readOnly": true, "items": { "$ref": "#/components/schemas/TaskArtifact" } }
+        },
+        "required": ["type"]
+      },
+      "Progress": {
+        "type": "object",
+        "readOnly": true,
+        "properties": {
+          "percent": { "type": "number" },
+          "step": { "type": "integer" },
+          "steps": { "type": "integer" },
+          "status": { "type": "string" },
+          "done": { "type": "boolean" },
+          "dest": { "type": "string" },
+          "error": { "type": "string" }
+        }
+      },
+      "TaskLog": {
+        "type": "object",
+        "properties": {
+          "taskId": { "type": "string", "format": "uuid" },
+          "created": { "type": "string", "format": "date-time" },
+          "line": { "type": "string" }
+        }
+      },
+      "TaskArtifact": {
+        "type": "object",
+        "properties": {
+          "name": { "type": "string" },
+          "url": { "type": "string" },
+          "hash": { "type": "string" },
+          "size": { "type": "integer" }
+        },
+        "required": ["name"]
+      },
+      "TaskNote": {
+        "type": "object",
+        "properties": {
+          "taskId": { "type": "string", "format": "uuid" },
+          "author": { "type": "string", "enum": ["admin", "worker"] },
+          "body": { "type": "string" },
+          "created": { "type": "string", "format": "date-time" }
+        }
+      }
+    }
+  }
+}`
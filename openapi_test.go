@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOpenApiHandler(t *testing.T) {
+	rr := httptest.NewRecorder()
+	OpenApiHandler(rr, httptest.NewRequest("GET", "/openapi.json", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status %d, got: %d", http.StatusOK, rr.Code)
+	}
+
+	doc := struct {
+		OpenApi string                 `json:"openapi"`
+		Paths   map[string]interface{} `json:"paths"`
+	}{}
+	if err := json.NewDecoder(rr.Body).Decode(&doc); err != nil {
+		t.Fatalf("invalid openapi json: %s", err.Error())
+	}
+	if doc.OpenApi != "3.0.0" {
+		t.Errorf("openapi version mismatch. expected: %s, got: %s", "3.0.0", doc.OpenApi)
+	}
+
+	for _, path := range []string{"/tasks", "/tasks/{id}", "/tasks/{id}/clone", "/tasks/{id}/cancel", "/tasks/{id}/delete", "/tasks/{id}/logs", "/tasks/{id}/artifacts", "/tasks/{id}/notes", "/tasks/{id}/raw"} {
+		if doc.Paths[path] == nil {
+			t.Errorf("expected paths to include %s", path)
+		}
+	}
+}
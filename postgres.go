@@ -2,8 +2,21 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+	"github.com/sirupsen/logrus"
 )
 
 // this interface unifies both *sql.Row & *sql.Rows
@@ -21,19 +34,306 @@ type sqlExecable interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
+// sqlQueryExecable unifies both *sql.DB & *sql.Tx for reads & writes
 type sqlQueryExecable interface {
 	sqlQueryable
 	sqlExecable
 }
 
+// sqlContextQueryExecable unifies both *sql.DB & *sql.Tx for reads & writes
+// that are cancelled when a context is done
+type sqlContextQueryExecable interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+var (
+	_ sqlQueryExecable = (*sql.DB)(nil)
+	_ sqlQueryExecable = (*sql.Tx)(nil)
+
+	_ sqlContextQueryExecable = (*sql.DB)(nil)
+	_ sqlContextQueryExecable = (*sql.Tx)(nil)
+)
+
+// txIsolationLevels maps DbTxIsolation settings to the isolation level
+// transactions are started with. empty uses the database's default
+var txIsolationLevels = map[string]sql.IsolationLevel{
+	"":                sql.LevelDefault,
+	"read committed":  sql.LevelReadCommitted,
+	"repeatable read": sql.LevelRepeatableRead,
+	"serializable":    sql.LevelSerializable,
+}
+
+// WithTx calls f with a transaction on db, committing if f succeeds &
+// rolling back if f returns an error or panics. transactions use the
+// configured isolation level, & are retried from the start if they fail to
+// serialize with concurrent transactions, so f may be called more than once.
+// the transaction is rolled back if ctx is done before it commits, pass a
+// request's context so a timed out request doesn't keep writing
+func WithTx(ctx context.Context, db *sql.DB, f func(tx *sql.Tx) error) error {
+	level, retries := sql.LevelDefault, 0
+	if cfg := currentConfig(); cfg != nil {
+		level, retries = txIsolationLevels[cfg.DbTxIsolation], cfg.DbTxMaxRetries
+	}
+	return retryTx(retries, func() error { return runTx(ctx, db, level, f) })
+}
+
+// runTx calls f with a single transaction on db at isolation level
+func runTx(ctx context.Context, db *sql.DB, level sql.IsolationLevel, f func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: level})
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		if p := recover(); p != nil {
+			tx.Rollback()
+			panic(p)
+		}
+	}()
+
+	if err := f(tx); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			log.Infoln("error rolling back transaction:", rerr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// retryTx calls run, calling it again up to retries more times while it
+// fails with a serialization failure, after a short random pause so
+// conflicting transactions don't collide again
+func retryTx(retries int, run func() error) error {
+	for i := 0; ; i++ {
+		err := run()
+		if i >= retries || !isSerializationFailure(err) {
+			return err
+		}
+		txRetries.Add(1)
+		log.Infof("retrying transaction after serialization failure: %s", err)
+		time.Sleep(time.Duration(rand.Intn(10*(i+1))) * time.Millisecond)
+	}
+}
+
+// isSerializationFailure reports whether err is a postgres serialization
+// failure or deadlock, which succeed if the transaction is retried
+func isSerializationFailure(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && (pqErr.Code == "40001" || pqErr.Code == "40P01")
+}
+
+// readReplica is an optional read replica connection & a store backed by it
+type readReplica struct {
+	db    *sql.DB
+	store datastore.Datastore
+}
+
+// replicaValue holds the *readReplica in use, which is replaced when the
+// replica (re)connects. Access it with currentReplica & setReplica, which are
+// safe for concurrent use. use readDB & readStore for queries
+var replicaValue atomic.Value
+
+// currentReplica returns the read replica, nil if none is configured
+func currentReplica() *readReplica {
+	r, _ := replicaValue.Load().(*readReplica)
+	return r
+}
+
+// setReplica replaces the read replica, nil removes it
+func setReplica(r *readReplica) {
+	replicaValue.Store(r)
+}
+
+// readDB returns the connection read-only queries should use, which is the
+// read replica if one is configured, falling back to the primary appDB.
+// writes must always go to appDB
+func readDB() *sql.DB {
+	if r := currentReplica(); r != nil {
+		return r.db
+	}
+	return appDB
+}
+
+// readStore returns the datastore read-only access should use, backed by the
+// read replica if one is configured, falling back to the primary store
+func readStore() datastore.Datastore {
+	if r := currentReplica(); r != nil {
+		return r.store
+	}
+	return store
+}
+
+// sensitiveColumns lists columns whose values should never be written
+// to logs
+var sensitiveColumns = map[string]bool{
+	"params": true,
+}
+
+// queryLogger wraps a sqlQueryExecable, recording query metrics &
+// logging each statement & how long it took to execute
+type queryLogger struct {
+	db sqlQueryExecable
+	// queries are cancelled when ctx is done, if db supports contexts
+	ctx context.Context
+	// statements aren't logged if log is nil
+	log *logrus.Logger
+}
+
+// newQueryLogger wraps db in a queryLogger. statements are only
+// logged if cfg.LogQueries is true. queries made through store are
+// recorded by it's connection, see openLoggedDB
+func newQueryLogger(db sqlQueryExecable) sqlQueryExecable {
+	return newQueryLoggerContext(context.Background(), db)
+}
+
+// newQueryLoggerContext wraps db in a queryLogger that runs queries with ctx
+func newQueryLoggerContext(ctx context.Context, db sqlQueryExecable) sqlQueryExecable {
+	return &queryLogger{db: db, ctx: ctx, log: queryLog()}
+}
+
+// queryLog returns the logger sql statements are written to, nil if
+// cfg.LogQueries is false
+func queryLog() *logrus.Logger {
+	if cfg := currentConfig(); cfg != nil && cfg.LogQueries {
+		return log
+	}
+	return nil
+}
+
+func (q *queryLogger) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	var (
+		rows *sql.Rows
+		err  error
+	)
+	if db, ok := q.db.(sqlContextQueryExecable); ok && q.ctx != nil {
+		rows, err = db.QueryContext(q.ctx, query, args...)
+	} else {
+		rows, err = q.db.Query(query, args...)
+	}
+	q.record(query, args, time.Since(start), err)
+	return rows, err
+}
+
+func (q *queryLogger) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	var row *sql.Row
+	if db, ok := q.db.(sqlContextQueryExecable); ok && q.ctx != nil {
+		row = db.QueryRowContext(q.ctx, query, args...)
+	} else {
+		row = q.db.QueryRow(query, args...)
+	}
+	q.record(query, args, time.Since(start), nil)
+	return row
+}
+
+func (q *queryLogger) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	var (
+		res sql.Result
+		err error
+	)
+	if db, ok := q.db.(sqlContextQueryExecable); ok && q.ctx != nil {
+		res, err = db.ExecContext(q.ctx, query, args...)
+	} else {
+		res, err = q.db.Exec(query, args...)
+	}
+	q.record(query, args, time.Since(start), err)
+	return res, err
+}
+
+// record observes query metrics & logs the statement
+func (q *queryLogger) record(query string, args []interface{}, duration time.Duration, err error) {
+	observeQuery(query, duration, err)
+	if q.log == nil {
+		return
+	}
+
+	entry := q.log.WithFields(logrus.Fields{
+		"query":    strings.Join(strings.Fields(query), " "),
+		"args":     redactArgs(query, args),
+		"duration": duration.String(),
+	})
+	if err != nil {
+		entry.WithError(err).Info("sql query error")
+		return
+	}
+	entry.Info("sql query")
+}
+
+var (
+	// matches "column = $1" style assignments & comparisons
+	rxAssignedParam = regexp.MustCompile(`(\w+)\s*=\s*\$(\d+)`)
+	// matches "INSERT INTO table (columns) VALUES (params)" statements
+	rxInsertParams = regexp.MustCompile(`(?is)insert\s+into\s+\w+\s*\(([^)]*)\)\s*values\s*\(([^)]*)\)`)
+)
+
+// redactArgs replaces any arguments bound to sensitive columns
+// in query with a placeholder value
+func redactArgs(query string, args []interface{}) []interface{} {
+	redacted := make([]interface{}, len(args))
+	copy(redacted, args)
+
+	redact := func(column, bindvar string) {
+		if !sensitiveColumns[strings.ToLower(strings.TrimSpace(column))] {
+			return
+		}
+		i, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(bindvar), "$"))
+		if err != nil || i < 1 || i > len(redacted) {
+			return
+		}
+		redacted[i-1] = "[redacted]"
+	}
+
+	for _, m := range rxAssignedParam.FindAllStringSubmatch(query, -1) {
+		redact(m[1], m[2])
+	}
+
+	if m := rxInsertParams.FindStringSubmatch(query); m != nil {
+		columns, params := strings.Split(m[1], ","), strings.Split(m[2], ",")
+		for i := 0; i < len(columns) && i < len(params); i++ {
+			redact(columns[i], params[i])
+		}
+	}
+
+	return redacted
+}
+
 func connectToAppDb() {
 	var err error
-	appDB, err = SetupConnection(cfg.PostgresDbUrl)
+	appDB, err = SetupConnection(postgresConnString(currentConfig().PostgresDbUrl))
 	if err != nil {
 		log.Info(err)
 	}
 }
 
+// postgresConnString adds per-connection settings from config to a
+// postgres connection string
+func postgresConnString(connString string) string {
+	cfg := currentConfig()
+	if cfg == nil || cfg.DbStatementTimeoutMs <= 0 {
+		return connString
+	}
+	return withStatementTimeout(connString, cfg.DbStatementTimeoutMs)
+}
+
+// withStatementTimeout sets statement_timeout on a postgres connection string,
+// which lib/pq sends to the server as a run-time parameter for each connection.
+// connString can be either a url or a list of key=value pairs
+func withStatementTimeout(connString string, ms int) string {
+	if strings.HasPrefix(connString, "postgres://") || strings.HasPrefix(connString, "postgresql://") {
+		if u, err := url.Parse(connString); err == nil {
+			q := u.Query()
+			q.Set("statement_timeout", strconv.Itoa(ms))
+			u.RawQuery = q.Encode()
+			return u.String()
+		}
+	}
+	return fmt.Sprintf("%s statement_timeout=%d", strings.TrimSpace(connString), ms)
+}
+
 // Sets up a connection with a given postgres db connection string
 func SetupConnection(connString string) (db *sql.DB, err error) {
 	db, err = sql.Open("postgres", connString)
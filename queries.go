@@ -4,7 +4,7 @@ const qRepos = `
 SELECT
   id, created, updated, url, branch, latest_commit
 FROM repos
-ORDER BY $1
+ORDER BY $1, id
 LIMIT $2 OFFSET $3;`
 
 const qRepoReadById = `
@@ -25,3 +25,125 @@ UPDATE repos SET
 WHERE id = $1;`
 
 const qRepoDelete = `DELETE FROM repos WHERE id = $1;`
+
+const qTaskLogInsert = `
+INSERT INTO task_logs
+  (task_id, created, line)
+VALUES
+  ($1, $2, $3);`
+
+// log & note reads include the archive tables, archived rows keep their ids
+// so ordering by id is unchanged
+const qTaskLogs = `
+SELECT
+  task_id, created, line
+FROM (
+  SELECT id, task_id, created, line FROM task_logs
+  UNION ALL
+  SELECT id, task_id, created, line FROM task_logs_archive
+) AS logs
+WHERE task_id = $1
+ORDER BY id ASC
+LIMIT $2 OFFSET $3;`
+
+// select the last $2 log lines for a task, in chronological order
+const qTaskLogsTail = `
+SELECT task_id, created, line FROM (
+  SELECT id, task_id, created, line
+  FROM (
+    SELECT id, task_id, created, line FROM task_logs
+    UNION ALL
+    SELECT id, task_id, created, line FROM task_logs_archive
+  ) AS logs
+  WHERE task_id = $1
+  ORDER BY id DESC
+  LIMIT $2
+) AS tail
+ORDER BY id ASC;`
+
+const qTaskNoteInsert = `
+INSERT INTO task_notes
+  (task_id, created, author, body)
+VALUES
+  ($1, $2, $3, $4);`
+
+const qTaskNotes = `
+SELECT
+  task_id, created, author, body
+FROM (
+  SELECT id, task_id, created, author, body FROM task_notes
+  UNION ALL
+  SELECT id, task_id, created, author, body FROM task_notes_archive
+) AS notes
+WHERE task_id = $1
+ORDER BY created ASC, id ASC
+LIMIT $2 OFFSET $3;`
+
+// qTaskSuccessHealth reads the time of the most recent task success & the
+// time the longest-waiting queued task was enqueued
+const qTaskSuccessHealth = `
+SELECT
+  (SELECT max(succeeded) FROM tasks),
+  (SELECT min(enqueued) FROM tasks
+   WHERE enqueued IS NOT NULL AND started IS NULL AND succeeded IS NULL AND failed IS NULL);`
+
+const qTaskRaw = `SELECT * FROM tasks WHERE id = $1;`
+
+const qTaskAuditInsert = `
+INSERT INTO task_audit
+  (task_id, created, actor, from_status, to_status, reason)
+VALUES
+  ($1, $2, $3, $4, $5, $6);`
+
+const qTaskAuditEntries = `
+SELECT
+  task_id, created, actor, from_status, to_status, reason
+FROM task_audit
+WHERE task_id = $1
+ORDER BY created ASC, id ASC;`
+
+const qWorkerHeartbeatUpsert = `
+INSERT INTO worker_heartbeats
+  (worker_id, last_seen)
+VALUES
+  ($1, $2)
+ON CONFLICT (worker_id) DO UPDATE SET last_seen = $2;`
+
+// remove & return workers that haven't sent a heartbeat since $1.
+// deleting keeps stale workers from being swept more than once
+const qWorkerHeartbeatsDeleteStale = `
+DELETE FROM worker_heartbeats
+WHERE last_seen < $1
+RETURNING worker_id;`
+
+// return a worker's in-flight tasks to the queued state
+const qWorkerTasksRequeue = `
+UPDATE tasks SET
+  started = NULL, worker_id = '', updated = $2
+WHERE
+  worker_id = $1 AND
+  started IS NOT NULL AND
+  succeeded IS NULL AND
+  failed IS NULL
+RETURNING id;`
+
+const qTaskCancelRequestUpsert = `
+INSERT INTO task_cancel_requests
+  (task_id, requested)
+VALUES
+  ($1, $2)
+ON CONFLICT (task_id) DO UPDATE SET requested = $2;`
+
+// select a worker's in-flight tasks that have been asked to cancel since
+// they started. requests from before a retry don't apply to the new run
+const qWorkerTasksCancelRequested = `
+SELECT t.id
+FROM tasks t
+JOIN task_cancel_requests c ON c.task_id = t.id
+WHERE
+  t.worker_id = $1 AND
+  t.started IS NOT NULL AND
+  t.succeeded IS NULL AND
+  t.failed IS NULL AND
+  c.requested >= t.started
+ORDER BY t.started ASC, t.id ASC;`
@@ -13,6 +13,7 @@ var rpool *redis.Pool
 var ErrNoRedisConn = fmt.Errorf("No connection to redis could be found")
 
 func connectRedis() (err error) {
+	cfg := currentConfig()
 	if cfg.RedisUrl == "" {
 		return fmt.Errorf("no redis url specified")
 	}
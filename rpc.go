@@ -13,6 +13,7 @@ import (
 // other servers
 func listenRpc() (err error) {
 	var ln net.Listener
+	cfg := currentConfig()
 
 	if cfg.RpcPort == "" {
 		log.Infoln("no rpc port specified, rpc disabled")
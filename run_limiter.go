@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/datatogether/api/apiutil"
+)
+
+const (
+	// QueueFullReject refuses new runs while every run slot is taken
+	QueueFullReject = "reject"
+	// QueueFullBlock accepts new runs, which wait for a free slot
+	QueueFullBlock = "block"
+	// QueueFullFair accepts new runs like QueueFullBlock, but hands free
+	// slots to waiting runs round-robin by task owner instead of in the order
+	// they arrived, so one user submitting many tasks can't starve the rest
+	QueueFullFair = "fair"
+)
+
+// queueFullRetryAfter is how long clients are asked to wait before
+// retrying a run that was refused because the queue is full
+const queueFullRetryAfter = 10 * time.Second
+
+// errQueueFull is returned to clients when a run is refused
+var errQueueFull = errors.New("task queue is full, try again later")
+
+// localRuns limits tasks performed by runTask, nil means unlimited
+var localRuns *runLimiter
+
+// runLimiter bounds the number of tasks this server performs at once.
+// a nil runLimiter is unlimited
+type runLimiter struct {
+	sync.Mutex
+	max, active int
+	// refuse new runs when full instead of waiting for a free slot
+	reject bool
+	// queue waiting runs by owner, taking turns between owners
+	fair bool
+	// owners with waiting runs, in the order they'll next get a slot
+	owners []string
+	// waiting runs for each owner, closed when the run is given a slot
+	waiting map[string][]chan struct{}
+}
+
+// newRunLimiter creates a limiter that allows max concurrent runs, returning
+// nil if max is 0 or less
+func newRunLimiter(max int, behavior string) *runLimiter {
+	if max <= 0 {
+		return nil
+	}
+	return &runLimiter{
+		max:     max,
+		reject:  behavior != QueueFullBlock && behavior != QueueFullFair,
+		fair:    behavior == QueueFullFair,
+		waiting: map[string][]chan struct{}{},
+	}
+}
+
+// rejecting reports whether new runs should be refused right now
+func (l *runLimiter) rejecting() bool {
+	if l == nil || !l.reject {
+		return false
+	}
+	l.Lock()
+	defer l.Unlock()
+	return l.active >= l.max
+}
+
+// acquire waits for a free slot
+func (l *runLimiter) acquire() {
+	l.acquireFor("")
+}
+
+// acquireFor waits for a free slot for a run of a task owned by owner.
+// owners only affect the order waiting runs get slots in fair limiters
+func (l *runLimiter) acquireFor(owner string) {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	if l.active < l.max && len(l.owners) == 0 {
+		l.active++
+		l.Unlock()
+		return
+	}
+
+	if !l.fair {
+		owner = ""
+	}
+	ready := make(chan struct{})
+	if len(l.waiting[owner]) == 0 {
+		l.owners = append(l.owners, owner)
+	}
+	l.waiting[owner] = append(l.waiting[owner], ready)
+	l.Unlock()
+
+	<-ready
+}
+
+// release frees a slot claimed with acquire, handing it to the next
+// waiting run if there is one
+func (l *runLimiter) release() {
+	if l == nil {
+		return
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	if len(l.owners) == 0 {
+		l.active--
+		return
+	}
+
+	owner := l.owners[0]
+	l.owners = l.owners[1:]
+	queue := l.waiting[owner]
+	next := queue[0]
+	if len(queue) > 1 {
+		l.waiting[owner] = queue[1:]
+		// owners with more waiting runs go to the back of the line
+		l.owners = append(l.owners, owner)
+	} else {
+		delete(l.waiting, owner)
+	}
+	close(next)
+}
+
+// writeQueueFull responds 429 Too Many Requests, telling the client
+// when to try again
+func writeQueueFull(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(queueFullRetryAfter/time.Second)))
+	apiutil.WriteErrResponse(w, http.StatusTooManyRequests, errQueueFull)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+)
+
+func TestRunLimiter(t *testing.T) {
+	var unlimited *runLimiter
+	unlimited.acquire()
+	if unlimited.rejecting() {
+		t.Errorf("expected nil limiter to never reject")
+	}
+	unlimited.release()
+
+	if l := newRunLimiter(0, QueueFullReject); l != nil {
+		t.Errorf("expected limiter with no max to be nil")
+	}
+
+	l := newRunLimiter(2, QueueFullReject)
+	l.acquire()
+	if l.rejecting() {
+		t.Errorf("expected limiter with a free slot not to reject")
+	}
+	l.acquire()
+	if !l.rejecting() {
+		t.Errorf("expected full limiter to reject")
+	}
+	l.release()
+	if l.rejecting() {
+		t.Errorf("expected limiter not to reject once a slot is released")
+	}
+
+	l = newRunLimiter(1, QueueFullBlock)
+	l.acquire()
+	if l.rejecting() {
+		t.Errorf("expected blocking limiter never to reject")
+	}
+}
+
+func TestRunLimiterFair(t *testing.T) {
+	for _, c := range []struct {
+		behavior string
+		expect   string
+	}{
+		// owner a submits three tasks before owner b submits two
+		{QueueFullBlock, "aaabb"},
+		{QueueFullFair, "ababa"},
+	} {
+		l := newRunLimiter(1, c.behavior)
+		l.acquire()
+
+		started := make(chan string)
+		for i, owner := range []string{"a", "a", "a", "b", "b"} {
+			go func(owner string) {
+				l.acquireFor(owner)
+				started <- owner
+			}(owner)
+			// wait for the run to queue so arrival order is deterministic
+			for waiting(l) < i+1 {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		order := ""
+		for i := 0; i < 5; i++ {
+			l.release()
+			order += <-started
+		}
+		if order != c.expect {
+			t.Errorf("%s: run order mismatch. expected: %s, got: %s", c.behavior, c.expect, order)
+		}
+	}
+}
+
+// waiting counts l's waiting runs
+func waiting(l *runLimiter) int {
+	l.Lock()
+	defer l.Unlock()
+	n := 0
+	for _, q := range l.waiting {
+		n += len(q)
+	}
+	return n
+}
+
+func TestEnqueueTaskQueueFull(t *testing.T) {
+	prev := currentConfig()
+	c := *prev
+	c.AmqpUrl = ""
+	setConfig(&c)
+	defer setConfig(prev)
+
+	prevRuns := localRuns
+	defer func() { localRuns = prevRuns }()
+	localRuns = newRunLimiter(1, QueueFullReject)
+	localRuns.acquire()
+	defer localRuns.release()
+
+	req := httptest.NewRequest("POST", "/tasks", strings.NewReader(`{"type":"ipfs.addurl","params":{"url":"http://example.com"}}`))
+	req.Header.Set("Content-Type", "application/json")
+	rr := httptest.NewRecorder()
+	TasksHandler(rr, req)
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected full queue to respond %d, got: %d. body: %s", http.StatusTooManyRequests, rr.Code, rr.Body.String())
+	}
+	if rr.Header().Get("Retry-After") != "10" {
+		t.Errorf("expected Retry-After header of 10 seconds, got: '%s'", rr.Header().Get("Retry-After"))
+	}
+}
+
+func TestPerformTaskReleasesSlot(t *testing.T) {
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	prevRuns := localRuns
+	defer func() { localRuns = prevRuns }()
+	localRuns = newRunLimiter(1, QueueFullReject)
+
+	task := &tasks.Task{Type: "test"}
+	done := make(chan struct{})
+	go func() {
+		performTask(datastore.NewMapDatastore(), task)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("expected performTask to return once the task finished")
+	}
+	if task.Succeeded == nil {
+		t.Errorf("expected task to succeed")
+	}
+	if localRuns.rejecting() {
+		t.Errorf("expected a finished run to release it's slot")
+	}
+}
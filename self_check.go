@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// dependencyCheck confirms an external service this server relies on is
+// reachable. hard dependencies are ones the server can't work without
+type dependencyCheck struct {
+	name  string
+	hard  bool
+	check func(ctx context.Context) error
+}
+
+// dependencyResult is the outcome of running a dependencyCheck
+type dependencyResult struct {
+	dependencyCheck
+	err      error
+	duration time.Duration
+}
+
+// selfCheck confirms the external services cfg configures are reachable,
+// logging a report. It returns an error naming any hard dependencies that are
+// down. A zero SelfCheckTimeoutSeconds skips the check
+func selfCheck(cfg *config) error {
+	if cfg.SelfCheckTimeoutSeconds <= 0 {
+		return nil
+	}
+	return runSelfChecks(dependencyChecks(cfg), time.Duration(cfg.SelfCheckTimeoutSeconds)*time.Second)
+}
+
+// dependencyChecks lists checks for the services cfg configures. postgres &
+// the amqp queue are hard dependencies, everything else degrades gracefully
+func dependencyChecks(cfg *config) []dependencyCheck {
+	checks := []dependencyCheck{}
+	if cfg.PostgresDbUrl != "" {
+		checks = append(checks, dependencyCheck{"postgres", true, postgresCheck(postgresConnString(cfg.PostgresDbUrl))})
+	}
+	if cfg.PostgresReadReplicaUrl != "" {
+		checks = append(checks, dependencyCheck{"postgres read replica", false, postgresCheck(postgresConnString(cfg.PostgresReadReplicaUrl))})
+	}
+	if cfg.AmqpUrl != "" {
+		checks = append(checks, dependencyCheck{"amqp", true, tcpCheck(urlHost(cfg.AmqpUrl, "5672"))})
+	}
+	if cfg.RedisUrl != "" {
+		checks = append(checks, dependencyCheck{"redis", false, tcpCheck(cfg.RedisUrl)})
+	}
+	if cfg.IpfsApiUrl != "" {
+		checks = append(checks, dependencyCheck{"ipfs api", false, httpCheck(cfg.IpfsApiUrl)})
+	}
+	return checks
+}
+
+// runSelfChecks runs checks concurrently, giving each timeout to complete
+func runSelfChecks(checks []dependencyCheck, timeout time.Duration) error {
+	results := make([]dependencyResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i, c := range checks {
+		wg.Add(1)
+		go func(i int, c dependencyCheck) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), timeout)
+			defer cancel()
+			start := time.Now()
+			err := c.check(ctx)
+			results[i] = dependencyResult{c, err, time.Since(start)}
+		}(i, c)
+	}
+	wg.Wait()
+
+	down := []string{}
+	for _, r := range results {
+		if r.err == nil {
+			log.Infof("self check: %s is reachable (%s)", r.name, r.duration)
+			continue
+		}
+		if r.hard {
+			down = append(down, r.name)
+			log.Errorf("self check: %s is unreachable: %s", r.name, r.err)
+		} else {
+			log.Warnf("self check: %s is unreachable: %s", r.name, r.err)
+		}
+	}
+
+	if len(down) > 0 {
+		return fmt.Errorf("required dependencies are unreachable: %s", strings.Join(down, ", "))
+	}
+	return nil
+}
+
+// postgresCheck pings the database at connString
+func postgresCheck(connString string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		db, err := sql.Open("postgres", connString)
+		if err != nil {
+			return err
+		}
+		defer db.Close()
+		return db.PingContext(ctx)
+	}
+}
+
+// tcpCheck opens & closes a tcp connection to addr
+func tcpCheck(addr string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// httpCheck requests rawurl, any response counts as reachable. it bypasses
+// the retrying default client so a down service fails fast
+func httpCheck(rawurl string) func(ctx context.Context) error {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequest("GET", rawurl, nil)
+		if err != nil {
+			return err
+		}
+		res, err := (&http.Client{}).Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		return res.Body.Close()
+	}
+}
+
+// urlHost returns the host:port of rawurl, using defaultPort if it has none
+func urlHost(rawurl, defaultPort string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil || u.Host == "" {
+		return rawurl
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Hostname(), defaultPort)
+	}
+	return u.Host
+}
@@ -3,27 +3,38 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"expvar"
+	"flag"
 	"fmt"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
 	"github.com/datatogether/task_mgmt/source"
 	"github.com/datatogether/task_mgmt/tasks"
 	"github.com/sirupsen/logrus"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
 var (
-	// cfg is the global configuration for the server. It's read in at startup from
-	// the config.json file and enviornment variables, see config.go for more info.
-	cfg *config
 	// log output
 	log = logrus.New()
 	// application database connection
 	appDB = &sql.DB{}
 	// hoist default store
 	store = sql_datastore.DefaultStore
+	// set to 1 once initPostgres has connected & migrated the app db,
+	// read & write with the sync/atomic package
+	dbReady int32
+
+	// runTaskId is set with the -run-task flag
+	runTaskId = flag.String("run-task", "", "run the task with this id, print the result & exit without starting the server")
 )
 
 func init() {
@@ -35,19 +46,52 @@ func init() {
 }
 
 func main() {
-	var err error
-	cfg, err = initConfig(os.Getenv("GOLANG_ENV"))
+	flag.Parse()
+
+	cfg, err := initConfig(os.Getenv("GOLANG_ENV"))
 	if err != nil {
 		// panic if the server is missing a vital configuration detail
 		panic(fmt.Errorf("server configuration error: %s", err.Error()))
 	}
+	setConfig(cfg)
 	configureTasks()
 
+	// retry transient failures for all outbound requests, identifying ourselves
+	// with cfg.UserAgent
+	http.DefaultClient.Transport = newUserAgentTransport(newRetryTransport(http.DefaultClient.Transport, cfg.HttpMaxRetries), cfg.UserAgent)
+
+	if *runTaskId != "" {
+		initPostgres()
+		if err := runTaskOnce(store, *runTaskId, os.Stdout); err != nil {
+			log.Errorln(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := selfCheck(cfg); err != nil {
+		if cfg.SelfCheckRequired && os.Getenv("GOLANG_ENV") == PRODUCTION_MODE {
+			panic(fmt.Errorf("self check failed: %s", err.Error()))
+		}
+		log.Errorln(err.Error())
+	}
+
+	localRuns = newRunLimiter(cfg.MaxActiveRuns, cfg.QueueFullBehavior)
+
+	// queue outgoing email to avoid hitting postmark rate limits
+	emails := newEmailQueue(mailer, cfg.EmailConcurrency, cfg.EmailRateLimit, realClock{})
+	mailer = emails
+
 	go initPostgres()
 	go listenRpc()
 	go connectRedis()
 
-	stop, err := acceptTasks()
+	queue, err := acceptTasks()
+	if err != nil {
+		panic(err.Error())
+	}
+
+	requests, err := consumeTaskRequests()
 	if err != nil {
 		panic(err.Error())
 	}
@@ -60,16 +104,45 @@ func main() {
 	// printConfigInfo()
 
 	// fire it up!
-	log.Infoln("starting server on port", cfg.Port)
+	log.Infoln("starting server on", net.JoinHostPort(cfg.ListenAddr, cfg.Port))
+
+	// shut down gracefully on interrupt, finishing in-flight requests
+	// & tasks until the shutdown timeout
+	shutdown := make(chan struct{})
+	go func() {
+		sigs := make(chan os.Signal, 1)
+		signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+		<-sigs
+		log.Infoln("shutting down")
 
-	// start server wrapped in a log.Fatal b/c http.ListenAndServe will not
-	// return unless there's an error
-	log.Fatal(StartServer(cfg, s))
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeoutSeconds)*time.Second)
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Infoln("error shutting down server:", err)
+		}
+		if requests != nil {
+			if err := requests.Shutdown(ctx); err != nil {
+				log.Infoln("error shutting down task request consumer:", err)
+			}
+		}
+		if queue != nil {
+			if err := queue.Shutdown(ctx); err != nil {
+				log.Infoln("error shutting down task queue:", err)
+			}
+		}
+		// tasks & requests can queue notifications, send them last
+		if err := emails.Shutdown(ctx); err != nil {
+			log.Infoln("error sending queued email:", err)
+		}
+		close(shutdown)
+	}()
 
-	// lol will never happen, left here as a reminder
-	// that we should be able to stop accepting new tasks
-	// at any point without issue
-	stop <- true
+	// http.ListenAndServe will not return unless there's an error,
+	// or the server is shutting down
+	if err := StartServer(cfg, s); err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdown
 }
 
 // NewServerRoutes returns a Muxer that has all API routes.
@@ -79,39 +152,107 @@ func NewServerRoutes() *http.ServeMux {
 	m.HandleFunc("/.well-known/acme-challenge/", CertbotHandler)
 	m.Handle("/", middleware(NotFoundHandler))
 	m.Handle("/healthcheck", middleware(HealthCheckHandler))
+	m.Handle("/healthz", middleware(HealthCheckHandler))
+	m.Handle("/ready", middleware(ReadyHandler))
+	m.Handle("/metrics", expvar.Handler())
+	m.Handle("/openapi.json", middleware(OpenApiHandler))
 
 	m.Handle("/tasks", middleware(TasksHandler))
 	m.Handle("/tasks/", middleware(TaskHandler))
-	// TODO - restore this:
-	// m.Handle("/tasks/cancel/", middleware(CancelTaskHandler))
+	m.Handle("/tasks/stats", middleware(TaskStatsHandler))
+	m.Handle("/workers/", middleware(WorkerHandler))
+	m.Handle("/admin/tasks/bulk-status", middleware(BulkTaskStatusHandler))
 
 	// Example of individual task routing:
 	m.HandleFunc("/ipfs/add", middleware(EnqueueIpfsAddHandler))
 
-	m.Handle("/js/", http.StripPrefix("/js/", http.FileServer(http.Dir("public/js"))))
-	m.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("public/css"))))
+	m.Handle("/js/", http.StripPrefix("/js/", StaticHandler("public/js")))
+	m.Handle("/css/", http.StripPrefix("/css/", StaticHandler("public/css")))
+	m.HandleFunc("/favicon.ico", FaviconHandler)
 
 	return m
 }
 
 func initPostgres() {
+	cfg := currentConfig()
 	log.Infoln("connecting to postgres db")
-	if err := sqlutil.ConnectToDb("postgres", cfg.PostgresDbUrl, appDB); err != nil {
+	if err := sqlutil.ConnectToDb("postgres", postgresConnString(cfg.PostgresDbUrl), appDB); err != nil {
 		panic(err)
 	}
 	log.Infoln("connected to postgres db")
 	created, err := sqlutil.EnsureTables(appDB, packagePath("sql/schema.sql"),
-		"tasks")
+		"tasks", "tasks_archive", "task_logs", "task_artifacts", "task_cancel_requests", "task_notes", "task_audit", "worker_heartbeats",
+		"task_logs_archive", "task_artifacts_archive", "task_notes_archive")
 	if err != nil {
 		log.Infoln(err)
 	}
 	if len(created) > 0 {
 		log.Infoln("created tables:", created)
 	}
+	if err := tasks.EnsureUniqueTitleIndex(appDB); err != nil {
+		log.Infoln("error setting unique title index:", err)
+	}
+	if err := tasks.MigrateWorkerId(appDB); err != nil {
+		log.Infoln("error migrating tasks worker id:", err)
+	}
+	if err := tasks.MigrateNotifyEmails(appDB); err != nil {
+		log.Infoln("error migrating tasks notify emails:", err)
+	}
+	if err := tasks.MigrateDefinitionHash(appDB); err != nil {
+		log.Infoln("error migrating tasks definition hash:", err)
+	}
+	if err := tasks.EnsureIndexes(appDB); err != nil {
+		log.Infoln("error creating task indexes:", err)
+	}
+	if err := source.MigrateChecksums(appDB); err != nil {
+		log.Infoln("error migrating source checksums:", err)
+	}
+	if err := source.MigrateDrifted(appDB); err != nil {
+		log.Infoln("error migrating sources drifted:", err)
+	}
 
-	sql_datastore.SetDB(appDB)
+	// store gets it's own connection pool, which logs & measures queries
+	storeDB, err := openLoggedDB(postgresConnString(cfg.PostgresDbUrl))
+	if err != nil {
+		panic(err)
+	}
+	sql_datastore.SetDB(storeDB)
 	store.Register(
 		&tasks.Task{},
 		&source.Source{},
 	)
+
+	if timeout := time.Duration(cfg.WorkerHeartbeatTimeoutSeconds) * time.Second; timeout > 0 {
+		go sweepWorkers(timeout/2, timeout)
+	}
+
+	if days := cfg.TaskArchiveAfterDays; days > 0 {
+		go archiveTasks(time.Hour, time.Duration(days)*24*time.Hour)
+	}
+
+	if mins := cfg.SourceDriftCheckMinutes; mins > 0 {
+		go checkSourceDrift(time.Duration(mins)*time.Minute, cfg.SourceDriftSampleSize)
+	}
+
+	atomic.StoreInt32(&dbReady, 1)
+
+	if cfg.PostgresReadReplicaUrl != "" {
+		log.Infoln("connecting to postgres read replica")
+		replica := &sql.DB{}
+		if err := sqlutil.ConnectToDb("postgres", postgresConnString(cfg.PostgresReadReplicaUrl), replica); err != nil {
+			panic(err)
+		}
+		log.Infoln("connected to postgres read replica")
+
+		replicaStoreDB, err := openLoggedDB(postgresConnString(cfg.PostgresReadReplicaUrl))
+		if err != nil {
+			panic(err)
+		}
+		rs := sql_datastore.NewDatastore(replicaStoreDB)
+		rs.Register(
+			&tasks.Task{},
+			&source.Source{},
+		)
+		setReplica(&readReplica{db: replica, store: rs})
+	}
 }
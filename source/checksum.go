@@ -0,0 +1,102 @@
+package source
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// DefaultChecksumAlgorithm is assumed for checksums that have no algorithm prefix
+const DefaultChecksumAlgorithm = "sha256"
+
+// checksumAlgorithms maps supported algorithm names to their hash constructors
+var checksumAlgorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Checksum is a hex-encoded digest & the algorithm used to produce it.
+// Checksums are stored as strings in the form [algorithm]:[digest],
+// eg: sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+type Checksum struct {
+	Algorithm string
+	Digest    string
+}
+
+// ParseChecksum reads a checksum string, validating the algorithm & digest.
+// strings without a prefix are assumed to use DefaultChecksumAlgorithm
+func ParseChecksum(s string) (Checksum, error) {
+	c := Checksum{Algorithm: DefaultChecksumAlgorithm, Digest: s}
+	if i := strings.Index(s, ":"); i >= 0 {
+		c = Checksum{Algorithm: strings.ToLower(s[:i]), Digest: s[i+1:]}
+	}
+	c.Digest = strings.ToLower(c.Digest)
+
+	newHash, ok := checksumAlgorithms[c.Algorithm]
+	if !ok {
+		return c, fmt.Errorf("unsupported checksum algorithm: '%s'", c.Algorithm)
+	}
+	digest, err := hex.DecodeString(c.Digest)
+	if err != nil {
+		return c, fmt.Errorf("invalid %s checksum digest: %s", c.Algorithm, err.Error())
+	}
+	if len(digest) != newHash().Size() {
+		return c, fmt.Errorf("invalid %s checksum digest length: %d", c.Algorithm, len(digest))
+	}
+
+	return c, nil
+}
+
+// ChecksumsEqual reports whether checksum strings a & b are the same
+// checksum, ignoring case & a missing default algorithm prefix. checksums
+// that can't be parsed are never equal
+func ChecksumsEqual(a, b string) bool {
+	ca, err := ParseChecksum(a)
+	if err != nil {
+		return false
+	}
+	cb, err := ParseChecksum(b)
+	if err != nil {
+		return false
+	}
+	return ca == cb
+}
+
+// NewChecksum calculates the checksum of r's contents using algorithm
+func NewChecksum(algorithm string, r io.Reader) (Checksum, error) {
+	newHash, ok := checksumAlgorithms[algorithm]
+	if !ok {
+		return Checksum{}, fmt.Errorf("unsupported checksum algorithm: '%s'", algorithm)
+	}
+
+	h := newHash()
+	if _, err := io.Copy(h, r); err != nil {
+		return Checksum{}, err
+	}
+	return Checksum{Algorithm: algorithm, Digest: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// String formats the checksum with it's algorithm prefix
+func (c Checksum) String() string {
+	return fmt.Sprintf("%s:%s", c.Algorithm, c.Digest)
+}
+
+// Verify checks that r's contents match the checksum
+func (c Checksum) Verify(r io.Reader) error {
+	got, err := NewChecksum(c.Algorithm, r)
+	if err != nil {
+		return err
+	}
+	if got.Digest != c.Digest {
+		return fmt.Errorf("checksum mismatch. expected: %s, got: %s", c, got)
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package source
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChecksum(t *testing.T) {
+	cases := []struct {
+		in, alg string
+		err     bool
+	}{
+		{"md5:acbd18db4cc2f85cedef654fccc4a4d8", "md5", false},
+		{"sha1:0beec7b5ea3f0fdbc95d0dd47f3c5bc275da8a33", "sha1", false},
+		{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", "sha256", false},
+		{"SHA256:2C26B46B68FFC68FF99B453C1D30413413422D706483BFA0F98A5E886266E7AE", "sha256", false},
+		{"sha512:f7fbba6e0636f890e56fbbf3283e524c6fa3204ae298382d624741d0dc6638326e282c41be5e4254d8820772c5518a2c5a8c0c7f7eda19594a7eb539453e1ed7", "sha512", false},
+		{"2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", "sha256", false},
+		{"crc32:8c736521", "", true},
+		{"md5:not_hex", "", true},
+		{"sha256:acbd18db4cc2f85cedef654fccc4a4d8", "", true},
+	}
+
+	for i, c := range cases {
+		got, err := ParseChecksum(c.in)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+		if got.Algorithm != c.alg {
+			t.Errorf("case %d algorithm mismatch. expected: %s, got: %s", i, c.alg, got.Algorithm)
+		}
+		if err := got.Verify(strings.NewReader("foo")); err != nil {
+			t.Errorf("case %d verify error: %s", i, err.Error())
+		}
+		if err := got.Verify(strings.NewReader("bar")); err == nil {
+			t.Errorf("case %d expected verifying different content to fail", i)
+		}
+	}
+}
+
+func TestChecksumsEqual(t *testing.T) {
+	cases := []struct {
+		a, b  string
+		equal bool
+	}{
+		{"md5:acbd18db4cc2f85cedef654fccc4a4d8", "md5:ACBD18DB4CC2F85CEDEF654FCCC4A4D8", true},
+		{"sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", "2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae", true},
+		{"md5:acbd18db4cc2f85cedef654fccc4a4d8", "acbd18db4cc2f85cedef654fccc4a4d8", false},
+		{"md5:acbd18db4cc2f85cedef654fccc4a4d8", "md5:37b51d194a7513e45b56f6524f2d51f2", false},
+		{"md5:acbd18db4cc2f85cedef654fccc4a4d8", "", false},
+	}
+	for i, c := range cases {
+		if got := ChecksumsEqual(c.a, c.b); got != c.equal {
+			t.Errorf("case %d: expected %s & %s equal: %t, got: %t", i, c.a, c.b, c.equal, got)
+		}
+	}
+}
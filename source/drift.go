@@ -0,0 +1,66 @@
+package source
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/datatogether/sqlutil"
+)
+
+// FetchFunc fetches the content at url. callers close the returned reader
+type FetchFunc func(url string) (io.ReadCloser, error)
+
+// CheckDrift fetches the source & compares it's content to the recorded
+// Checksum, setting Drifted to the time of the check if they differ & to nil
+// if they match. It returns true if Drifted changed, meaning the source needs
+// saving. Sources without a checksum are left unchanged
+func (s *Source) CheckDrift(fetch FetchFunc) (changed bool, err error) {
+	if s.Checksum == "" {
+		return false, nil
+	}
+	c, err := ParseChecksum(s.Checksum)
+	if err != nil {
+		return false, err
+	}
+
+	body, err := fetch(s.Url)
+	if err != nil {
+		return false, fmt.Errorf("error fetching source %s: %s", s.Url, err.Error())
+	}
+	defer body.Close()
+
+	got, err := NewChecksum(c.Algorithm, body)
+	if err != nil {
+		return false, fmt.Errorf("error reading source %s: %s", s.Url, err.Error())
+	}
+
+	if got.Digest == c.Digest {
+		changed = s.Drifted != nil
+		s.Drifted = nil
+		return changed, nil
+	}
+
+	changed = s.Drifted == nil
+	if changed {
+		now := time.Now().In(time.UTC).Round(time.Millisecond)
+		s.Drifted = &now
+	}
+	return changed, nil
+}
+
+// SampleChecksummedSources reads a random selection of up to n sources that
+// have a checksum
+func SampleChecksummedSources(db sqlutil.Queryable, n int) ([]*Source, error) {
+	rows, err := db.Query(qSourcesSampleChecksummed, n)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalSources(rows, n)
+}
+
+// MigrateDrifted adds the drifted column to sources tables created before it existed
+func MigrateDrifted(db sqlutil.Execable) error {
+	_, err := db.Exec(qSourceMigrateDrifted)
+	return err
+}
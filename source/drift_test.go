@@ -0,0 +1,68 @@
+package source
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func TestSourceCheckDrift(t *testing.T) {
+	content := "original content"
+	digest := sha256.Sum256([]byte(content))
+	fetched := 0
+	fetch := func(url string) (io.ReadCloser, error) {
+		fetched++
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+
+	s := &Source{Url: "http://example.com/data.zim", Checksum: "sha256:" + hex.EncodeToString(digest[:])}
+
+	cases := []struct {
+		content string
+		changed bool
+		drifted bool
+	}{
+		{"original content", false, false},
+		{"changed content", true, true},
+		// already flagged, still drifted
+		{"changed again", false, true},
+		{"original content", true, false},
+	}
+
+	for i, c := range cases {
+		content = c.content
+		changed, err := s.CheckDrift(fetch)
+		if err != nil {
+			t.Errorf("case %d unexpected error: %s", i, err.Error())
+			continue
+		}
+		if changed != c.changed {
+			t.Errorf("case %d changed mismatch. expected: %t, got: %t", i, c.changed, changed)
+		}
+		if drifted := s.Drifted != nil; drifted != c.drifted {
+			t.Errorf("case %d drifted mismatch. expected: %t, got: %t", i, c.drifted, drifted)
+		}
+	}
+	if fetched != len(cases) {
+		t.Errorf("expected source to be fetched %d times, got: %d", len(cases), fetched)
+	}
+
+	failing := func(url string) (io.ReadCloser, error) {
+		return nil, fmt.Errorf("connection refused")
+	}
+	if _, err := s.CheckDrift(failing); err == nil {
+		t.Errorf("expected fetch error to be returned")
+	}
+	if s.Drifted != nil {
+		t.Errorf("expected failed fetch not to flag drift")
+	}
+
+	unchecked := &Source{Url: "http://example.com"}
+	if changed, err := unchecked.CheckDrift(failing); changed || err != nil {
+		t.Errorf("expected source without a checksum to be skipped. changed: %t, err: %v", changed, err)
+	}
+}
@@ -8,19 +8,20 @@ CREATE TABLE sources (
   title            text NOT NULL DEFAULT '',
   url              text NOT NULL,
   checksum         text NOT NULL DEFAULT '', 
-  meta             json
+  meta             json,
+  drifted          timestamp
 );`
 
 const qSourcesList = `
 SELECT
-  id, created, updated, title, url, checksum, meta
+  id, created, updated, title, url, checksum, meta, drifted
 FROM sources
-ORDER BY created DESC
+ORDER BY created DESC, id DESC
 LIMIT $1 OFFSET $2;`
 
 const qSourceReadById = `
 SELECT 
-  id, created, updated, title, url, checksum, meta
+  id, created, updated, title, url, checksum, meta, drifted
 FROM sources
 WHERE 
   id = $1;`
@@ -29,13 +30,31 @@ const qSourceExists = `SELECT exists(SELECT 1 FROM sources WHERE id = $1);`
 
 const qSourceInsert = `
 INSERT INTO sources
-  (id, created, updated, title, url, checksum, meta)
+  (id, created, updated, title, url, checksum, meta, drifted)
 VALUES
-  ($1, $2, $3, $4, $5, $6, $7);`
+  ($1, $2, $3, $4, $5, $6, $7, $8);`
 
 const qSourceUpdate = `
 UPDATE sources SET
-  created = $2, updated = $3, title = $4, url = $5, checksum = $6, meta = $7
+  created = $2, updated = $3, title = $4, url = $5, checksum = $6, meta = $7, drifted = $8
 WHERE id = $1;`
 
+const qSourceMigrateChecksums = `
+UPDATE sources SET
+  checksum = (CASE WHEN length(checksum) = 32 THEN 'md5:' ELSE 'sha256:' END) || checksum
+WHERE checksum <> '' AND position(':' in checksum) = 0;`
+
+// adds the drifted column to sources tables created before it existed
+const qSourceMigrateDrifted = `
+ALTER TABLE sources ADD COLUMN IF NOT EXISTS drifted timestamp;`
+
+// a random sample of $1 sources that have a checksum to check for drift
+const qSourcesSampleChecksummed = `
+SELECT
+  id, created, updated, title, url, checksum, meta, drifted
+FROM sources
+WHERE checksum <> ''
+ORDER BY random()
+LIMIT $1;`
+
 const qSourceDelete = `DELETE FROM sources WHERE id = $1;`
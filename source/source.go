@@ -29,10 +29,13 @@ type Source struct {
 	Title string `json:"title"`
 	// Url to source data
 	Url string `json:"url"`
-	// Checksum of url
+	// Checksum of url, prefixed with the hash algorithm. see ParseChecksum
 	Checksum string `json:"checksum"`
 	// any associated metadata
 	Meta map[string]interface{} `json:"meta"`
+	// time a drift check found the content at Url no longer matches
+	// Checksum, nil if it matched when last checked
+	Drifted *time.Time `json:"drifted,omitempty"`
 }
 
 func (s Source) DatastoreType() string {
@@ -67,6 +70,14 @@ func (s *Source) Read(store datastore.Datastore) error {
 func (s *Source) Save(store datastore.Datastore) (err error) {
 	var exists bool
 
+	if s.Checksum != "" {
+		c, err := ParseChecksum(s.Checksum)
+		if err != nil {
+			return err
+		}
+		s.Checksum = c.String()
+	}
+
 	if s.Id != "" {
 		exists, err = store.Has(s.Key())
 		if err != nil {
@@ -121,9 +132,10 @@ func (s *Source) UnmarshalSQL(row sqlutil.Scannable) error {
 		id, url, checksum, title string
 		created, updated         time.Time
 		meta                     []byte
+		drifted                  *time.Time
 	)
 
-	if err := row.Scan(&id, &created, &updated, &title, &url, &checksum, &meta); err != nil {
+	if err := row.Scan(&id, &created, &updated, &title, &url, &checksum, &meta, &drifted); err != nil {
 		if err == sql.ErrNoRows {
 			return datastore.ErrNotFound
 		}
@@ -137,6 +149,7 @@ func (s *Source) UnmarshalSQL(row sqlutil.Scannable) error {
 		Title:    title,
 		Url:      url,
 		Checksum: checksum,
+		Drifted:  drifted,
 	}
 
 	if meta != nil {
@@ -174,6 +187,7 @@ func (s *Source) SQLParams(cmd sql_datastore.Cmd) []interface{} {
 			s.Url,
 			s.Checksum,
 			meta,
+			s.Drifted,
 		}
 	}
 }
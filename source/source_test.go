@@ -38,6 +38,31 @@ func TestSourceStorage(t *testing.T) {
 	}
 }
 
+func TestSourceMd5Checksum(t *testing.T) {
+	store := datastore.NewMapDatastore()
+
+	// kiwix publishes bare md5 digests, which must be saved with a prefix
+	s := &Source{Title: "zim", Url: "https://download.kiwix.org/a.zim", Checksum: "acbd18db4cc2f85cedef654fccc4a4d8"}
+	if err := s.Save(store); err == nil {
+		t.Errorf("expected an unprefixed md5 digest to be rejected as a sha256 checksum")
+	}
+
+	s.Checksum = "md5:ACBD18DB4CC2F85CEDEF654FCCC4A4D8"
+	if err := s.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	s2 := &Source{Id: s.Id}
+	if err := s2.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s2.Checksum != "md5:acbd18db4cc2f85cedef654fccc4a4d8" {
+		t.Errorf("expected md5 checksum to be stored normalized, got: %s", s2.Checksum)
+	}
+	if !ChecksumsEqual("md5:"+"acbd18db4cc2f85cedef654fccc4a4d8", s2.Checksum) {
+		t.Errorf("expected a re-fetched md5 digest to match the stored checksum")
+	}
+}
+
 func CompareSources(a, b *Source) error {
 	if a.Id != b.Id {
 		return fmt.Errorf("Id mismatch: %s != %s", a.Id, b.Id)
@@ -3,6 +3,7 @@ package source
 import (
 	"database/sql"
 	"fmt"
+	"github.com/datatogether/sqlutil"
 	"github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/query"
 )
@@ -39,6 +40,14 @@ func ListSources(store datastore.Datastore, orderby string, limit, offset int) (
 	return sources[:i], nil
 }
 
+// MigrateChecksums adds algorithm prefixes to any checksums stored without one.
+// bare checksums are assumed to be DefaultChecksumAlgorithm, except for
+// 32-character digests, which can only be md5
+func MigrateChecksums(db sqlutil.Execable) error {
+	_, err := db.Exec(qSourceMigrateChecksums)
+	return err
+}
+
 func unmarshalSources(rows *sql.Rows, limit int) ([]*Source, error) {
 	defer rows.Close()
 	sources := make([]*Source, limit)
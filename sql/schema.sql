@@ -1,5 +1,5 @@
 -- name: drop-all
-DROP TABLE IF EXISTS tasks, sources, repos, repo_sources;
+DROP TABLE IF EXISTS task_logs, task_artifacts, task_cancel_requests, task_notes, task_audit, tasks, task_logs_archive, task_artifacts_archive, task_notes_archive, tasks_archive, sources, repos, repo_sources, worker_heartbeats;
 
 -- name: create-tasks
 CREATE TABLE tasks (
@@ -15,7 +15,31 @@ CREATE TABLE tasks (
   enqueued         timestamp,
   started          timestamp,
   succeeded        timestamp,
-  failed           timestamp
+  failed           timestamp,
+  worker_id        text NOT NULL DEFAULT '',
+  notify_emails    text[],
+  definition_hash  text NOT NULL DEFAULT ''
+);
+
+-- name: create-tasks_archive
+CREATE TABLE tasks_archive (
+  id               UUID NOT NULL PRIMARY KEY,
+  created          timestamp NOT NULL,
+  updated          timestamp NOT NULL,
+  title            text NOT NULL DEFAULT '',
+  user_id          text NOT NULL DEFAULT '',
+  type             text NOT NULL DEFAULT '',
+  params           json,
+  status           text NOT NULL DEFAULT '',
+  error            text NOT NULL DEFAULT '',
+  enqueued         timestamp,
+  started          timestamp,
+  succeeded        timestamp,
+  failed           timestamp,
+  worker_id        text NOT NULL DEFAULT '',
+  notify_emails    text[],
+  definition_hash  text NOT NULL DEFAULT '',
+  archived         timestamp NOT NULL DEFAULT (now() at time zone 'utc')
 );
 
 -- name: create-sources
@@ -26,7 +50,8 @@ CREATE TABLE sources (
   title            text NOT NULL DEFAULT '',
   url              text NOT NULL,
   checksum         text NOT NULL DEFAULT '', 
-  meta             json
+  meta             json,
+  drifted          timestamp
 );
 
 -- name: create-repos
@@ -43,4 +68,87 @@ CREATE TABLE repos (
 CREATE TABLE repo_sources (
   repo_id          UUID NOT NULL references repos(id) ON DELETE CASCADE,
   source_id        UUID NOT NULL references sources(id) ON DELETE CASCADE
-);
\ No newline at end of file
+);
+
+-- name: create-task_logs
+CREATE TABLE task_logs (
+  id               bigserial PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  line             text NOT NULL DEFAULT ''
+);
+
+-- name: create-task_artifacts
+CREATE TABLE task_artifacts (
+  id               bigserial PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks(id) ON DELETE CASCADE,
+  name             text NOT NULL,
+  url              text NOT NULL DEFAULT '',
+  hash             text NOT NULL DEFAULT '',
+  size             bigint NOT NULL DEFAULT 0,
+  UNIQUE (task_id, name)
+);
+
+-- name: create-task_cancel_requests
+CREATE TABLE task_cancel_requests (
+  task_id          UUID NOT NULL PRIMARY KEY references tasks(id) ON DELETE CASCADE,
+  requested        timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+-- name: create-task_notes
+CREATE TABLE task_notes (
+  id               bigserial PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  author           text NOT NULL DEFAULT '',
+  body             text NOT NULL DEFAULT ''
+);
+
+-- name: create-task_logs_archive
+-- logs, artifacts & notes are moved here with their task, keeping their ids
+CREATE TABLE task_logs_archive (
+  id               bigint NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks_archive(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  line             text NOT NULL DEFAULT ''
+);
+CREATE INDEX task_logs_archive_task_id ON task_logs_archive (task_id);
+
+-- name: create-task_artifacts_archive
+CREATE TABLE task_artifacts_archive (
+  id               bigint NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks_archive(id) ON DELETE CASCADE,
+  name             text NOT NULL,
+  url              text NOT NULL DEFAULT '',
+  hash             text NOT NULL DEFAULT '',
+  size             bigint NOT NULL DEFAULT 0,
+  UNIQUE (task_id, name)
+);
+
+-- name: create-task_notes_archive
+CREATE TABLE task_notes_archive (
+  id               bigint NOT NULL PRIMARY KEY,
+  task_id          UUID NOT NULL references tasks_archive(id) ON DELETE CASCADE,
+  created          timestamp NOT NULL,
+  author           text NOT NULL DEFAULT '',
+  body             text NOT NULL DEFAULT ''
+);
+CREATE INDEX task_notes_archive_task_id ON task_notes_archive (task_id);
+
+-- name: create-task_audit
+-- audit entries outlive their task, so task_id isn't a foreign key
+CREATE TABLE task_audit (
+  id               bigserial PRIMARY KEY,
+  task_id          UUID NOT NULL,
+  created          timestamp NOT NULL DEFAULT (now() at time zone 'utc'),
+  actor            text NOT NULL DEFAULT '',
+  from_status      text NOT NULL DEFAULT '',
+  to_status        text NOT NULL DEFAULT '',
+  reason           text NOT NULL DEFAULT ''
+);
+
+-- name: create-worker_heartbeats
+CREATE TABLE worker_heartbeats (
+  worker_id        text NOT NULL PRIMARY KEY,
+  last_seen        timestamp NOT NULL DEFAULT (now() at time zone 'utc')
+);
@@ -12,8 +12,8 @@ DELETE FROM sources;
 INSERT INTO sources
   (id, created, updated, title, url, checksum, meta)
 VALUES
-  ('bac6f89b-703e-4751-8109-b14d604df746', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'wikipedia ab full' , 'http://download.kiwix.org/zim/wikipedia_ab_all.zim', 'cefb808c89d55a1085966efc47df3d38', null),
-  ('78f9b2a4-cf20-438e-adc8-77396d831327', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'wikipedia ace full' , 'http://download.kiwix.org/zim/wikipedia_ace_all.zim', 'eb43e54729670f7116ace499aee2f692', null);
+  ('bac6f89b-703e-4751-8109-b14d604df746', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'wikipedia ab full' , 'http://download.kiwix.org/zim/wikipedia_ab_all.zim', 'md5:cefb808c89d55a1085966efc47df3d38', null),
+  ('78f9b2a4-cf20-438e-adc8-77396d831327', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'wikipedia ace full' , 'http://download.kiwix.org/zim/wikipedia_ace_all.zim', 'md5:eb43e54729670f7116ace499aee2f692', null);
 
 -- name: delete-repo_sources
 DELETE FROM repo_sources;
@@ -32,3 +32,27 @@ INSERT INTO tasks
   -- (id, created, updated, title, request, success, fail, repo_url, repo_commit, source_url, source_checksum, result_url, result_hash, message)
 VALUES
   ('57220705-4954-4a42-9e02-e6aa53b6908e', '2017-01-01 00:00:01', '2017-01-01 00:00:01', 'Add a url to IPFS', '', 'ipfs.add', null, '', '', null, null, null,null);
+
+-- name: delete-tasks_archive
+DELETE FROM tasks_archive;
+-- name: insert-tasks_archive
+INSERT INTO tasks_archive
+  (id, created, updated, title, user_id, type, params, status, error, enqueued, started, succeeded, failed, worker_id, archived)
+VALUES
+  ('8f0b7a1e-5c52-4f2e-9d1c-0c1c7a3e6b21', '2016-01-01 00:00:01', '2016-01-01 00:00:01', 'Archived task', '', 'ipfs.add', null, '', '', '2016-01-01 00:00:01', '2016-01-01 00:00:01', '2016-01-01 00:00:02', null, 'test_worker', '2017-01-01 00:00:01');
+
+-- name: delete-task_audit
+DELETE FROM task_audit;
+-- name: insert-task_audit
+INSERT INTO task_audit
+  (task_id, created, actor, from_status, to_status, reason)
+VALUES
+  ('8f0b7a1e-5c52-4f2e-9d1c-0c1c7a3e6b21', '2016-01-01 00:00:03', 'admin', 'running', 'finished', 'worker lost the result');
+
+-- name: delete-worker_heartbeats
+DELETE FROM worker_heartbeats;
+-- name: insert-worker_heartbeats
+INSERT INTO worker_heartbeats
+  (worker_id, last_seen)
+VALUES
+  ('test_worker', '2017-01-01 00:00:01');
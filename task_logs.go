@@ -0,0 +1,79 @@
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// TaskLog is a single line of output from the worker performing a task.
+// logs are append-only
+type TaskLog struct {
+	// id of the task this line belongs to
+	TaskId string `json:"taskId"`
+	// time the line was appended
+	Created time.Time `json:"created"`
+	// line of output
+	Line string `json:"line"`
+}
+
+// AppendTaskLogs adds lines to the end of a task's log
+func AppendTaskLogs(db sqlExecable, taskId string, lines []string) ([]*TaskLog, error) {
+	logs := make([]*TaskLog, len(lines))
+	now := time.Now().Round(time.Millisecond).In(time.UTC)
+	for i, line := range lines {
+		l := &TaskLog{TaskId: taskId, Created: now, Line: line}
+		if _, err := db.Exec(qTaskLogInsert, l.TaskId, l.Created, l.Line); err != nil {
+			return nil, err
+		}
+		logs[i] = l
+	}
+	return logs, nil
+}
+
+// ReadTaskLogs reads a page of a task's log lines in chronological order
+func ReadTaskLogs(db sqlQueryable, taskId string, limit, offset int) ([]*TaskLog, error) {
+	rows, err := db.Query(qTaskLogs, taskId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTaskLogs(rows, limit)
+}
+
+// TailTaskLogs reads the last limit lines of a task's log in chronological order
+func TailTaskLogs(db sqlQueryable, taskId string, limit int) ([]*TaskLog, error) {
+	rows, err := db.Query(qTaskLogsTail, taskId, limit)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshalTaskLogs(rows, limit)
+}
+
+func (l *TaskLog) UnmarshalSQL(row sqlScannable) error {
+	var (
+		taskId, line string
+		created      time.Time
+	)
+	if err := row.Scan(&taskId, &created, &line); err != nil {
+		return err
+	}
+
+	*l = TaskLog{
+		TaskId:  taskId,
+		Created: created,
+		Line:    line,
+	}
+	return nil
+}
+
+func unmarshalTaskLogs(rows *sql.Rows, limit int) ([]*TaskLog, error) {
+	defer rows.Close()
+	logs := make([]*TaskLog, 0, limit)
+	for rows.Next() {
+		l := &TaskLog{}
+		if err := l.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		logs = append(logs, l)
+	}
+	return logs, rows.Err()
+}
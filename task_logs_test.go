@@ -0,0 +1,79 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTaskLogs(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+
+	lines := []string{"a", "b", "c", "d", "e"}
+	if _, err := AppendTaskLogs(appDB, id, lines[:2]); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if _, err := AppendTaskLogs(appDB, id, lines[2:]); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	logs, err := ReadTaskLogs(appDB, id, 10, 0)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if err := compareLogLines(logs, lines); err != nil {
+		t.Error(err)
+	}
+
+	logs, err = TailTaskLogs(appDB, id, 2)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if err := compareLogLines(logs, []string{"d", "e"}); err != nil {
+		t.Errorf("tail: %s", err)
+	}
+}
+
+func TestTaskLogsHandlerRequiresWorkerSecret(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	prev := currentConfig()
+	c := *prev
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	path := "/tasks/57220705-4954-4a42-9e02-e6aa53b6908e/logs"
+	for _, token := range []string{"", "wrong", "secret"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{ "lines" : ["line"] }`))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		TaskHandler(rr, req)
+
+		expect := http.StatusUnauthorized
+		if token == "secret" {
+			expect = http.StatusOK
+		}
+		if rr.Code != expect {
+			t.Errorf("token '%s': expected status %d, got: %d", token, expect, rr.Code)
+		}
+	}
+}
+
+func compareLogLines(logs []*TaskLog, lines []string) error {
+	if len(logs) != len(lines) {
+		return fmt.Errorf("log length mismatch. expected: %d, got: %d", len(lines), len(logs))
+	}
+	for i, l := range logs {
+		if l.Line != lines[i] {
+			return fmt.Errorf("line %d mismatch. expected: %s, got: %s", i, lines[i], l.Line)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// TaskNote is a comment left on a task, eg: by an operator investigating a
+// failure. notes can't be changed once they're added
+type TaskNote struct {
+	// id of the task this note is about
+	TaskId string `json:"taskId"`
+	// who wrote the note, taken from the request's credentials
+	Author string `json:"author"`
+	// text of the note
+	Body string `json:"body"`
+	// time the note was added
+	Created time.Time `json:"created"`
+}
+
+// AddTaskNote adds a note by author to a task
+func AddTaskNote(db sqlExecable, taskId, author, body string) (*TaskNote, error) {
+	n := &TaskNote{
+		TaskId:  taskId,
+		Author:  author,
+		Body:    body,
+		Created: time.Now().Round(time.Millisecond).In(time.UTC),
+	}
+	if _, err := db.Exec(qTaskNoteInsert, n.TaskId, n.Created, n.Author, n.Body); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// ReadTaskNotes reads a page of a task's notes in chronological order
+func ReadTaskNotes(db sqlQueryable, taskId string, limit, offset int) ([]*TaskNote, error) {
+	rows, err := db.Query(qTaskNotes, taskId, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]*TaskNote, 0, limit)
+	for rows.Next() {
+		n := &TaskNote{}
+		if err := n.UnmarshalSQL(rows); err != nil {
+			return nil, err
+		}
+		notes = append(notes, n)
+	}
+	return notes, rows.Err()
+}
+
+func (n *TaskNote) UnmarshalSQL(row sqlScannable) error {
+	var (
+		taskId, author, body string
+		created              time.Time
+	)
+	if err := row.Scan(&taskId, &created, &author, &body); err != nil {
+		return err
+	}
+
+	*n = TaskNote{
+		TaskId:  taskId,
+		Author:  author,
+		Body:    body,
+		Created: created,
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTaskNotes(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+
+	bodies := []string{"looking into this", "source was down", "fixed upstream"}
+	for i, body := range bodies {
+		author := "admin"
+		if i == 1 {
+			author = "worker"
+		}
+		if _, err := AddTaskNote(appDB, id, author, body); err != nil {
+			t.Fatal(err.Error())
+		}
+	}
+
+	notes, err := ReadTaskNotes(appDB, id, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(notes) != len(bodies) {
+		t.Fatalf("expected %d notes, got: %d", len(bodies), len(notes))
+	}
+	for i, n := range notes {
+		if n.Body != bodies[i] {
+			t.Errorf("note %d: expected notes in chronological order. expected: %s, got: %s", i, bodies[i], n.Body)
+		}
+		if i > 0 && n.Created.Before(notes[i-1].Created) {
+			t.Errorf("note %d: created before the note preceding it", i)
+		}
+	}
+	if notes[1].Author != "worker" {
+		t.Errorf("expected note author 'worker', got: '%s'", notes[1].Author)
+	}
+}
+
+func TestTaskNotesHandler(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	prev := currentConfig()
+	c := *prev
+	c.AdminApiKey = "admin_key"
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	path := "/tasks/57220705-4954-4a42-9e02-e6aa53b6908e/notes"
+	cases := []struct {
+		token, body string
+		expect      int
+	}{
+		{"", `{"body":"anonymous"}`, http.StatusUnauthorized},
+		{"wrong", `{"body":"anonymous"}`, http.StatusUnauthorized},
+		{"admin_key", `{"body":""}`, http.StatusBadRequest},
+		{"admin_key", `{"body":"first"}`, http.StatusOK},
+		{"secret", `{"body":"second"}`, http.StatusOK},
+	}
+	for i, c := range cases {
+		req := httptest.NewRequest("POST", path, strings.NewReader(c.body))
+		req.Header.Set("Content-Type", "application/json")
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rr := httptest.NewRecorder()
+		TaskHandler(rr, req)
+		if rr.Code != c.expect {
+			t.Errorf("case %d: expected status %d, got: %d. body: %s", i, c.expect, rr.Code, rr.Body.String())
+		}
+	}
+
+	// notes are immutable
+	for _, method := range []string{"PUT", "PATCH", "DELETE"} {
+		rr := httptest.NewRecorder()
+		TaskHandler(rr, httptest.NewRequest(method, path, nil))
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("%s: expected status %d, got: %d", method, http.StatusNotFound, rr.Code)
+		}
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", path, nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got: %d", http.StatusOK, rr.Code)
+	}
+	res := struct {
+		Data []*TaskNote `json:"data"`
+	}{}
+	if err := json.Unmarshal(rr.Body.Bytes(), &res); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(res.Data) != 2 || res.Data[0].Body != "first" || res.Data[1].Body != "second" {
+		t.Fatalf("expected notes 'first' then 'second', got: %v", res.Data)
+	}
+	if res.Data[0].Author != "admin" || res.Data[1].Author != "worker" {
+		t.Errorf("expected authors admin & worker, got: %s & %s", res.Data[0].Author, res.Data[1].Author)
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/pborman/uuid"
+	"github.com/streadway/amqp"
+)
+
+// TaskRequest is a message asking for a task to be created, for deployments
+// that drive task creation from a queue instead of the http api
+type TaskRequest struct {
+	// IdempotencyKey identifies the request. every message with the same key
+	// creates the same task, so redelivered & duplicate messages are
+	// harmless. the amqp message id is used when empty
+	IdempotencyKey string                 `json:"idempotencyKey"`
+	Title          string                 `json:"title"`
+	Type           string                 `json:"type"`
+	UserId         string                 `json:"userId"`
+	Params         map[string]interface{} `json:"params"`
+	NotifyEmails   []string               `json:"notifyEmails"`
+}
+
+// requestTaskId derives the id of the task created for an idempotency key
+func requestTaskId(key string) string {
+	return uuid.NewSHA1(uuid.NameSpace_URL, []byte("task-mgmt:task-request:"+key)).String()
+}
+
+// TaskRequestConsumer creates tasks from TaskRequest messages delivered on an
+// amqp queue. deliveries are only acknowledged once their task is created &
+// submitted, so every request is handled at least once
+type TaskRequestConsumer struct {
+	store datastore.Datastore
+	msgs  <-chan amqp.Delivery
+	// submit starts a newly created task
+	submit func(t *tasks.Task) error
+	// closed when msgs is closed & the last delivery is handled
+	done chan struct{}
+	// close tears down the consumer's connection, may be nil
+	close func()
+}
+
+// newTaskRequestConsumer creates a TaskRequestConsumer that writes tasks to
+// store, calling submit for each new task. call run to start consuming msgs
+func newTaskRequestConsumer(store datastore.Datastore, msgs <-chan amqp.Delivery, submit func(t *tasks.Task) error) *TaskRequestConsumer {
+	return &TaskRequestConsumer{
+		store:  store,
+		msgs:   msgs,
+		submit: submit,
+		done:   make(chan struct{}),
+	}
+}
+
+// run handles deliveries until msgs is closed
+func (c *TaskRequestConsumer) run() {
+	defer close(c.done)
+	for msg := range c.msgs {
+		c.handle(msg)
+	}
+}
+
+// handle creates & submits the task for a single delivery. deliveries that
+// fail are requeued once, then dropped (or dead-lettered, if the queue is
+// configured to) so a bad message can't be retried forever
+func (c *TaskRequestConsumer) handle(msg amqp.Delivery) {
+	req := &TaskRequest{}
+	if err := json.Unmarshal(msg.Body, req); err != nil {
+		log.Errorf("invalid task request: %s", err.Error())
+		msg.Nack(false, false)
+		return
+	}
+	if req.IdempotencyKey == "" {
+		req.IdempotencyKey = msg.MessageId
+	}
+	if req.IdempotencyKey == "" {
+		log.Errorf("invalid task request: idempotencyKey is required")
+		msg.Nack(false, false)
+		return
+	}
+
+	t, err := c.createTask(req)
+	if err == nil && t == nil {
+		log.Infof("skipping duplicate task request: %s", req.IdempotencyKey)
+		msg.Ack(false)
+		return
+	}
+	if err == nil {
+		err = c.submit(t)
+	}
+	if err != nil {
+		log.Errorf("task request %s error: %s", req.IdempotencyKey, err.Error())
+		msg.Nack(false, !msg.Redelivered)
+		return
+	}
+
+	log.Infof("created task %s for task request %s", t.Id, req.IdempotencyKey)
+	msg.Ack(false)
+}
+
+// createTask saves the task for req, returning the task to submit. if the
+// task has already been created & submitted createTask returns a nil task.
+// a task that was created but never submitted is returned for submitting
+func (c *TaskRequestConsumer) createTask(req *TaskRequest) (*tasks.Task, error) {
+	t := &tasks.Task{
+		Id:           requestTaskId(req.IdempotencyKey),
+		Title:        req.Title,
+		Type:         req.Type,
+		UserId:       req.UserId,
+		Params:       req.Params,
+		NotifyEmails: req.NotifyEmails,
+	}
+	err := t.Create(c.store)
+	if err != tasks.ErrConflict {
+		return t, err
+	}
+
+	existing := &tasks.Task{Id: t.Id}
+	if err := existing.Read(c.store); err != nil {
+		return nil, err
+	}
+	if existing.Enqueued != nil {
+		return nil, nil
+	}
+	return existing, nil
+}
+
+// Shutdown stops consuming task requests & waits for the request in-flight
+// to be handled, returning ctx.Err() if ctx expires first
+func (c *TaskRequestConsumer) Shutdown(ctx context.Context) error {
+	if c.close != nil {
+		c.close()
+	}
+	select {
+	case <-c.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// consumeTaskRequests starts creating tasks from the queue named by
+// TaskRequestQueue. it returns a nil consumer if no queue is configured
+func consumeTaskRequests() (*TaskRequestConsumer, error) {
+	cfg := currentConfig()
+	if cfg.TaskRequestQueue == "" {
+		return nil, nil
+	}
+	if cfg.AmqpUrl == "" {
+		return nil, fmt.Errorf("TaskRequestQueue requires an AmqpUrl")
+	}
+
+	conn, err := amqp.Dial(cfg.AmqpUrl)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to connect to amqp server: %s", err.Error())
+	}
+
+	ch, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Failed to open a channel: %s", err.Error())
+	}
+
+	q, err := ch.QueueDeclare(
+		cfg.TaskRequestQueue, // name
+		true,                 // durable, requests must survive a broker restart
+		false,                // delete when unused
+		false,                // exclusive
+		false,                // no-wait
+		nil,                  // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error declaring task request queue: %s", err.Error())
+	}
+
+	msgs, err := ch.Consume(
+		q.Name, // queue
+		"",     // consumer
+		false,  // auto-ack
+		false,  // exclusive
+		false,  // no-local
+		false,  // no-wait
+		nil,    // args
+	)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Error consuming task request queue: %s", err.Error())
+	}
+
+	log.Infof("consuming task requests from queue: %s", q.Name)
+	c := newTaskRequestConsumer(store, msgs, func(t *tasks.Task) error {
+		if err := t.Enqueue(store, cfg.AmqpUrl); err != nil {
+			return err
+		}
+		go notifyTaskRequest(mailer, t)
+		return nil
+	})
+	c.close = func() {
+		ch.Close()
+		conn.Close()
+	}
+	go c.run()
+
+	return c, nil
+}
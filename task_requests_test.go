@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/streadway/amqp"
+)
+
+func TestTaskRequestConsumer(t *testing.T) {
+	tasks.RegisterTaskdef("test", func() tasks.Taskable { return &testTaskable{} })
+
+	store := datastore.NewMapDatastore()
+	var submitted []string
+	failSubmit := false
+	submit := func(t *tasks.Task) error {
+		if failSubmit {
+			failSubmit = false
+			return fmt.Errorf("queue unavailable")
+		}
+		submitted = append(submitted, t.Id)
+		now := time.Now()
+		t.Enqueued = &now
+		return t.Save(store)
+	}
+
+	cases := []struct {
+		description string
+		delivery    amqp.Delivery
+		failSubmit  bool
+		acked       bool
+		requeue     bool
+		submitted   int
+	}{
+		{"new request", amqp.Delivery{Body: []byte(`{"idempotencyKey":"a","type":"test","title":"a"}`)}, false, true, false, 1},
+		{"duplicate request", amqp.Delivery{Body: []byte(`{"idempotencyKey":"a","type":"test","title":"a"}`)}, false, true, false, 1},
+		{"message id as key", amqp.Delivery{MessageId: "b", Body: []byte(`{"type":"test"}`)}, false, true, false, 2},
+		{"invalid json", amqp.Delivery{Body: []byte(`{`)}, false, false, false, 2},
+		{"missing key", amqp.Delivery{Body: []byte(`{"type":"test"}`)}, false, false, false, 2},
+		{"unknown type", amqp.Delivery{Body: []byte(`{"idempotencyKey":"c","type":"nope"}`)}, false, false, true, 2},
+		{"failed submit", amqp.Delivery{Body: []byte(`{"idempotencyKey":"d","type":"test"}`)}, true, false, true, 2},
+		{"redelivered after failed submit", amqp.Delivery{Redelivered: true, Body: []byte(`{"idempotencyKey":"d","type":"test"}`)}, false, true, false, 3},
+		{"redelivered failure", amqp.Delivery{Redelivered: true, Body: []byte(`{"idempotencyKey":"e","type":"nope"}`)}, false, false, false, 3},
+	}
+
+	msgs := make(chan amqp.Delivery)
+	c := newTaskRequestConsumer(store, msgs, submit)
+	go c.run()
+
+	for i, cse := range cases {
+		ack := &recordingAcknowledger{}
+		cse.delivery.Acknowledger = ack
+		failSubmit = cse.failSubmit
+		msgs <- cse.delivery
+		// an unbuffered send only waits for the delivery to be received,
+		// the next send waits for it to be handled
+		msgs <- amqp.Delivery{Acknowledger: &recordingAcknowledger{}, Body: []byte(`{`)}
+
+		if ack.acked != cse.acked || ack.requeue != cse.requeue {
+			t.Errorf("case %d %s: expected acked: %t requeue: %t, got acked: %t requeue: %t", i, cse.description, cse.acked, cse.requeue, ack.acked, ack.requeue)
+		}
+		if len(submitted) != cse.submitted {
+			t.Errorf("case %d %s: expected %d submitted tasks, got: %d", i, cse.description, cse.submitted, len(submitted))
+		}
+	}
+
+	close(msgs)
+	if err := c.Shutdown(context.Background()); err != nil {
+		t.Errorf("unexpected shutdown error: %s", err)
+	}
+
+	task := &tasks.Task{Id: requestTaskId("a")}
+	if err := task.Read(store); err != nil {
+		t.Fatalf("expected task to be created for request: %s", err)
+	}
+	if task.Title != "a" || task.Type != "test" || task.Enqueued == nil {
+		t.Errorf("created task mismatch: %+v", task)
+	}
+	if requestTaskId("a") == requestTaskId("b") {
+		t.Errorf("expected different keys to create different tasks")
+	}
+}
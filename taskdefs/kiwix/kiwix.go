@@ -73,9 +73,12 @@ func (t *TaskUpdateSources) Do(updates chan tasks.Progress) {
 					return
 				}
 
-				if z.Md5 != s.Checksum {
+				// kiwix publishes bare md5 digests, unprefixed checksums
+				// are read as sha256
+				checksum := "md5:" + z.Md5
+				if !source.ChecksumsEqual(checksum, s.Checksum) {
 					s.Title = z.Title()
-					s.Checksum = z.Md5
+					s.Checksum = checksum
 					if err := s.Save(t.store); err != nil {
 						p.Error = fmt.Errorf("error saving source '%s': %s", s.Url, err.Error())
 						updates <- p
@@ -0,0 +1,45 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/datatogether/sqlutil"
+)
+
+// ArchiveTasks moves finished & failed tasks that haven't been updated since
+// before out of the tasks table & into tasks_archive, keeping the tasks table
+// small. A task's logs, artifacts & notes are archived with it. Archived tasks
+// can still be read with ReadArchivedTask. It returns the ids of archived tasks
+func ArchiveTasks(db sqlutil.Queryable, before time.Time) ([]string, error) {
+	rows, err := db.Query(qTasksArchive, before.In(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ReadArchivedTask reads a task that's been moved to tasks_archive by id,
+// along with it's artifacts, returning datastore.ErrNotFound if no archived
+// task exists
+func ReadArchivedTask(db sqlutil.Queryable, id string) (*Task, error) {
+	t := &Task{}
+	if err := t.UnmarshalSQL(db.QueryRow(qTaskArchiveReadById, id)); err != nil {
+		return nil, err
+	}
+	artifacts, err := readTaskArtifacts(db, qTaskArchiveArtifacts, t.Id)
+	if err != nil {
+		return nil, err
+	}
+	t.Artifacts = artifacts
+	return t, nil
+}
@@ -0,0 +1,63 @@
+package tasks
+
+import (
+	"fmt"
+
+	"github.com/datatogether/sqlutil"
+)
+
+// TaskArtifact is an output produced by a task. tasks can produce any number
+// of artifacts, registered by the worker that performed the task
+type TaskArtifact struct {
+	// name of the artifact, unique within a task
+	Name string `json:"name"`
+	// location the artifact can be fetched from
+	Url string `json:"url,omitempty"`
+	// hash of the artifact's contents
+	Hash string `json:"hash,omitempty"`
+	// size of the artifact in bytes
+	Size int64 `json:"size,omitempty"`
+}
+
+// AddTaskArtifacts registers artifacts produced by a task. registering an
+// artifact with the same name as an existing one replaces it, so workers
+// can safely retry. Artifacts without a name return ErrInvalidTask
+func AddTaskArtifacts(db sqlutil.Execable, taskId string, artifacts []*TaskArtifact) error {
+	for _, a := range artifacts {
+		if a.Name == "" {
+			return fmt.Errorf("%w: artifact name is required", ErrInvalidTask)
+		}
+	}
+	for _, a := range artifacts {
+		if _, err := db.Exec(qTaskArtifactUpsert, taskId, a.Name, a.Url, a.Hash, a.Size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadTaskArtifacts reads all artifacts registered for a task in the order
+// they were first registered
+func ReadTaskArtifacts(db sqlutil.Queryable, taskId string) ([]*TaskArtifact, error) {
+	return readTaskArtifacts(db, qTaskArtifacts, taskId)
+}
+
+// readTaskArtifacts reads artifacts for taskId with query, which must select
+// name, url, hash & size
+func readTaskArtifacts(db sqlutil.Queryable, query, taskId string) ([]*TaskArtifact, error) {
+	rows, err := db.Query(query, taskId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	artifacts := []*TaskArtifact{}
+	for rows.Next() {
+		a := &TaskArtifact{}
+		if err := rows.Scan(&a.Name, &a.Url, &a.Hash, &a.Size); err != nil {
+			return nil, err
+		}
+		artifacts = append(artifacts, a)
+	}
+	return artifacts, rows.Err()
+}
@@ -0,0 +1,33 @@
+package tasks
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+)
+
+// definitionHash checksums the fields that define what a task does, in the
+// form sha256:[digest]. params are marshaled with sorted keys, so equal
+// definitions always hash the same. run state, titles & owners aren't
+// included, they don't change the work a task performs
+func (t *Task) definitionHash() string {
+	data, err := json.Marshal(struct {
+		Type   string                 `json:"type"`
+		Params map[string]interface{} `json:"params"`
+	}{t.Type, t.Params})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// DefinitionChanged reports whether t would perform different work than
+// prev, a previous run of the same task. Use it to skip re-running tasks
+// whose definition hasn't changed
+func (t *Task) DefinitionChanged(prev *Task) bool {
+	if prev == nil {
+		return true
+	}
+	return t.definitionHash() != prev.definitionHash()
+}
@@ -0,0 +1,62 @@
+package tasks
+
+import (
+	"github.com/ipfs/go-datastore"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskDefinitionChanged(t *testing.T) {
+	base := &Task{Type: "ipfs.addurl", Params: map[string]interface{}{"url": "http://example.com/a", "depth": 1.0}}
+	now := time.Now()
+
+	cases := []struct {
+		task    *Task
+		changed bool
+	}{
+		// run state, titles & owners don't change the definition
+		{&Task{Type: "ipfs.addurl", Params: map[string]interface{}{"depth": 1.0, "url": "http://example.com/a"}}, false},
+		{&Task{Title: "renamed", UserId: "someone", Type: "ipfs.addurl", Params: map[string]interface{}{"url": "http://example.com/a", "depth": 1.0},
+			Started: &now, Failed: &now, Error: "boom", WorkerId: "w", NotifyEmails: []string{"a@example.com"}}, false},
+		{&Task{Type: "ipfs.addurl", Params: map[string]interface{}{"url": "http://example.com/b", "depth": 1.0}}, true},
+		{&Task{Type: "ipfs.addurl", Params: map[string]interface{}{"url": "http://example.com/a"}}, true},
+		{&Task{Type: "ipfs.add", Params: map[string]interface{}{"url": "http://example.com/a", "depth": 1.0}}, true},
+	}
+
+	for i, c := range cases {
+		if got := c.task.DefinitionChanged(base); got != c.changed {
+			t.Errorf("case %d: expected changed to be %t, got: %t", i, c.changed, got)
+		}
+	}
+
+	if !base.DefinitionChanged(nil) {
+		t.Errorf("expected a task without a previous run to count as changed")
+	}
+}
+
+func TestTaskSaveDefinitionHash(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.HasPrefix(task.DefinitionHash, "sha256:") {
+		t.Errorf("expected saving to set a sha256 definition hash, got: '%s'", task.DefinitionHash)
+	}
+
+	prev := task.DefinitionHash
+	task.Title = "renamed"
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.DefinitionHash != prev {
+		t.Errorf("expected title change to keep definition hash %s, got: %s", prev, task.DefinitionHash)
+	}
+
+	if err := task.Patch([]byte(`{"definitionHash":"sha256:00"}`)); err == nil {
+		t.Errorf("expected patching definitionHash to error")
+	}
+}
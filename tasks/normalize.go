@@ -0,0 +1,109 @@
+package tasks
+
+import (
+	"net/url"
+	"strings"
+)
+
+// NormalizeTitles collapses runs of whitespace in the titles of new tasks
+// to a single space & trims the ends, so titles that only differ by
+// spacing are the same title when UniqueTitles is set
+var NormalizeTitles = false
+
+// NormalizeUrls rewrites the "url" param of new tasks with NormalizeUrl,
+// so equivalent urls are stored & matched the same way
+var NormalizeUrls = false
+
+// TrimUrlTrailingSlashes also removes trailing slashes from url paths
+// when normalizing urls. only enable it if the sources tasks are created
+// for serve the same content with & without the slash
+var TrimUrlTrailingSlashes = false
+
+// UniqueUrls refuses new tasks that share a type & "url" param with a task
+// that hasn't finished or failed. urls are compared in their normalized
+// form when NormalizeUrls is set
+var UniqueUrls = false
+
+// defaultPorts are left off normalized urls
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+}
+
+// NormalizeTitle collapses whitespace in title
+func NormalizeTitle(title string) string {
+	return strings.Join(strings.Fields(title), " ")
+}
+
+// NormalizeUrl rewrites rawurl into a canonical form: the scheme & host are
+// lowercased, default ports removed, & an empty path becomes "/". if
+// trimSlash is true trailing slashes are removed from paths other than "/".
+// the path, query & fragment are otherwise left as-is, servers can treat
+// their case as meaningful
+func NormalizeUrl(rawurl string, trimSlash bool) (string, error) {
+	u, err := url.Parse(strings.TrimSpace(rawurl))
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		// relative urls & urls without a host have no canonical form
+		return rawurl, nil
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+	host, port := strings.ToLower(u.Hostname()), u.Port()
+	if port == defaultPorts[u.Scheme] {
+		port = ""
+	}
+	if strings.Contains(host, ":") {
+		// ipv6 literal
+		host = "[" + host + "]"
+	}
+	if port != "" {
+		host += ":" + port
+	}
+	u.Host = host
+
+	if trimSlash {
+		u.Path = strings.TrimRight(u.Path, "/")
+		u.RawPath = strings.TrimRight(u.RawPath, "/")
+	}
+	if u.Path == "" {
+		u.Path, u.RawPath = "/", ""
+	}
+	return u.String(), nil
+}
+
+// urlVariants returns the spellings of rawurl tasks can be stored with:
+// rawurl itself, plus it's normalized form when NormalizeUrls is set.
+// tasks saved before normalization was enabled keep their original url
+func urlVariants(rawurl string) []string {
+	urls := []string{rawurl}
+	if NormalizeUrls {
+		if u, err := NormalizeUrl(rawurl, TrimUrlTrailingSlashes); err == nil && u != rawurl {
+			urls = append(urls, u)
+		}
+	}
+	return urls
+}
+
+// normalize applies the enabled title & url normalization to t. Params is
+// copied before the url is rewritten, callers may share the map
+func (t *Task) normalize() {
+	if NormalizeTitles {
+		t.Title = NormalizeTitle(t.Title)
+	}
+	if NormalizeUrls {
+		if raw, ok := t.Params["url"].(string); ok {
+			// unparsable urls are left for the task's own validation
+			if u, err := NormalizeUrl(raw, TrimUrlTrailingSlashes); err == nil && u != raw {
+				params := make(map[string]interface{}, len(t.Params))
+				for k, v := range t.Params {
+					params[k] = v
+				}
+				params["url"] = u
+				t.Params = params
+			}
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package tasks
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ipfs/go-datastore"
+)
+
+func TestNormalizeUrl(t *testing.T) {
+	cases := []struct {
+		a, b      string
+		trimSlash bool
+		same      bool
+	}{
+		{"http://example.com/a", "http://EXAMPLE.com/a", false, true},
+		{"HTTP://example.com/a", "http://example.com/a", false, true},
+		{"http://example.com:80/a", "http://example.com/a", false, true},
+		{"https://example.com:443/a", "https://example.com/a", false, true},
+		{"http://example.com", "http://example.com/", false, true},
+		{" http://example.com/a ", "http://example.com/a", false, true},
+		{"http://example.com/a/", "http://example.com/a", true, true},
+		{"http://[::1]:80/a", "http://[::1]/a", false, true},
+		{"http://example.com/a/", "http://example.com/a", false, false},
+		{"http://example.com:8080/a", "http://example.com/a", false, false},
+		{"https://example.com:80/a", "https://example.com/a", false, false},
+		{"http://example.com/A", "http://example.com/a", false, false},
+		{"http://example.com/a?q=1", "http://example.com/a?q=2", false, false},
+	}
+
+	for i, c := range cases {
+		a, err := NormalizeUrl(c.a, c.trimSlash)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", i, err)
+			continue
+		}
+		b, err := NormalizeUrl(c.b, c.trimSlash)
+		if err != nil {
+			t.Errorf("case %d: unexpected error: %s", i, err)
+			continue
+		}
+		if (a == b) != c.same {
+			t.Errorf("case %d: expected %s & %s to normalize the same: %t. got: %s, %s", i, c.a, c.b, c.same, a, b)
+		}
+		// normalizing is idempotent
+		if again, _ := NormalizeUrl(a, c.trimSlash); again != a {
+			t.Errorf("case %d: expected normalizing %s again to be unchanged, got: %s", i, a, again)
+		}
+	}
+
+	if got, _ := NormalizeUrl("http://example.com/", true); got != "http://example.com/" {
+		t.Errorf("expected root path to keep it's slash, got: %s", got)
+	}
+	if _, err := NormalizeUrl("http://example.com:port/", false); err == nil {
+		t.Errorf("expected invalid url to error")
+	}
+}
+
+func TestNormalizeTitle(t *testing.T) {
+	if got := NormalizeTitle("  a \t title\n here "); got != "a title here" {
+		t.Errorf("expected whitespace to be collapsed, got: '%s'", got)
+	}
+}
+
+func TestTaskSaveNormalizes(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	defer func() {
+		NormalizeTitles, NormalizeUrls, TrimUrlTrailingSlashes, UniqueTitles = false, false, false, false
+	}()
+	NormalizeTitles, NormalizeUrls, TrimUrlTrailingSlashes, UniqueTitles = true, true, true, true
+
+	store := datastore.NewMapDatastore()
+	a := &Task{Type: "test", Title: " archive  example ", Params: map[string]interface{}{"url": "HTTP://Example.com:80/data/"}}
+	if err := a.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if a.Title != "archive example" {
+		t.Errorf("expected title to be normalized, got: '%s'", a.Title)
+	}
+	if a.Params["url"] != "http://example.com/data" {
+		t.Errorf("expected url to be normalized, got: %s", a.Params["url"])
+	}
+	if a.DefinitionHash != a.definitionHash() {
+		t.Errorf("expected definition hash to match the normalized definition")
+	}
+
+	b := &Task{Type: "test", Title: "archive example", Params: map[string]interface{}{"url": "http://example.com/data"}}
+	if b.DefinitionChanged(a) {
+		t.Errorf("expected task with an equivalent url to have the same definition")
+	}
+	if err := b.Save(store); err != ErrConflict {
+		t.Errorf("expected title differing only by whitespace to conflict, got: %v", err)
+	}
+}
+
+func TestTaskSaveNormalizeCopiesParams(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	defer func() { NormalizeUrls = false }()
+	NormalizeUrls = true
+
+	params := map[string]interface{}{"url": "HTTP://Example.com/data"}
+	a := &Task{Type: "test", Params: params}
+	if err := a.Save(datastore.NewMapDatastore()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if a.Params["url"] != "http://example.com/data" {
+		t.Errorf("expected url to be normalized, got: %s", a.Params["url"])
+	}
+	if params["url"] != "HTTP://Example.com/data" {
+		t.Errorf("expected caller's params to be unchanged, got: %s", params["url"])
+	}
+}
+
+func TestTaskSaveUniqueUrls(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	defer func() { NormalizeUrls, TrimUrlTrailingSlashes, UniqueUrls = false, false, false }()
+	NormalizeUrls, TrimUrlTrailingSlashes, UniqueUrls = true, true, true
+
+	store := datastore.NewMapDatastore()
+	// saved before url normalization was enabled
+	legacy := &Task{Id: "d8b2ec4a-8f8c-4c1f-9c52-4d2c5e5c2f10", Type: "test", Params: map[string]interface{}{"url": "HTTP://Legacy.com/data/"}}
+	if err := store.Put(legacy.Key(), legacy); err != nil {
+		t.Fatal(err.Error())
+	}
+	a := &Task{Type: "test", Params: map[string]interface{}{"url": "http://example.com/data"}}
+	if err := a.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	cases := []struct {
+		taskType, url string
+		err           error
+	}{
+		{"test", "http://EXAMPLE.com:80/data/", ErrConflict},
+		{"test", "http://example.com/data", ErrConflict},
+		{"test", "HTTP://Legacy.com/data/", ErrConflict},
+		{"test", "http://example.com/other", nil},
+		{"other", "http://example.com/data", nil},
+	}
+	RegisterTaskdef("other", NewExampleTask)
+	for i, c := range cases {
+		b := &Task{Type: c.taskType, Params: map[string]interface{}{"url": c.url}}
+		if err := b.Save(store); err != c.err {
+			t.Errorf("case %d: expected error: %v, got: %v", i, c.err, err)
+		}
+		if c.err == nil {
+			// remove the new task so it doesn't affect later cases
+			store.Delete(b.Key())
+		}
+	}
+
+	now := time.Now()
+	a.Succeeded = &now
+	if err := a.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	b := &Task{Type: "test", Params: map[string]interface{}{"url": "http://example.com/data/"}}
+	if err := b.Save(store); err != nil {
+		t.Errorf("expected finished task's url to be reusable, got: %v", err)
+	}
+}
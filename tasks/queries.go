@@ -14,7 +14,10 @@ CREATE TABLE tasks (
   enqueued         timestamp,
   started          timestamp,
   succeeded        timestamp,
-  failed           timestamp
+  failed           timestamp,
+  worker_id        text NOT NULL DEFAULT '',
+  notify_emails    text[],
+  definition_hash  text NOT NULL DEFAULT ''
 );`
 
 // an available task a source.Checksum && repo.LatestCommit combination that doesn't
@@ -43,31 +46,163 @@ WHERE
 const qTasks = `
 SELECT
   id, created, updated, title, user_id, type,
-  params, status, error, enqueued, started, succeeded, failed
+  params, status, error, enqueued, started, succeeded, failed, worker_id,
+  notify_emails, definition_hash
 FROM tasks
-ORDER BY created DESC
+ORDER BY created DESC, id DESC
 LIMIT $1 OFFSET $2;`
 
+// qTaskSelect is the base statement for TaskQuery, which appends
+// it's own WHERE, ORDER BY & LIMIT clauses
+const qTaskSelect = `
+SELECT
+  id, created, updated, title, user_id, type,
+  params, status, error, enqueued, started, succeeded, failed, worker_id,
+  notify_emails, definition_hash
+FROM tasks`
+
+// qTaskSelectLastUpdated is the base statement for TaskQuery.LastUpdatedSQL
+const qTaskSelectLastUpdated = `
+SELECT max(updated) FROM tasks`
+
 const qTaskExists = `SELECT exists(SELECT 1 FROM tasks WHERE id = $1);`
 
+const qTaskTitleExists = `SELECT exists(SELECT 1 FROM tasks WHERE title = $1);`
+
+const qTaskUrlExists = `
+SELECT exists(SELECT 1 FROM tasks
+  WHERE type = $1 AND params->>'url' = ANY($2) AND succeeded IS NULL AND failed IS NULL);`
+
+// unique titles are only enforced for non-empty titles
+const qTaskCreateUniqueTitleIndex = `
+CREATE UNIQUE INDEX IF NOT EXISTS tasks_unique_title ON tasks (title) WHERE title <> '';`
+
+const qTaskDropUniqueTitleIndex = `DROP INDEX IF EXISTS tasks_unique_title;`
+
 const qTaskReadById = `
 SELECT 
   id, created, updated, title, user_id, type,
-  params, status, error, enqueued, started, succeeded, failed
+  params, status, error, enqueued, started, succeeded, failed, worker_id,
+  notify_emails, definition_hash
 FROM tasks
 WHERE id = $1;`
 
 const qTaskInsert = `
 INSERT INTO tasks
   (id, created, updated, title, user_id, type,
-   params, status, error, enqueued, started, succeeded, failed)
+   params, status, error, enqueued, started, succeeded, failed, worker_id,
+   notify_emails, definition_hash)
 VALUES
-  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13);`
+  ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16);`
 
 const qTaskUpdate = `
 UPDATE tasks SET
   created = $2, updated = $3, title = $4, user_id = $5, type = $6,
-  params = $7, status = $8, error = $9, enqueued = $10, started = $11, succeeded = $12, failed = $13
+  params = $7, status = $8, error = $9, enqueued = $10, started = $11, succeeded = $12, failed = $13,
+  worker_id = $14, notify_emails = $15, definition_hash = $16
+WHERE id = $1;`
+
+const qTaskUpdateRunState = `
+UPDATE tasks SET
+  updated = $2, error = $3, enqueued = $4, started = $5, succeeded = $6, failed = $7,
+  worker_id = $8
 WHERE id = $1;`
 
+// qTaskCreateIndexes indexes the columns task listings filter & sort on.
+// partial indexes on the date stamps back the status conditions in
+// taskStatusConditions
+const qTaskCreateIndexes = `
+CREATE INDEX IF NOT EXISTS tasks_created ON tasks (created);
+CREATE INDEX IF NOT EXISTS tasks_updated ON tasks (updated);
+CREATE INDEX IF NOT EXISTS tasks_queued ON tasks (enqueued)
+  WHERE started IS NULL AND succeeded IS NULL AND failed IS NULL;
+CREATE INDEX IF NOT EXISTS tasks_running ON tasks (started)
+  WHERE started IS NOT NULL AND succeeded IS NULL AND failed IS NULL;
+CREATE INDEX IF NOT EXISTS tasks_succeeded ON tasks (succeeded) WHERE succeeded IS NOT NULL;
+CREATE INDEX IF NOT EXISTS tasks_failed ON tasks (failed) WHERE failed IS NOT NULL;`
+
+// adds the worker_id column to tasks tables created before it existed
+const qTaskMigrateWorkerId = `
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS worker_id text NOT NULL DEFAULT '';`
+
+// adds the notify_emails column to tasks & tasks_archive tables created
+// before it existed
+const qTaskMigrateNotifyEmails = `
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS notify_emails text[];
+ALTER TABLE tasks_archive ADD COLUMN IF NOT EXISTS notify_emails text[];`
+
+// adds the definition_hash column to tasks & tasks_archive tables created
+// before it existed
+const qTaskMigrateDefinitionHash = `
+ALTER TABLE tasks ADD COLUMN IF NOT EXISTS definition_hash text NOT NULL DEFAULT '';
+ALTER TABLE tasks_archive ADD COLUMN IF NOT EXISTS definition_hash text NOT NULL DEFAULT '';`
+
+const qTaskCountReady = `
+SELECT count(1) FROM tasks
+WHERE user_id = $1 AND started IS NULL AND succeeded IS NULL AND failed IS NULL;`
+
 const qTaskDelete = `DELETE FROM tasks WHERE id = $1;`
+
+// qTasksArchive moves finished & failed tasks last updated before $1 into
+// tasks_archive, copying their logs, artifacts & notes into the matching
+// archive tables, returning the ids of archived tasks. every sub-statement
+// reads the same snapshot, so the copies see rows the task delete cascades to
+const qTasksArchive = `
+WITH archived AS (
+  DELETE FROM tasks
+  WHERE (succeeded IS NOT NULL OR failed IS NOT NULL) AND updated < $1
+  RETURNING
+    id, created, updated, title, user_id, type,
+    params, status, error, enqueued, started, succeeded, failed, worker_id,
+    notify_emails, definition_hash
+), archived_tasks AS (
+  INSERT INTO tasks_archive
+    (id, created, updated, title, user_id, type,
+     params, status, error, enqueued, started, succeeded, failed, worker_id,
+     notify_emails, definition_hash)
+  SELECT * FROM archived
+  RETURNING id
+), archived_logs AS (
+  INSERT INTO task_logs_archive (id, task_id, created, line)
+  SELECT id, task_id, created, line FROM task_logs
+  WHERE task_id IN (SELECT id FROM archived)
+), archived_artifacts AS (
+  INSERT INTO task_artifacts_archive (id, task_id, name, url, hash, size)
+  SELECT id, task_id, name, url, hash, size FROM task_artifacts
+  WHERE task_id IN (SELECT id FROM archived)
+), archived_notes AS (
+  INSERT INTO task_notes_archive (id, task_id, created, author, body)
+  SELECT id, task_id, created, author, body FROM task_notes
+  WHERE task_id IN (SELECT id FROM archived)
+)
+SELECT id FROM archived_tasks;`
+
+const qTaskArchiveReadById = `
+SELECT
+  id, created, updated, title, user_id, type,
+  params, status, error, enqueued, started, succeeded, failed, worker_id,
+  notify_emails, definition_hash
+FROM tasks_archive
+WHERE id = $1;`
+
+// registers an artifact for a task, replacing any artifact of the same name
+const qTaskArtifactUpsert = `
+INSERT INTO task_artifacts
+  (task_id, name, url, hash, size)
+VALUES
+  ($1, $2, $3, $4, $5)
+ON CONFLICT (task_id, name) DO UPDATE SET url = $3, hash = $4, size = $5;`
+
+const qTaskArtifacts = `
+SELECT
+  name, url, hash, size
+FROM task_artifacts
+WHERE task_id = $1
+ORDER BY id ASC;`
+
+const qTaskArchiveArtifacts = `
+SELECT
+  name, url, hash, size
+FROM task_artifacts_archive
+WHERE task_id = $1
+ORDER BY id ASC;`
@@ -0,0 +1,86 @@
+package tasks
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/datatogether/sql_datastore"
+	"github.com/datatogether/sqlutil"
+	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+)
+
+// SQLStore is a datastore for tasks that runs it's queries on DB, which can
+// be a transaction. sql_datastore.Datastore only accepts a *sql.DB, wrap a
+// *sql.Tx in a SQLStore to read & save tasks as part of a transaction.
+// Only Task values are supported, & Query isn't
+type SQLStore struct {
+	DB sqlutil.Execable
+}
+
+// Put saves a task, inserting it if it doesn't exist
+func (s SQLStore) Put(key datastore.Key, value interface{}) error {
+	t, ok := value.(*Task)
+	if !ok {
+		return fmt.Errorf("value is not a task")
+	}
+
+	exists, err := s.Has(key)
+	if err != nil {
+		return err
+	}
+	cmd := sql_datastore.CmdInsertOne
+	if exists {
+		cmd = sql_datastore.CmdUpdateOne
+	}
+	_, err = s.DB.Exec(t.SQLQuery(cmd), t.SQLParams(cmd)...)
+	return err
+}
+
+// Get reads a task, returning datastore.ErrNotFound if it doesn't exist
+func (s SQLStore) Get(key datastore.Key) (interface{}, error) {
+	t, err := s.model(key)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.UnmarshalSQL(s.DB.QueryRow(t.SQLQuery(sql_datastore.CmdSelectOne), t.SQLParams(sql_datastore.CmdSelectOne)...)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Has checks if a task exists
+func (s SQLStore) Has(key datastore.Key) (exists bool, err error) {
+	t, err := s.model(key)
+	if err != nil {
+		return false, err
+	}
+	err = s.DB.QueryRow(t.SQLQuery(sql_datastore.CmdExistsOne), t.SQLParams(sql_datastore.CmdExistsOne)...).Scan(&exists)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return
+}
+
+// Delete removes a task
+func (s SQLStore) Delete(key datastore.Key) error {
+	t, err := s.model(key)
+	if err != nil {
+		return err
+	}
+	_, err = s.DB.Exec(t.SQLQuery(sql_datastore.CmdDeleteOne), t.SQLParams(sql_datastore.CmdDeleteOne)...)
+	return err
+}
+
+// Query isn't supported, use QueryTasks
+func (s SQLStore) Query(q query.Query) (query.Results, error) {
+	return nil, fmt.Errorf("SQLStore doesn't support queries")
+}
+
+// model returns an empty task for key
+func (s SQLStore) model(key datastore.Key) (*Task, error) {
+	if key.Type() != (Task{}).DatastoreType() {
+		return nil, fmt.Errorf("SQLStore only stores tasks, got key: %s", key.String())
+	}
+	return &Task{Id: key.Name()}, nil
+}
@@ -0,0 +1,65 @@
+package tasks
+
+import (
+	"fmt"
+)
+
+// Status is the state of a task, derived from it's date stamps. cancelled
+// tasks are failed tasks with CancelledError as their error
+type Status string
+
+const (
+	// StatusReady tasks have been saved but not yet put on the queue
+	StatusReady Status = "ready"
+	// StatusQueued tasks are on the queue, waiting for a worker
+	StatusQueued Status = "queued"
+	// StatusRunning tasks have been claimed by a worker
+	StatusRunning Status = "running"
+	// StatusFinished tasks completed successfully
+	StatusFinished Status = "finished"
+	// StatusFailed tasks completed with an error
+	StatusFailed Status = "failed"
+	// StatusCancelled tasks were stopped by a cancel request before they
+	// finished
+	StatusCancelled Status = "cancelled"
+)
+
+// Statuses lists all valid task statuses in the order a task moves
+// through them
+var Statuses = []Status{StatusReady, StatusQueued, StatusRunning, StatusFinished, StatusFailed, StatusCancelled}
+
+// legacyStatuses maps status names that have since been renamed to their
+// current status, so old api clients & stored rows keep working
+var legacyStatuses = map[Status]Status{
+	"enquing": StatusReady,
+}
+
+// Canonical returns the current name for s if s is a legacy status name,
+// otherwise s
+func (s Status) Canonical() Status {
+	if status, ok := legacyStatuses[s]; ok {
+		return status
+	}
+	return s
+}
+
+// String implements the fmt.Stringer interface
+func (s Status) String() string {
+	return string(s)
+}
+
+// ParseStatus reads a Status from a string, returning an error if s
+// isn't a valid status. An empty string parses to an empty Status, legacy
+// status names parse to their current status
+func ParseStatus(s string) (Status, error) {
+	if s == "" {
+		return "", nil
+	}
+	canonical := Status(s).Canonical()
+	for _, status := range Statuses {
+		if status == canonical {
+			return status, nil
+		}
+	}
+	return "", fmt.Errorf("%w: invalid task status: '%s'", ErrInvalidTask, s)
+}
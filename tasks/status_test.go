@@ -0,0 +1,63 @@
+package tasks
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	cases := []struct {
+		s      string
+		expect Status
+		err    bool
+	}{
+		{"", "", false},
+		{"ready", StatusReady, false},
+		{"enquing", StatusReady, false},
+		{"queued", StatusQueued, false},
+		{"running", StatusRunning, false},
+		{"finished", StatusFinished, false},
+		{"failed", StatusFailed, false},
+		{"cancelled", StatusCancelled, false},
+		{"Running", "", true},
+		{"done", "", true},
+		{"running; DROP TABLE tasks", "", true},
+	}
+
+	for i, c := range cases {
+		got, err := ParseStatus(c.s)
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if err != nil && !errors.Is(err, ErrInvalidTask) {
+			t.Errorf("case %d expected error to be ErrInvalidTask, got: %v", i, err)
+		}
+		if got != c.expect {
+			t.Errorf("case %d status mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
+
+func TestTaskStatusString(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		t      Task
+		expect Status
+	}{
+		{Task{}, StatusReady},
+		{Task{Enqueued: &now}, StatusQueued},
+		{Task{Enqueued: &now, Started: &now}, StatusRunning},
+		{Task{Enqueued: &now, Started: &now, Succeeded: &now}, StatusFinished},
+		{Task{Enqueued: &now, Started: &now, Failed: &now}, StatusFailed},
+		{Task{Enqueued: &now, Started: &now, Failed: &now, Error: CancelledError}, StatusCancelled},
+		{Task{Enqueued: &now, Failed: &now, Error: "cancelled by accident"}, StatusFailed},
+	}
+
+	for i, c := range cases {
+		if got := c.t.StatusString(); got != c.expect {
+			t.Errorf("case %d mismatch. expected: %s, got: %s", i, c.expect, got)
+		}
+	}
+}
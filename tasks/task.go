@@ -1,17 +1,56 @@
 package tasks
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
 	"fmt"
 	"github.com/datatogether/sql_datastore"
 	"github.com/datatogether/sqlutil"
 	"github.com/ipfs/go-datastore"
+	"github.com/ipfs/go-datastore/query"
+	"github.com/lib/pq"
 	"github.com/pborman/uuid"
 	"github.com/streadway/amqp"
+	"net/mail"
+	"text/template"
 	"time"
+	"unicode/utf8"
 )
 
+// UniqueTitles requires new tasks to have a title that no other
+// task has when true. Must be set before calling Task.Save
+var UniqueTitles = false
+
+// TitleTemplate is a text/template for generating titles for tasks
+// that are saved without one. The template is executed with the task as data,
+// and has a "short" function that abbreviates strings to 7 characters
+var TitleTemplate = `{{.Type}} @ {{short .Id}}`
+
+// LockFinishedDefinitions rejects saves that change the type or params of a
+// finished or failed task, so a task's history always describes the work it
+// did. changes to run state are still saved
+var LockFinishedDefinitions = false
+
+// MaxTitleLength & MaxErrorLength limit the number of characters in a task's
+// Title & Error. Saving a task that exceeds either returns ErrInvalidTask.
+// a limit of 0 means no limit
+var (
+	MaxTitleLength = 0
+	MaxErrorLength = 0
+)
+
+// ErrInvalidTask is returned when saving a task that fails validation
+var ErrInvalidTask = fmt.Errorf("invalid task")
+
+// ErrConflict is returned when saving a task would conflict with an existing task
+var ErrConflict = fmt.Errorf("task conflicts with an existing task")
+
+// ErrNotRunnable is returned when saving a change to the definition of a
+// finished or failed task while LockFinishedDefinitions is set
+var ErrNotRunnable = fmt.Errorf("task has finished, reset or clone it to change it's definition")
+
 // Task represents the storable state of a task. Note this is not the "task" itself
 // (the function that will be called to do the actual work associated with a task)
 // but the state associated with performing a task.
@@ -51,11 +90,34 @@ type Task struct {
 	// timestamp for when request failed
 	// nil if task hasn't failed
 	Failed *time.Time `json:"failed,omitempty"`
+	// identifier of the worker that claimed this task, empty if the
+	// task hasn't been claimed. kept after the task finishes as a record
+	// of where it ran
+	WorkerId string `json:"workerId,omitempty"`
+	// email addresses notified about this task, either alongside or instead
+	// of the server's configured recipients
+	NotifyEmails []string `json:"notifyEmails,omitempty"`
+	// checksum of the task's type & params, set on save. see DefinitionChanged
+	DefinitionHash string `json:"definitionHash,omitempty"`
 	// progress of this task's completion
 	// progress may not be stored, but instead kept ephemerally
 	Progress *Progress `json:"progress,omitempty"`
+	// outputs the task produced. artifacts are stored separately from
+	// the task, and only included when read with ReadTaskArtifacts or
+	// ReadArchivedTask
+	Artifacts []*TaskArtifact `json:"artifacts,omitempty"`
+
+	// status of the task when it was last read or saved, used to detect
+	// status changes on save
+	savedStatus Status
 }
 
+// StatusChanged, if set, is called after saving a task moves it to a new
+// status, with the status it had when it was last read or saved. new tasks
+// change from an empty status. StatusChanged must not fail the save, so it
+// has no return value
+var StatusChanged func(t *Task, from Status)
+
 // DatastoreType is to fulfill the sql_datastore.Model interface
 // It distinguishes "Task" as a storable type. "Task" is not (yet) intended for
 // use outside of Datatogether servers.
@@ -157,8 +219,16 @@ func TaskFromDelivery(store datastore.Datastore, msg amqp.Delivery) (*Task, erro
 	return t, nil
 }
 
-// Do performs the
+// Do performs the task, sending progress updates on tc. the task's final
+// state is saved to store before Do returns
 func (task *Task) Do(store datastore.Datastore, tc chan *Task) error {
+	return task.DoContext(context.Background(), store, tc)
+}
+
+// DoContext is Do, returning ctx.Err() without saving if ctx is done before
+// the task finishes. taskables can't be interrupted, so a stopped task's
+// taskable keeps running in the background with it's updates discarded
+func (task *Task) DoContext(ctx context.Context, store datastore.Datastore, tc chan *Task) error {
 	newTask := taskdefs[task.Type]
 	if newTask == nil {
 		return fmt.Errorf("unknown task type: %s", task.Type)
@@ -189,44 +259,197 @@ func (task *Task) Do(store datastore.Datastore, tc chan *Task) error {
 	// execute the task in a goroutine
 	go tt.Do(pc)
 
-	for p := range pc {
+	for {
+		var p Progress
+		select {
+		case <-ctx.Done():
+			// let the taskable finish sending
+			go func() {
+				for p := range pc {
+					if p.Done || p.Error != nil {
+						return
+					}
+				}
+			}()
+			return ctx.Err()
+		case update, ok := <-pc:
+			if !ok {
+				return nil
+			}
+			p = update
+		}
+
 		// TODO - log progress and pipe out of this func
 		// so others can listen in for updates
 		// fmt.Println(p.String())
 		task.Progress = &p
-		tc <- task
+		// send a copy, receivers read updates while the task keeps running
+		update := *task
+		tc <- &update
 
 		if p.Error != nil {
-			task.Error = p.Error.Error()
+			task.SetError(p.Error.Error())
 			now := time.Now()
 			task.Failed = &now
-			go task.Save(store)
+			task.Save(store)
 			return p.Error
 		}
 		if p.Done {
 			now := time.Now()
 			task.Succeeded = &now
-			go task.Save(store)
-			return nil
+			return task.Save(store)
 		}
 	}
+}
+
+// Claim marks the task as started by the worker identified by workerId
+func (t *Task) Claim(workerId string) {
+	now := time.Now()
+	t.Started = &now
+	t.WorkerId = workerId
+}
+
+// Retry resets the run state of a failed task so it can be run again.
+// Retry returns ErrConflict if the task hasn't finished, & ErrInvalidTask
+// if it succeeded
+func (t *Task) Retry() error {
+	if t.Failed == nil {
+		if t.Succeeded != nil {
+			return fmt.Errorf("%w: only failed tasks can be retried", ErrInvalidTask)
+		}
+		return ErrConflict
+	}
+
+	t.Error = ""
+	t.Enqueued = nil
+	t.Started = nil
+	t.Failed = nil
+	t.WorkerId = ""
+	t.Progress = nil
+	return nil
+}
+
+// CancelledError is the error recorded on tasks that were cancelled
+const CancelledError = "cancelled"
+
+// Cancel marks an unfinished task as failed with CancelledError. Workers call
+// Cancel to acknowledge a cancellation request for a task they're running.
+// Cancel returns ErrConflict if the task has already finished
+func (t *Task) Cancel() error {
+	if t.Succeeded != nil || t.Failed != nil {
+		return ErrConflict
+	}
 
+	now := time.Now()
+	t.Failed = &now
+	t.SetError(CancelledError)
 	return nil
 }
 
-// StatusString returns a string representation of the status
-// of a task based on the state of it's date stamps
-func (t *Task) StatusString() string {
-	if t.Enqueued == nil {
-		return "enquing"
-	} else if t.Enqueued != nil {
-		return "queued"
-	} else if t.Succeeded != nil {
-		return "finished"
-	} else if t.Failed != nil {
-		return "failed"
+// SetStatus corrects a task's run state to status, either StatusFinished or
+// StatusFailed. tasks set to failed record reason as their error. Other
+// statuses are set by running tasks, & return ErrInvalidTask, as does
+// setting a task to the status it already has
+func (t *Task) SetStatus(status Status, reason string) error {
+	if status != StatusFinished && status != StatusFailed {
+		return fmt.Errorf("%w: tasks can only be set to %s or %s", ErrInvalidTask, StatusFinished, StatusFailed)
+	}
+	if t.StatusString() == status {
+		return fmt.Errorf("%w: task %s is already %s", ErrInvalidTask, t.Id, status)
+	}
+
+	now := time.Now()
+	if status == StatusFinished {
+		t.Succeeded = &now
+		t.Failed = nil
+		t.Error = ""
 	} else {
-		return "running"
+		t.Succeeded = nil
+		t.Failed = &now
+		t.SetError(reason)
+	}
+	t.Updated = now.Round(time.Second).In(time.UTC)
+	return nil
+}
+
+// Clone creates a new, unsaved task with the same definition as t.
+// The clone has no id & no run state
+func (t *Task) Clone() *Task {
+	var params map[string]interface{}
+	if t.Params != nil {
+		params = make(map[string]interface{}, len(t.Params))
+		for key, val := range t.Params {
+			params[key] = val
+		}
+	}
+
+	var notifyEmails []string
+	if t.NotifyEmails != nil {
+		notifyEmails = append([]string{}, t.NotifyEmails...)
+	}
+
+	return &Task{
+		Title:        t.Title,
+		UserId:       t.UserId,
+		Type:         t.Type,
+		Params:       params,
+		NotifyEmails: notifyEmails,
+	}
+}
+
+// Patch applies a JSON object of field changes to t. Only definition fields
+// can be patched, attempts to patch ownership, computed or run-state fields
+// return an error
+func (t *Task) Patch(data []byte) error {
+	fields := map[string]json.RawMessage{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return fmt.Errorf("invalid patch: %s", err.Error())
+	}
+
+	patched := *t
+	for key, val := range fields {
+		var err error
+		switch key {
+		case "title":
+			err = json.Unmarshal(val, &patched.Title)
+		case "type":
+			err = json.Unmarshal(val, &patched.Type)
+		case "params":
+			patched.Params = nil
+			err = json.Unmarshal(val, &patched.Params)
+		case "notifyEmails":
+			patched.NotifyEmails = nil
+			err = json.Unmarshal(val, &patched.NotifyEmails)
+		case "id", "userId", "created", "updated", "status", "error", "enqueued", "started", "succeeded", "failed", "workerId", "definitionHash", "progress", "artifacts":
+			return fmt.Errorf("field '%s' cannot be patched", key)
+		default:
+			return fmt.Errorf("unknown field: '%s'", key)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid value for field '%s': %s", key, err.Error())
+		}
+	}
+
+	*t = patched
+	return nil
+}
+
+// StatusString returns the status of a task based on the state
+// of it's date stamps, & it's error for cancelled tasks
+func (t *Task) StatusString() Status {
+	switch {
+	case t.Succeeded != nil:
+		return StatusFinished
+	case t.Failed != nil && t.Error == CancelledError:
+		return StatusCancelled
+	case t.Failed != nil:
+		return StatusFailed
+	case t.Started != nil:
+		return StatusRunning
+	case t.Enqueued != nil:
+		return StatusQueued
+	default:
+		return StatusReady
 	}
 }
 
@@ -251,9 +474,31 @@ func (t *Task) valid() error {
 		return fmt.Errorf("Invalid task: %s", err.Error())
 	}
 
+	if MaxTitleLength > 0 && utf8.RuneCountInString(t.Title) > MaxTitleLength {
+		return fmt.Errorf("%w: title is longer than %d characters", ErrInvalidTask, MaxTitleLength)
+	}
+	if MaxErrorLength > 0 && utf8.RuneCountInString(t.Error) > MaxErrorLength {
+		return fmt.Errorf("%w: error is longer than %d characters", ErrInvalidTask, MaxErrorLength)
+	}
+	for _, addr := range t.NotifyEmails {
+		if _, err := mail.ParseAddress(addr); err != nil {
+			return fmt.Errorf("%w: invalid notify email '%s'", ErrInvalidTask, addr)
+		}
+	}
+
 	return nil
 }
 
+// SetError sets the task's error message, truncating it to MaxErrorLength.
+// Workers should use SetError to record failures, so an overly long error
+// doesn't keep the task from saving
+func (t *Task) SetError(msg string) {
+	if MaxErrorLength > 0 && utf8.RuneCountInString(msg) > MaxErrorLength {
+		msg = string([]rune(msg)[:MaxErrorLength])
+	}
+	t.Error = msg
+}
+
 func (t *Task) Read(store datastore.Datastore) error {
 	if t.Id == "" {
 		return datastore.ErrNotFound
@@ -276,24 +521,276 @@ func (t *Task) Save(store datastore.Datastore) (err error) {
 	if err := t.valid(); err != nil {
 		return err
 	}
+	t.DefinitionHash = t.definitionHash()
 
 	var exists bool
 	if t.Id != "" {
+		// ids may be supplied by clients, but must be uuids
+		parsed := uuid.Parse(t.Id)
+		if parsed == nil {
+			return fmt.Errorf("invalid task id: '%s' is not a uuid", t.Id)
+		}
+		t.Id = parsed.String()
+
 		exists, err = store.Has(t.Key())
 		if err != nil {
 			return err
 		}
+		if exists && LockFinishedDefinitions {
+			if err := t.checkDefinitionLocked(store); err != nil {
+				return err
+			}
+		}
 	}
 
 	if !exists {
-		t.Id = uuid.New()
+		rawurl, _ := t.Params["url"].(string)
+		t.normalize()
+		t.DefinitionHash = t.definitionHash()
+
+		// use a client-supplied id if one is provided, which lets
+		// clients derive deterministic ids to make retries idempotent
+		id := t.Id
+		if id == "" {
+			id = uuid.New()
+		}
+
+		title := t.Title
+		if title == "" {
+			gen := *t
+			gen.Id = id
+			if title, err = gen.generateTitle(); err != nil {
+				return err
+			}
+		}
+
+		// unique titles are only enforced for non-empty titles
+		if UniqueTitles && title != "" {
+			taken, err := titleExists(store, title)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrConflict
+			}
+		}
+		if UniqueUrls && rawurl != "" {
+			taken, err := urlExists(store, t.Type, rawurl)
+			if err != nil {
+				return err
+			}
+			if taken {
+				return ErrConflict
+			}
+		}
+
+		t.Id = id
+		t.Title = title
 		t.Created = time.Now().Round(time.Second).In(time.UTC)
 		t.Updated = t.Created
 	} else {
 		t.Updated = time.Now().Round(time.Second).In(time.UTC)
 	}
 
-	return store.Put(t.Key(), t)
+	if err := store.Put(t.Key(), t); err != nil {
+		// a concurrent save can insert the same id or title between the
+		// existence checks above & the insert, which the db rejects
+		if isUniqueViolation(err) {
+			return ErrConflict
+		}
+		return err
+	}
+
+	if status := t.StatusString(); status != t.savedStatus {
+		from := t.savedStatus
+		t.savedStatus = status
+		if StatusChanged != nil {
+			StatusChanged(t, from)
+		}
+	}
+	return nil
+}
+
+// checkDefinitionLocked returns ErrNotRunnable if the stored copy of t has
+// finished or failed, & t changes it's definition
+func (t *Task) checkDefinitionLocked(store datastore.Datastore) error {
+	stored := &Task{Id: t.Id}
+	if err := stored.Read(store); err != nil {
+		return err
+	}
+	switch stored.StatusString() {
+	case StatusFinished, StatusFailed, StatusCancelled:
+		if t.DefinitionChanged(stored) {
+			return ErrNotRunnable
+		}
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether err is a postgres unique constraint violation
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+// Create saves t as a new task. t.Id can be set to a client-chosen uuid,
+// in which case Create returns ErrConflict if a task with that id already
+// exists. Save will instead update the existing task
+func (t *Task) Create(store datastore.Datastore) error {
+	if t.Id != "" {
+		// normalize before checking, so other spellings of an existing
+		// id (uppercase, urn:uuid:) still conflict
+		parsed := uuid.Parse(t.Id)
+		if parsed == nil {
+			return fmt.Errorf("invalid task id: '%s' is not a uuid", t.Id)
+		}
+		t.Id = parsed.String()
+		exists, err := store.Has(t.Key())
+		if err != nil {
+			return err
+		}
+		if exists {
+			return ErrConflict
+		}
+	}
+	return t.Save(store)
+}
+
+// generateTitle renders TitleTemplate for the task
+func (t *Task) generateTitle() (string, error) {
+	tmpl, err := template.New("title").Funcs(template.FuncMap{
+		"short": func(s string) string {
+			if len(s) > 7 {
+				return s[:7]
+			}
+			return s
+		},
+	}).Parse(TitleTemplate)
+	if err != nil {
+		return "", fmt.Errorf("invalid title template: %s", err.Error())
+	}
+
+	buf := &bytes.Buffer{}
+	if err := tmpl.Execute(buf, t); err != nil {
+		return "", fmt.Errorf("error generating task title: %s", err.Error())
+	}
+	return buf.String(), nil
+}
+
+// titleExists checks to see if any task in store has the given title
+func titleExists(store datastore.Datastore, title string) (exists bool, err error) {
+	// sql datastores don't support filtered queries, check the db directly
+	if sqlstore, ok := store.(*sql_datastore.Datastore); ok {
+		err = sqlstore.DB.QueryRow(qTaskTitleExists, title).Scan(&exists)
+		return
+	}
+	if sqlstore, ok := store.(SQLStore); ok {
+		err = sqlstore.DB.QueryRow(qTaskTitleExists, title).Scan(&exists)
+		return
+	}
+
+	res, err := store.Query(query.Query{Prefix: fmt.Sprintf("/%s", Task{}.DatastoreType())})
+	if err != nil {
+		return false, err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return false, r.Error
+		}
+		if t, ok := r.Value.(*Task); ok && t.Title == title {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// urlExists checks to see if a task of type taskType that hasn't finished
+// or failed has a "url" param matching rawurl or it's normalized form
+func urlExists(store datastore.Datastore, taskType, rawurl string) (exists bool, err error) {
+	urls := urlVariants(rawurl)
+	if sqlstore, ok := store.(*sql_datastore.Datastore); ok {
+		err = sqlstore.DB.QueryRow(qTaskUrlExists, taskType, pq.Array(urls)).Scan(&exists)
+		return
+	}
+	if sqlstore, ok := store.(SQLStore); ok {
+		err = sqlstore.DB.QueryRow(qTaskUrlExists, taskType, pq.Array(urls)).Scan(&exists)
+		return
+	}
+
+	res, err := store.Query(query.Query{Prefix: fmt.Sprintf("/%s", Task{}.DatastoreType())})
+	if err != nil {
+		return false, err
+	}
+	defer res.Close()
+
+	for r := range res.Next() {
+		if r.Error != nil {
+			return false, r.Error
+		}
+		t, ok := r.Value.(*Task)
+		if !ok || t.Type != taskType || t.Succeeded != nil || t.Failed != nil {
+			continue
+		}
+		for _, u := range urls {
+			if t.Params["url"] == u {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// EnsureUniqueTitleIndex creates or drops the partial index that enforces
+// unique task titles in the database, matching the value of UniqueTitles
+func EnsureUniqueTitleIndex(db sqlutil.Execable) error {
+	if UniqueTitles {
+		_, err := db.Exec(qTaskCreateUniqueTitleIndex)
+		return err
+	}
+	_, err := db.Exec(qTaskDropUniqueTitleIndex)
+	return err
+}
+
+// EnsureIndexes creates indexes that support filtering & sorting task
+// listings, it's safe to call on every startup
+func EnsureIndexes(db sqlutil.Execable) error {
+	_, err := db.Exec(qTaskCreateIndexes)
+	return err
+}
+
+// MigrateNotifyEmails adds the notify_emails column to tasks & tasks_archive
+// tables created before tasks could set their own notification recipients
+func MigrateNotifyEmails(db sqlutil.Execable) error {
+	_, err := db.Exec(qTaskMigrateNotifyEmails)
+	return err
+}
+
+// UpdateRunState writes the run state of t, it's error & date stamps, to db
+// without otherwise saving the task. Use it to change many tasks at once
+// inside a transaction. UpdateRunState doesn't call StatusChanged, callers
+// should report changes once the transaction commits
+func UpdateRunState(db sqlutil.Execable, t *Task) error {
+	if _, err := db.Exec(qTaskUpdateRunState, t.Id, t.Updated, t.Error, t.Enqueued, t.Started, t.Succeeded, t.Failed, t.WorkerId); err != nil {
+		return err
+	}
+	t.savedStatus = t.StatusString()
+	return nil
+}
+
+// MigrateDefinitionHash adds the definition_hash column to tasks &
+// tasks_archive tables created before it existed
+func MigrateDefinitionHash(db sqlutil.Execable) error {
+	_, err := db.Exec(qTaskMigrateDefinitionHash)
+	return err
+}
+
+// MigrateWorkerId adds the worker_id column to tasks tables
+// created before tasks recorded the worker that claimed them
+func MigrateWorkerId(db sqlutil.Execable) error {
+	_, err := db.Exec(qTaskMigrateWorkerId)
+	return err
 }
 
 func (t *Task) Delete(store datastore.Datastore) error {
@@ -328,6 +825,8 @@ func (t *Task) SQLQuery(cmd sql_datastore.Cmd) string {
 func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 	var (
 		id, title, userId, typ, status, e    string
+		workerId, definitionHash             string
+		notifyEmails                         []string
 		paramBytes                           []byte
 		params                               map[string]interface{}
 		created, updated                     time.Time
@@ -335,7 +834,8 @@ func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 	)
 	err := row.Scan(
 		&id, &created, &updated, &title, &userId, &typ, &paramBytes, &status, &e,
-		&enqueued, &started, &succeeded, &failed,
+		&enqueued, &started, &succeeded, &failed, &workerId, pq.Array(&notifyEmails),
+		&definitionHash,
 	)
 	if err == sql.ErrNoRows {
 		return datastore.ErrNotFound
@@ -362,7 +862,14 @@ func (t *Task) UnmarshalSQL(row sqlutil.Scannable) error {
 		Started:   started,
 		Succeeded: succeeded,
 		Failed:    failed,
+		WorkerId:  workerId,
+
+		DefinitionHash: definitionHash,
+	}
+	if len(notifyEmails) > 0 {
+		t.NotifyEmails = notifyEmails
 	}
+	t.savedStatus = t.StatusString()
 
 	return nil
 }
@@ -392,6 +899,9 @@ func (t *Task) SQLParams(cmd sql_datastore.Cmd) []interface{} {
 			t.Started,
 			t.Succeeded,
 			t.Failed,
+			t.WorkerId,
+			pq.Array(t.NotifyEmails),
+			t.DefinitionHash,
 			// t.Progress,
 		}
 	}
@@ -0,0 +1,160 @@
+package tasks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// TimestampRFC3339 formats timestamps as RFC3339 strings
+	TimestampRFC3339 = "rfc3339"
+	// TimestampUnix formats timestamps as seconds since the unix epoch
+	TimestampUnix = "unix"
+)
+
+// TimestampFormat sets how task timestamps are written as JSON, one of
+// TimestampRFC3339 or TimestampUnix. Tasks read timestamps in either format
+var TimestampFormat = TimestampRFC3339
+
+// taskJSON is Task with it's timestamps swapped out for values that
+// marshal according to TimestampFormat
+type taskJSON struct {
+	*taskAlias
+	Created   interface{} `json:"created"`
+	Updated   interface{} `json:"updated"`
+	Enqueued  interface{} `json:"enqueued,omitempty"`
+	Started   interface{} `json:"started,omitempty"`
+	Succeeded interface{} `json:"succeeded,omitempty"`
+	Failed    interface{} `json:"failed,omitempty"`
+}
+
+// taskAlias drops Task's methods to avoid recursive calls to MarshalJSON
+type taskAlias Task
+
+// MarshalJSON implements the json.Marshaler interface, writing
+// timestamps in TimestampFormat
+func (t Task) MarshalJSON() ([]byte, error) {
+	alias := taskAlias(t)
+	return json.Marshal(taskJSON{
+		taskAlias: &alias,
+		Created:   formatTimestamp(&t.Created),
+		Updated:   formatTimestamp(&t.Updated),
+		Enqueued:  formatTimestamp(t.Enqueued),
+		Started:   formatTimestamp(t.Started),
+		Succeeded: formatTimestamp(t.Succeeded),
+		Failed:    formatTimestamp(t.Failed),
+	})
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface, accepting
+// timestamps as either RFC3339 strings or unix seconds
+func (t *Task) UnmarshalJSON(data []byte) error {
+	return t.unmarshalJSON(data, false)
+}
+
+// UnmarshalJSONStrict works like UnmarshalJSON, but errors if data contains
+// fields a task doesn't have. Use it for input from clients, where an unknown
+// field is most likely a mistake. tasks passed between servers stay lenient
+// so servers running different versions can still read each other's tasks
+func (t *Task) UnmarshalJSONStrict(data []byte) error {
+	return t.unmarshalJSON(data, true)
+}
+
+func (t *Task) unmarshalJSON(data []byte, strict bool) error {
+	aux := struct {
+		*taskAlias
+		Created   json.RawMessage `json:"created"`
+		Updated   json.RawMessage `json:"updated"`
+		Enqueued  json.RawMessage `json:"enqueued"`
+		Started   json.RawMessage `json:"started"`
+		Succeeded json.RawMessage `json:"succeeded"`
+		Failed    json.RawMessage `json:"failed"`
+	}{taskAlias: (*taskAlias)(t)}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+
+	for _, f := range []struct {
+		name string
+		raw  json.RawMessage
+		dst  **time.Time
+	}{
+		{"enqueued", aux.Enqueued, &t.Enqueued},
+		{"started", aux.Started, &t.Started},
+		{"succeeded", aux.Succeeded, &t.Succeeded},
+		{"failed", aux.Failed, &t.Failed},
+	} {
+		if f.raw == nil {
+			continue
+		}
+		ts, err := parseTimestamp(f.raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s timestamp: %s", f.name, err.Error())
+		}
+		*f.dst = ts
+	}
+
+	for _, f := range []struct {
+		name string
+		raw  json.RawMessage
+		dst  *time.Time
+	}{
+		{"created", aux.Created, &t.Created},
+		{"updated", aux.Updated, &t.Updated},
+	} {
+		ts, err := parseTimestamp(f.raw)
+		if err != nil {
+			return fmt.Errorf("invalid %s timestamp: %s", f.name, err.Error())
+		}
+		if ts != nil {
+			*f.dst = *ts
+		}
+	}
+
+	return nil
+}
+
+// formatTimestamp converts t to a value that marshals in TimestampFormat,
+// returning nil for nil or zero times
+func formatTimestamp(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	if TimestampFormat == TimestampUnix {
+		if t.IsZero() {
+			return nil
+		}
+		return t.Unix()
+	}
+	return *t
+}
+
+// parseTimestamp reads a JSON RFC3339 string or number of unix seconds,
+// returning nil for empty or null values
+func parseTimestamp(raw json.RawMessage) (*time.Time, error) {
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+
+	if raw[0] == '"' {
+		var t time.Time
+		if err := json.Unmarshal(raw, &t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	}
+
+	secs, err := strconv.ParseInt(string(raw), 10, 64)
+	if err != nil {
+		return nil, err
+	}
+	t := time.Unix(secs, 0).In(time.UTC)
+	return &t, nil
+}
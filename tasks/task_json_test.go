@@ -0,0 +1,83 @@
+package tasks
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTaskJSONTimestamps(t *testing.T) {
+	prev := TimestampFormat
+	defer func() { TimestampFormat = prev }()
+
+	created := time.Date(2017, 1, 1, 0, 0, 1, 0, time.UTC)
+	started := created.Add(time.Minute)
+	task := &Task{Id: "id", Created: created, Updated: created, Started: &started, Type: "test"}
+
+	cases := []struct {
+		format, expect string
+	}{
+		{TimestampRFC3339, `"created":"2017-01-01T00:00:01Z"`},
+		{TimestampUnix, `"created":1483228801`},
+	}
+
+	for _, c := range cases {
+		TimestampFormat = c.format
+		data, err := json.Marshal(task)
+		if err != nil {
+			t.Errorf("%s: %s", c.format, err.Error())
+			continue
+		}
+		if !strings.Contains(string(data), c.expect) {
+			t.Errorf("%s: expected json to contain %s, got: %s", c.format, c.expect, string(data))
+		}
+		if strings.Contains(string(data), `"enqueued"`) {
+			t.Errorf("%s: expected nil timestamps to be omitted, got: %s", c.format, string(data))
+		}
+
+		got := &Task{}
+		if err := json.Unmarshal(data, got); err != nil {
+			t.Errorf("%s: %s", c.format, err.Error())
+			continue
+		}
+		if err := CompareTasks(task, got); err != nil {
+			t.Errorf("%s: round trip mismatch: %s", c.format, err.Error())
+		}
+		if got.Started == nil || !got.Started.Equal(started) || got.Enqueued != nil {
+			t.Errorf("%s: expected started to round trip & enqueued to be nil. started: %v, enqueued: %v", c.format, got.Started, got.Enqueued)
+		}
+		if got.Type != "test" {
+			t.Errorf("%s: expected non-timestamp fields to round trip, got type: %s", c.format, got.Type)
+		}
+	}
+
+	got := &Task{}
+	if err := json.Unmarshal([]byte(`{ "created" : "yesterday" }`), got); err == nil {
+		t.Errorf("expected invalid timestamp to error")
+	}
+}
+
+func TestTaskUnmarshalJSONStrict(t *testing.T) {
+	data := []byte(`{"type":"test","params":{"url":"http://example.com"},"created":1483228801,"priority":1}`)
+
+	lenient := &Task{}
+	if err := json.Unmarshal(data, lenient); err != nil {
+		t.Errorf("expected lenient unmarshal to ignore unknown fields, got: %s", err.Error())
+	}
+
+	strict := &Task{}
+	err := strict.UnmarshalJSONStrict(data)
+	if err == nil || !strings.Contains(err.Error(), `unknown field "priority"`) {
+		t.Errorf("expected strict unmarshal to reject unknown field, got: %v", err)
+	}
+
+	known := &Task{}
+	if err := known.UnmarshalJSONStrict([]byte(`{"type":"test","created":1483228801}`)); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if known.Type != "test" || known.Created.Unix() != 1483228801 {
+		t.Errorf("expected strict unmarshal to read fields, got type: %s, created: %s", known.Type, known.Created)
+	}
+}
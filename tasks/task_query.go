@@ -0,0 +1,259 @@
+package tasks
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/datatogether/sqlutil"
+	"github.com/lib/pq"
+)
+
+// taskStatusConditions maps status names to the SQL condition that
+// selects tasks in that status, based on the state of it's date stamps & error
+var taskStatusConditions = map[Status]string{
+	StatusReady:     "enqueued IS NULL AND started IS NULL AND succeeded IS NULL AND failed IS NULL",
+	StatusQueued:    "enqueued IS NOT NULL AND started IS NULL AND succeeded IS NULL AND failed IS NULL",
+	StatusRunning:   "started IS NOT NULL AND succeeded IS NULL AND failed IS NULL",
+	StatusFinished:  "succeeded IS NOT NULL",
+	StatusFailed:    "failed IS NOT NULL AND error IS DISTINCT FROM '" + CancelledError + "'",
+	StatusCancelled: "failed IS NOT NULL AND error = '" + CancelledError + "'",
+}
+
+// taskSortColumns is a whitelist of columns tasks can be ordered by
+var taskSortColumns = map[string]bool{
+	"created": true,
+	"updated": true,
+	"title":   true,
+	"type":    true,
+	"user_id": true,
+}
+
+// TaskQuery describes a filtered, sorted & paginated listing of tasks.
+// zero-value fields are ignored
+type TaskQuery struct {
+	// only return tasks with this status, eg: StatusRunning
+	Status Status
+	// only return tasks of this type
+	Type string
+	// only return tasks submitted by this user
+	UserId string
+	// only return tasks whose "url" param matches this source url
+	SourceUrl string
+	// match tasks with urls that start with SourceUrl instead of exact matches
+	SourceUrlPrefix bool
+	// only return tasks created at or after this time
+	CreatedAfter *time.Time
+	// only return tasks created before this time
+	CreatedBefore *time.Time
+	// column & direction to sort by, eg: "created DESC"
+	OrderBy string
+	Limit   int
+	Offset  int
+}
+
+// SQL generates a parameterized select statement & it's arguments for the query.
+// Values are always passed as bindvars, statuses & sort columns must be
+// whitelisted values, returning an error otherwise
+func (q TaskQuery) SQL() (string, []interface{}, error) {
+	where, args, err := q.where()
+	if err != nil {
+		return "", nil, err
+	}
+
+	orderBy, err := q.orderBy()
+	if err != nil {
+		return "", nil, err
+	}
+
+	query := qTaskSelect + where
+	query += "\nORDER BY " + orderBy
+
+	if q.Limit > 0 {
+		args = append(args, q.Limit)
+		query += fmt.Sprintf("\nLIMIT $%d", len(args))
+	}
+	if q.Offset > 0 {
+		args = append(args, q.Offset)
+		query += fmt.Sprintf(" OFFSET $%d", len(args))
+	}
+
+	return query + ";", args, nil
+}
+
+// LastUpdatedSQL generates a statement & it's arguments that selects the
+// latest updated time of all tasks matching the query, ignoring pagination
+func (q TaskQuery) LastUpdatedSQL() (string, []interface{}, error) {
+	where, args, err := q.where()
+	if err != nil {
+		return "", nil, err
+	}
+	return qTaskSelectLastUpdated + where + ";", args, nil
+}
+
+// where generates the WHERE clause for the query's filters, returning an
+// empty string if the query has no filters
+func (q TaskQuery) where() (string, []interface{}, error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	bind := func(condition string, arg interface{}) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(condition, len(args)))
+	}
+
+	if q.Status != "" {
+		cond, ok := taskStatusConditions[q.Status.Canonical()]
+		if !ok {
+			return "", nil, fmt.Errorf("invalid task status: '%s'", q.Status)
+		}
+		conditions = append(conditions, fmt.Sprintf("(%s)", cond))
+	}
+	if q.Type != "" {
+		bind("type = $%d", q.Type)
+	}
+	if q.UserId != "" {
+		bind("user_id = $%d", q.UserId)
+	}
+	if q.SourceUrl != "" {
+		if q.SourceUrlPrefix {
+			bind(`params->>'url' LIKE $%d`, escapeLike(q.SourceUrl)+"%")
+		} else {
+			// match both the given & normalized spellings, so tasks saved
+			// before url normalization was enabled are still found
+			if urls := urlVariants(q.SourceUrl); len(urls) > 1 {
+				bind(`params->>'url' = ANY($%d)`, pq.Array(urls))
+			} else {
+				bind(`params->>'url' = $%d`, q.SourceUrl)
+			}
+		}
+	}
+	if q.CreatedAfter != nil {
+		bind("created >= $%d", *q.CreatedAfter)
+	}
+	if q.CreatedBefore != nil {
+		bind("created < $%d", *q.CreatedBefore)
+	}
+
+	if len(conditions) == 0 {
+		return "", args, nil
+	}
+	return "\nWHERE " + strings.Join(conditions, " AND "), args, nil
+}
+
+// orderBy validates & normalizes the query's OrderBy, defaulting to "created DESC".
+// id is always added as a tiebreaker so pages of tasks with equal sort values
+// come back in a stable order
+func (q TaskQuery) orderBy() (string, error) {
+	if q.OrderBy == "" {
+		return "created DESC, id DESC", nil
+	}
+
+	fields := strings.Fields(q.OrderBy)
+	if len(fields) > 2 || !taskSortColumns[strings.ToLower(fields[0])] {
+		return "", fmt.Errorf("invalid task ordering: '%s'", q.OrderBy)
+	}
+
+	dir := "ASC"
+	if len(fields) == 2 {
+		dir = strings.ToUpper(fields[1])
+		if dir != "ASC" && dir != "DESC" {
+			return "", fmt.Errorf("invalid task ordering: '%s'", q.OrderBy)
+		}
+	}
+
+	return fmt.Sprintf("%s %s, id %s", strings.ToLower(fields[0]), dir, dir), nil
+}
+
+// LastUpdated reads the latest updated time of all tasks matching q from db,
+// returning nil if no tasks match
+func LastUpdated(db sqlutil.Queryable, q TaskQuery) (*time.Time, error) {
+	query, args, err := q.LastUpdatedSQL()
+	if err != nil {
+		return nil, err
+	}
+
+	var updated *time.Time
+	if err := db.QueryRow(query, args...).Scan(&updated); err != nil {
+		return nil, err
+	}
+	return updated, nil
+}
+
+// CountTasks reads the number of tasks in each status from db
+func CountTasks(db sqlutil.Queryable) (map[Status]int, error) {
+	columns := make([]string, len(Statuses))
+	for i, status := range Statuses {
+		columns[i] = fmt.Sprintf("count(1) FILTER (WHERE %s)", taskStatusConditions[status])
+	}
+
+	counts := make([]int, len(Statuses))
+	dest := make([]interface{}, len(Statuses))
+	for i := range counts {
+		dest[i] = &counts[i]
+	}
+	if err := db.QueryRow(fmt.Sprintf("SELECT %s FROM tasks;", strings.Join(columns, ", "))).Scan(dest...); err != nil {
+		return nil, err
+	}
+
+	res := map[Status]int{}
+	for i, status := range Statuses {
+		res[status] = counts[i]
+	}
+	return res, nil
+}
+
+// CountReadyTasks reads the number of tasks owned by userId that haven't
+// started yet
+func CountReadyTasks(db sqlutil.Queryable, userId string) (count int, err error) {
+	err = db.QueryRow(qTaskCountReady, userId).Scan(&count)
+	return
+}
+
+// escapeLike escapes LIKE pattern characters in s so it matches literally
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
+
+// QueryTasks reads tasks matching q from db
+func QueryTasks(db sqlutil.Queryable, q TaskQuery) ([]*Task, error) {
+	query, args, err := q.SQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalTasks(rows, q.Limit)
+}
+
+// QueryTasksForUpdate reads tasks matching q from db like QueryTasks, locking
+// the matching rows until db's transaction ends
+func QueryTasksForUpdate(db sqlutil.Queryable, q TaskQuery) ([]*Task, error) {
+	query, args, err := q.SQL()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(strings.TrimSuffix(query, ";")+"\nFOR UPDATE;", args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return unmarshalTasks(rows, q.Limit)
+}
+
+// ReadTaskForUpdate reads the task with id from db, locking it's row until
+// db's transaction ends
+func ReadTaskForUpdate(db sqlutil.Queryable, id string) (*Task, error) {
+	t := &Task{}
+	if err := t.UnmarshalSQL(db.QueryRow(strings.TrimSuffix(qTaskReadById, ";")+"\nFOR UPDATE;", id)); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
@@ -0,0 +1,120 @@
+package tasks
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+func TestTaskQuerySQL(t *testing.T) {
+	after := time.Date(2017, 1, 1, 0, 0, 0, 0, time.UTC)
+	cases := []struct {
+		q     TaskQuery
+		where string
+		order string
+		args  int
+		err   bool
+	}{
+		{TaskQuery{}, "", "ORDER BY created DESC, id DESC", 0, false},
+		{TaskQuery{Limit: 10, Offset: 20}, "", "ORDER BY created DESC, id DESC\nLIMIT $1 OFFSET $2", 2, false},
+		{TaskQuery{Status: StatusRunning}, "WHERE (" + taskStatusConditions[StatusRunning] + ")", "ORDER BY created DESC, id DESC", 0, false},
+		{TaskQuery{Status: StatusCancelled}, "WHERE (" + taskStatusConditions[StatusCancelled] + ")", "ORDER BY created DESC, id DESC", 0, false},
+		{TaskQuery{Status: "enquing"}, "WHERE (" + taskStatusConditions[StatusReady] + ")", "ORDER BY created DESC, id DESC", 0, false},
+		{TaskQuery{Type: "ipfs.addurl", UserId: "user"}, "WHERE type = $1 AND user_id = $2", "ORDER BY created DESC, id DESC", 2, false},
+		{TaskQuery{Status: StatusFailed, Type: "ipfs.addurl", CreatedAfter: &after, OrderBy: "updated asc", Limit: 5},
+			"WHERE (" + taskStatusConditions[StatusFailed] + ") AND type = $1 AND created >= $2", "ORDER BY updated ASC, id ASC\nLIMIT $3", 3, false},
+		{TaskQuery{SourceUrl: "http://example.com/a"}, "WHERE params->>'url' = $1", "ORDER BY created DESC, id DESC", 1, false},
+		{TaskQuery{SourceUrl: "http://example.com/", SourceUrlPrefix: true, Type: "ipfs.addurl"},
+			"WHERE type = $1 AND params->>'url' LIKE $2", "ORDER BY created DESC, id DESC", 2, false},
+		{TaskQuery{Status: "running; DROP TABLE tasks"}, "", "", 0, true},
+		{TaskQuery{OrderBy: "params"}, "", "", 0, true},
+		{TaskQuery{OrderBy: "created; DROP TABLE tasks"}, "", "", 0, true},
+		{TaskQuery{OrderBy: "created sideways"}, "", "", 0, true},
+	}
+
+	for i, c := range cases {
+		query, args, err := c.q.SQL()
+		if c.err != (err != nil) {
+			t.Errorf("case %d error mismatch. expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if c.err {
+			continue
+		}
+
+		expect := qTaskSelect
+		if c.where != "" {
+			expect += "\n" + c.where
+		}
+		expect += "\n" + c.order + ";"
+		if query != expect {
+			t.Errorf("case %d query mismatch. expected:\n%s\ngot:\n%s", i, expect, query)
+		}
+		if len(args) != c.args {
+			t.Errorf("case %d args length mismatch. expected: %d, got: %d", i, c.args, len(args))
+		}
+	}
+}
+
+func TestTaskQueryNormalizedSourceUrl(t *testing.T) {
+	defer func() { NormalizeUrls = false }()
+	NormalizeUrls = true
+
+	query, args, err := TaskQuery{SourceUrl: "HTTP://Example.com/a"}.SQL()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(query, "WHERE params->>'url' = ANY($1)") {
+		t.Errorf("expected query to match any url spelling, got:\n%s", query)
+	}
+	urls, ok := args[0].(*pq.StringArray)
+	if !ok || len(*urls) != 2 || (*urls)[0] != "HTTP://Example.com/a" || (*urls)[1] != "http://example.com/a" {
+		t.Errorf("expected given & normalized urls, got: %#v", args[0])
+	}
+
+	// already normalized urls have nothing else to match
+	query, _, err = TaskQuery{SourceUrl: "http://example.com/a"}.SQL()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if !strings.Contains(query, "WHERE params->>'url' = $1") {
+		t.Errorf("expected exact match for a normalized url, got:\n%s", query)
+	}
+}
+
+func TestTaskQuerySourceUrlArgs(t *testing.T) {
+	_, args, err := TaskQuery{SourceUrl: "http://example.com/a"}.SQL()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if args[0] != "http://example.com/a" {
+		t.Errorf("expected exact match arg to be the url, got: %v", args[0])
+	}
+
+	_, args, err = TaskQuery{SourceUrl: "http://example.com/100%_done", SourceUrlPrefix: true}.SQL()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect := `http://example.com/100\%\_done%`; args[0] != expect {
+		t.Errorf("expected prefix match arg to be %s, got: %v", expect, args[0])
+	}
+}
+
+func TestTaskQueryLastUpdatedSQL(t *testing.T) {
+	query, args, err := TaskQuery{Type: "ipfs.addurl", Limit: 10, Offset: 20, OrderBy: "title"}.LastUpdatedSQL()
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if expect := qTaskSelectLastUpdated + "\nWHERE type = $1;"; query != expect {
+		t.Errorf("query mismatch. expected:\n%s\ngot:\n%s", expect, query)
+	}
+	if len(args) != 1 {
+		t.Errorf("expected pagination to be ignored, got args: %v", args)
+	}
+
+	if _, _, err := (TaskQuery{Status: "sideways"}).LastUpdatedSQL(); err == nil {
+		t.Errorf("expected invalid status to error")
+	}
+}
@@ -1,9 +1,14 @@
 package tasks
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
-	// "github.com/ipfs/go-datastore"
-	// "testing"
+	"github.com/ipfs/go-datastore"
+	"github.com/lib/pq"
+	"strings"
+	"testing"
+	"time"
 )
 
 type ExampleTask struct {
@@ -112,6 +117,543 @@ func (e ExampleTask) Do(updates chan Progress) {
 // 	}
 // }
 
+func TestTaskClone(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	now := time.Now()
+	task := &Task{
+		Title:     "test",
+		UserId:    "test_user",
+		Type:      "test",
+		Params:    map[string]interface{}{"a": "b"},
+		Enqueued:  &now,
+		Started:   &now,
+		Succeeded: &now,
+	}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	clone := task.Clone()
+	if err := clone.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	if clone.Id == "" || clone.Id == task.Id {
+		t.Errorf("expected clone to have a new id. original: %s, clone: %s", task.Id, clone.Id)
+	}
+	if clone.Title != task.Title || clone.UserId != task.UserId || clone.Type != task.Type {
+		t.Errorf("expected clone to share definition fields")
+	}
+	if clone.Params["a"] != "b" {
+		t.Errorf("expected clone to share params")
+	}
+	if clone.Enqueued != nil || clone.Started != nil || clone.Succeeded != nil || clone.Failed != nil {
+		t.Errorf("expected clone timestamps to be empty")
+	}
+
+	clone.Params["a"] = "c"
+	if task.Params["a"] != "b" {
+		t.Errorf("modifying clone params shouldn't affect original")
+	}
+}
+
+func TestTaskPatch(t *testing.T) {
+	now := time.Now()
+	task := &Task{
+		Id:      "id",
+		Title:   "test",
+		UserId:  "test_user",
+		Type:    "test",
+		Params:  map[string]interface{}{"a": "b"},
+		Started: &now,
+	}
+
+	if err := task.Patch([]byte(`{ "title" : "patched" }`)); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if task.Title != "patched" {
+		t.Errorf("expected title to be patched, got: %s", task.Title)
+	}
+	if task.Id != "id" || task.UserId != "test_user" || task.Type != "test" || task.Params["a"] != "b" || task.Started != &now {
+		t.Errorf("expected unpatched fields to be untouched")
+	}
+
+	bad := []string{
+		`{ "started" : null }`,
+		`{ "id" : "new_id" }`,
+		`{ "userId" : "someone_else" }`,
+		`{ "title" : "nope", "succeeded" : "2017-01-01T00:00:00Z" }`,
+		`{ "unknown" : true }`,
+		`{ "title" : 5 }`,
+		`not json`,
+	}
+	for i, patch := range bad {
+		if err := task.Patch([]byte(patch)); err == nil {
+			t.Errorf("case %d: expected patch to error", i)
+		}
+	}
+	if task.Title != "patched" || task.UserId != "test_user" || task.Started != &now {
+		t.Errorf("expected rejected patches to leave task untouched")
+	}
+}
+
+func TestTaskUniqueTitles(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	defer func() { UniqueTitles = false }()
+
+	for _, unique := range []bool{true, false} {
+		UniqueTitles = unique
+		store := datastore.NewMapDatastore()
+
+		a := &Task{Title: "duplicate", Type: "test"}
+		if err := a.Save(store); err != nil {
+			t.Error(err.Error())
+			return
+		}
+		// updating an existing task shouldn't conflict with itself
+		if err := a.Save(store); err != nil {
+			t.Errorf("unique: %t. unexpected error updating task: %s", unique, err.Error())
+		}
+
+		b := &Task{Title: "duplicate", Type: "test"}
+		err := b.Save(store)
+		if unique && err != ErrConflict {
+			t.Errorf("expected duplicate title to return ErrConflict, got: %v", err)
+		} else if !unique && err != nil {
+			t.Errorf("expected duplicate title to be allowed, got: %s", err.Error())
+		}
+	}
+}
+
+func TestTaskUniqueTitlesEmpty(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	prevTemplate := TitleTemplate
+	defer func() { UniqueTitles, TitleTemplate = false, prevTemplate }()
+	// a template that renders nothing leaves generated titles empty
+	UniqueTitles, TitleTemplate = true, ""
+
+	store := datastore.NewMapDatastore()
+	for i := 0; i < 2; i++ {
+		task := &Task{Type: "test"}
+		if err := task.Save(store); err != nil {
+			t.Errorf("task %d: expected empty titles not to conflict, got: %s", i, err)
+		}
+	}
+}
+
+func TestTaskLockFinishedDefinitions(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	RegisterTaskdef("test.other", NewExampleTask)
+	defer func() { LockFinishedDefinitions = false }()
+	now := time.Now()
+
+	cases := []struct {
+		description string
+		lock        bool
+		stored      Task
+		edit        func(t *Task)
+		expect      error
+	}{
+		{"params of a finished task", true, Task{Succeeded: &now}, func(t *Task) { t.Params = map[string]interface{}{"a": "changed"} }, ErrNotRunnable},
+		{"type of a failed task", true, Task{Failed: &now}, func(t *Task) { t.Type = "test.other" }, ErrNotRunnable},
+		{"title of a finished task", true, Task{Succeeded: &now}, func(t *Task) { t.Title = "renamed" }, nil},
+		{"run state of a finished task", true, Task{Succeeded: &now}, func(t *Task) { t.Progress = &Progress{Done: true} }, nil},
+		{"retrying a failed task", true, Task{Failed: &now, Error: "boom"}, func(t *Task) { t.Retry() }, nil},
+		{"params of a running task", true, Task{Started: &now}, func(t *Task) { t.Params = map[string]interface{}{"a": "changed"} }, nil},
+		{"finishing a running task", true, Task{Started: &now}, func(t *Task) { t.Succeeded = &now }, nil},
+		{"params of a finished task, unlocked", false, Task{Succeeded: &now}, func(t *Task) { t.Params = map[string]interface{}{"a": "changed"} }, nil},
+	}
+
+	for i, c := range cases {
+		LockFinishedDefinitions = c.lock
+		store := datastore.NewMapDatastore()
+		stored := c.stored
+		stored.Type = "test"
+		stored.Enqueued = &now
+		stored.Params = map[string]interface{}{"a": "original"}
+		if err := stored.Save(store); err != nil {
+			t.Fatal(err.Error())
+		}
+
+		edit := &Task{Id: stored.Id}
+		if err := edit.Read(store); err != nil {
+			t.Fatal(err.Error())
+		}
+		c.edit(edit)
+		if err := edit.Save(store); err != c.expect {
+			t.Errorf("case %d %s: expected error: %v, got: %v", i, c.description, c.expect, err)
+		}
+	}
+}
+
+func TestTaskGeneratedTitle(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if expect := fmt.Sprintf("test @ %s", task.Id[:7]); task.Title != expect {
+		t.Errorf("generated title mismatch. expected: %s, got: %s", expect, task.Title)
+	}
+
+	task = &Task{Title: "provided", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if task.Title != "provided" {
+		t.Errorf("expected provided title to be preserved, got: %s", task.Title)
+	}
+
+	prev := TitleTemplate
+	defer func() { TitleTemplate = prev }()
+	TitleTemplate = `add {{index .Params "url"}}`
+	task = &Task{Type: "test", Params: map[string]interface{}{"url": "http://a.com"}}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if task.Title != "add http://a.com" {
+		t.Errorf("generated title mismatch. expected: %s, got: %s", "add http://a.com", task.Title)
+	}
+}
+
+func TestTaskClaim(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Title: "claim me", Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	task.Claim("worker-1")
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	read := &Task{Id: task.Id}
+	if err := read.Read(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if read.WorkerId != "worker-1" {
+		t.Errorf("worker id mismatch. expected: %s, got: %s", "worker-1", read.WorkerId)
+	}
+	if read.Started == nil {
+		t.Errorf("expected claimed task to have a started timestamp")
+	}
+
+	data, err := json.Marshal(read)
+	if err != nil {
+		t.Error(err.Error())
+		return
+	}
+	fields := map[string]interface{}{}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if fields["workerId"] != "worker-1" {
+		t.Errorf("expected json to contain workerId, got: %s", string(data))
+	}
+}
+
+func TestTaskCreate(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	generated := &Task{Type: "test"}
+	if err := generated.Create(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if generated.Id == "" {
+		t.Errorf("expected task without an id to have one generated")
+	}
+
+	id := "b9d4f6e0-1a2b-4c3d-8e9f-0a1b2c3d4e5f"
+	supplied := &Task{Id: id, Type: "test"}
+	if err := supplied.Create(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if supplied.Id != id {
+		t.Errorf("expected client-supplied id to be kept. expected: %s, got: %s", id, supplied.Id)
+	}
+	read := &Task{Id: id}
+	if err := read.Read(store); err != nil {
+		t.Errorf("error reading task with client-supplied id: %s", err.Error())
+	}
+
+	if err := (&Task{Id: id, Type: "test"}).Create(store); err != ErrConflict {
+		t.Errorf("expected creating a task with a taken id to return ErrConflict, got: %v", err)
+	}
+	for _, variant := range []string{strings.ToUpper(id), "urn:uuid:" + id} {
+		if err := (&Task{Id: variant, Type: "test", Title: "overwrite"}).Create(store); err != ErrConflict {
+			t.Errorf("expected creating a task with taken id variant %s to return ErrConflict, got: %v", variant, err)
+		}
+	}
+	if err := read.Read(store); err != nil || read.Title == "overwrite" {
+		t.Errorf("expected existing task to be left as-is, got: %v %+v", err, read)
+	}
+	if err := (&Task{Id: "not-a-uuid", Type: "test"}).Create(store); err == nil {
+		t.Errorf("expected creating a task with a malformed id to error")
+	}
+}
+
+// racingStore simulates another save inserting the same task between
+// Save's existence check & its insert by failing every Put with err
+type racingStore struct {
+	datastore.Datastore
+	err error
+}
+
+func (s racingStore) Put(key datastore.Key, value interface{}) error {
+	return s.err
+}
+
+func TestTaskSaveUniqueViolation(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+
+	store := racingStore{datastore.NewMapDatastore(), &pq.Error{Code: "23505", Message: "duplicate key value violates unique constraint"}}
+	if err := (&Task{Type: "test"}).Save(store); err != ErrConflict {
+		t.Errorf("expected unique violation to return ErrConflict, got: %v", err)
+	}
+	if err := (&Task{Id: "b9d4f6e0-1a2b-4c3d-8e9f-0a1b2c3d4e5f", Type: "test"}).Create(store); err != ErrConflict {
+		t.Errorf("expected unique violation on create to return ErrConflict, got: %v", err)
+	}
+
+	other := &pq.Error{Code: "23502", Message: "null value violates not-null constraint"}
+	if err := (&Task{Type: "test"}).Save(racingStore{datastore.NewMapDatastore(), other}); err != other {
+		t.Errorf("expected other db errors to be returned as-is, got: %v", err)
+	}
+}
+
+func TestTaskNotifyEmails(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	task := &Task{Type: "test", NotifyEmails: []string{"team@example.com"}}
+	if err := task.Save(store); err != nil {
+		t.Error(err.Error())
+		return
+	}
+
+	clone := task.Clone()
+	if len(clone.NotifyEmails) != 1 || clone.NotifyEmails[0] != "team@example.com" {
+		t.Errorf("expected clone to share notify emails, got: %v", clone.NotifyEmails)
+	}
+	clone.NotifyEmails[0] = "other@example.com"
+	if task.NotifyEmails[0] != "team@example.com" {
+		t.Errorf("modifying clone notify emails shouldn't affect original")
+	}
+
+	if err := task.Patch([]byte(`{"notifyEmails":["a@example.com","b@example.com"]}`)); err != nil {
+		t.Error(err.Error())
+		return
+	}
+	if len(task.NotifyEmails) != 2 {
+		t.Errorf("expected patch to replace notify emails, got: %v", task.NotifyEmails)
+	}
+
+	task.NotifyEmails = []string{"not an email"}
+	if err := task.Save(store); !errors.Is(err, ErrInvalidTask) {
+		t.Errorf("expected invalid notify email to return ErrInvalidTask, got: %v", err)
+	}
+}
+
+func TestTaskMaxLengths(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	prevTitle, prevError := MaxTitleLength, MaxErrorLength
+	defer func() { MaxTitleLength, MaxErrorLength = prevTitle, prevError }()
+	MaxTitleLength, MaxErrorLength = 5, 5
+
+	cases := []struct {
+		title, err string
+		invalid    bool
+	}{
+		{"short", "", false},
+		{"héllo", "éeeee", false},
+		{"too long", "", true},
+		{"ok", "too long", true},
+	}
+	for i, c := range cases {
+		err := (&Task{Title: c.title, Error: c.err, Type: "test"}).Save(store)
+		if c.invalid != errors.Is(err, ErrInvalidTask) {
+			t.Errorf("case %d: expected invalid: %t, got error: %v", i, c.invalid, err)
+		}
+	}
+
+	task := &Task{Type: "test"}
+	task.SetError("élan vital")
+	if task.Error != "élan " {
+		t.Errorf("expected error to be truncated to %d characters, got: '%s'", MaxErrorLength, task.Error)
+	}
+	if err := task.Save(store); err != nil {
+		t.Errorf("expected task with truncated error to save, got: %s", err.Error())
+	}
+
+	MaxErrorLength = 0
+	task.SetError("no limit at all")
+	if task.Error != "no limit at all" {
+		t.Errorf("expected error not to be truncated without a limit, got: '%s'", task.Error)
+	}
+}
+
+func TestTaskRetry(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		task   *Task
+		expect error
+	}{
+		{&Task{Enqueued: &now, Started: &now, Failed: &now, Error: "boom", WorkerId: "w"}, nil},
+		{&Task{Enqueued: &now}, ErrConflict},
+		{&Task{Enqueued: &now, Started: &now}, ErrConflict},
+		{&Task{Enqueued: &now, Started: &now, Succeeded: &now}, ErrInvalidTask},
+	}
+
+	for i, c := range cases {
+		err := c.task.Retry()
+		if !errors.Is(err, c.expect) {
+			t.Errorf("case %d: expected error: %v, got: %v", i, c.expect, err)
+			continue
+		}
+		if err == nil {
+			if c.task.Failed != nil || c.task.Started != nil || c.task.Enqueued != nil || c.task.Error != "" || c.task.WorkerId != "" {
+				t.Errorf("case %d: expected retried task run state to be reset", i)
+			}
+		}
+	}
+}
+
+func TestTaskStatusChanged(t *testing.T) {
+	RegisterTaskdef("test", NewExampleTask)
+	store := datastore.NewMapDatastore()
+
+	type change struct{ from, to Status }
+	changes := []change{}
+	StatusChanged = func(t *Task, from Status) {
+		changes = append(changes, change{from, t.StatusString()})
+	}
+	defer func() { StatusChanged = nil }()
+
+	task := &Task{Type: "test"}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	// saving without changing status isn't a change
+	task.Title = "renamed"
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	now := time.Now()
+	task.Enqueued = &now
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	read := &Task{Id: task.Id}
+	if err := read.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	read.Claim("worker")
+	if err := read.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	expect := []change{{"", StatusReady}, {StatusReady, StatusQueued}, {StatusQueued, StatusRunning}}
+	if len(changes) != len(expect) {
+		t.Fatalf("expected %d status changes, got: %v", len(expect), changes)
+	}
+	for i, c := range expect {
+		if changes[i] != c {
+			t.Errorf("change %d: expected %v, got: %v", i, c, changes[i])
+		}
+	}
+}
+
+func TestTaskSetStatus(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		task   *Task
+		status Status
+		expect error
+	}{
+		{&Task{Enqueued: &now}, StatusFailed, nil},
+		{&Task{Enqueued: &now, Started: &now}, StatusFailed, nil},
+		{&Task{Enqueued: &now, Started: &now, Succeeded: &now}, StatusFailed, nil},
+		{&Task{Enqueued: &now, Started: &now}, StatusFinished, nil},
+		{&Task{Enqueued: &now, Started: &now, Failed: &now, Error: "boom"}, StatusFinished, nil},
+		{&Task{Enqueued: &now, Started: &now, Failed: &now}, StatusFailed, ErrInvalidTask},
+		{&Task{Enqueued: &now, Started: &now, Succeeded: &now}, StatusFinished, ErrInvalidTask},
+		{&Task{Enqueued: &now, Started: &now, Failed: &now}, StatusQueued, ErrInvalidTask},
+		{&Task{Enqueued: &now}, StatusRunning, ErrInvalidTask},
+	}
+
+	for i, c := range cases {
+		err := c.task.SetStatus(c.status, "bad data")
+		if !errors.Is(err, c.expect) {
+			t.Errorf("case %d: expected error: %v, got: %v", i, c.expect, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if got := c.task.StatusString(); got != c.status {
+			t.Errorf("case %d: expected status %s, got: %s", i, c.status, got)
+		}
+		expectErr := ""
+		if c.status == StatusFailed {
+			expectErr = "bad data"
+		}
+		if c.task.Error != expectErr {
+			t.Errorf("case %d: expected error message '%s', got: '%s'", i, expectErr, c.task.Error)
+		}
+	}
+}
+
+func TestTaskCancel(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		task   *Task
+		expect error
+	}{
+		{&Task{Enqueued: &now}, nil},
+		{&Task{Enqueued: &now, Started: &now, WorkerId: "w"}, nil},
+		{&Task{Enqueued: &now, Started: &now, Failed: &now, Error: "boom"}, ErrConflict},
+		{&Task{Enqueued: &now, Started: &now, Succeeded: &now}, ErrConflict},
+	}
+
+	for i, c := range cases {
+		err := c.task.Cancel()
+		if err != c.expect {
+			t.Errorf("case %d: expected error: %v, got: %v", i, c.expect, err)
+			continue
+		}
+		if err == nil {
+			if c.task.Failed == nil || c.task.Error != CancelledError {
+				t.Errorf("case %d: expected cancelled task to fail with error '%s', got: '%s'", i, CancelledError, c.task.Error)
+			}
+			if c.task.StatusString() != StatusCancelled {
+				t.Errorf("case %d: expected status %s, got: %s", i, StatusCancelled, c.task.StatusString())
+			}
+		}
+	}
+}
+
 func CompareTasks(a, b *Task) error {
 	if a.Id != b.Id {
 		return fmt.Errorf("Id mismatch: %s != %s", a.Id, b.Id)
@@ -82,17 +82,14 @@ func ReadTasks(store datastore.Datastore, orderby string, limit, offset int) ([]
 
 func unmarshalTasks(rows *sql.Rows, limit int) ([]*Task, error) {
 	defer rows.Close()
-	tasks := make([]*Task, limit)
-	i := 0
+	tasks := make([]*Task, 0, limit)
 	for rows.Next() {
 		t := &Task{}
 		if err := t.UnmarshalSQL(rows); err != nil {
 			return nil, err
 		}
-		tasks[i] = t
-		i++
+		tasks = append(tasks, t)
 	}
 
-	tasks = tasks[:i]
-	return tasks, nil
+	return tasks, rows.Err()
 }
@@ -5,13 +5,14 @@ import (
 	"fmt"
 	"net"
 	"net/http"
+	"strings"
 	"time"
 
 	"golang.org/x/crypto/acme/autocert"
 )
 
 func StartServer(c *config, s *http.Server) error {
-	s.Addr = fmt.Sprintf(fmt.Sprintf(":%s", c.Port))
+	s.Addr = net.JoinHostPort(c.ListenAddr, c.Port)
 
 	if !c.TLS {
 		return s.ListenAndServe()
@@ -23,26 +24,100 @@ func StartServer(c *config, s *http.Server) error {
 	// LetsEncrypt is good. Thanks LetsEncrypt.
 	certManager := autocert.Manager{
 		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(cfg.UrlRoot),
+		HostPolicy: autocert.HostWhitelist(c.UrlRoot),
 		Cache:      autocert.DirCache(certCache),
 	}
 
+	tlsConfig, err := serverTLSConfig(c)
+	if err != nil {
+		return err
+	}
+	tlsConfig.GetCertificate = certManager.GetCertificate
+	s.TLSConfig = tlsConfig
+
 	// Attempt to boot a port 80 https redirect
 	go func() { HttpsRedirect() }()
 
-	s.TLSConfig = &tls.Config{
-		GetCertificate: certManager.GetCertificate,
-		// Causes servers to use Go's default ciphersuite preferences,
-		// which are tuned to avoid attacks. Does nothing on clients.
-		PreferServerCipherSuites: true,
+	return s.ListenAndServeTLS(cert, key)
+}
+
+// tlsVersions maps TlsMinVersion settings to tls package versions
+var tlsVersions = map[string]uint16{
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// defaultCipherSuites are the TLS 1.2 suites offered when TlsCipherSuites
+// isn't set, forward-secret AEAD ciphers only. TLS 1.3 suites can't be
+// configured, all of them are secure
+var defaultCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
+
+// serverTLSConfig builds the tls settings for serving HTTPS directly from
+// c's TlsMinVersion & TlsCipherSuites, with HTTP/2 enabled. Certificates
+// are left for the caller to configure
+func serverTLSConfig(c *config) (*tls.Config, error) {
+	var minVersion uint16 = tls.VersionTLS12
+	if c.TlsMinVersion != "" {
+		v, ok := tlsVersions[c.TlsMinVersion]
+		if !ok {
+			return nil, fmt.Errorf("TLS_MIN_VERSION must be either '1.2' or '1.3', got: '%s'", c.TlsMinVersion)
+		}
+		minVersion = v
+	}
+
+	suites := defaultCipherSuites
+	if names := nonEmpty(c.TlsCipherSuites); len(names) > 0 {
+		known := map[string]uint16{}
+		for _, suite := range tls.CipherSuites() {
+			known[suite.Name] = suite.ID
+		}
+
+		suites = make([]uint16, len(names))
+		h2Suite := false
+		for i, name := range names {
+			id, ok := known[name]
+			if !ok {
+				return nil, fmt.Errorf("unknown or insecure TLS cipher suite: '%s'", name)
+			}
+			suites[i] = id
+			h2Suite = h2Suite || id == tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 || id == tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+		}
+		// HTTP/2 refuses to start without one of these
+		if !h2Suite && minVersion < tls.VersionTLS13 {
+			return nil, fmt.Errorf("TLS_CIPHER_SUITES must include TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256 or TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 for HTTP/2")
+		}
+	}
+
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: suites,
 		// Only use curves which have assembly implementations
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP256,
 			tls.X25519,
 		},
-	}
+		// offer HTTP/2, falling back to HTTP/1.1
+		NextProtos: []string{"h2", "http/1.1"},
+	}, nil
+}
 
-	return s.ListenAndServeTLS(cert, key)
+// nonEmpty returns strs without empty or whitespace-only strings, which
+// config reads in for unset list values
+func nonEmpty(strs []string) []string {
+	res := []string{}
+	for _, s := range strs {
+		if s = strings.TrimSpace(s); s != "" {
+			res = append(res, s)
+		}
+	}
+	return res
 }
 
 // Redirect HTTP to https if port 80 is open
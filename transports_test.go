@@ -0,0 +1,67 @@
+package main
+
+import (
+	"crypto/tls"
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestStartServerListenAddr(t *testing.T) {
+	// occupy a port so StartServer fails fast instead of serving forever
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	defer ln.Close()
+	_, port, err := net.SplitHostPort(ln.Addr().String())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+
+	s := &http.Server{}
+	if err := StartServer(&config{ListenAddr: "127.0.0.1", Port: port}, s); err == nil {
+		t.Errorf("expected listening on an occupied port to error")
+	}
+	if expect := "127.0.0.1:" + port; s.Addr != expect {
+		t.Errorf("server addr mismatch. expected: %s, got: %s", expect, s.Addr)
+	}
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	cases := []struct {
+		minVersion string
+		suites     []string
+		expect     uint16
+		err        bool
+	}{
+		{"", nil, tls.VersionTLS12, false},
+		{"", []string{""}, tls.VersionTLS12, false},
+		{"1.2", nil, tls.VersionTLS12, false},
+		{"1.3", nil, tls.VersionTLS13, false},
+		{"1.1", nil, 0, true},
+		{"", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, tls.VersionTLS12, false},
+		{"", []string{"TLS_RSA_WITH_RC4_128_SHA"}, 0, true},
+		{"", []string{"TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384"}, 0, true},
+	}
+
+	for i, c := range cases {
+		cfg, err := serverTLSConfig(&config{TLS: true, TlsMinVersion: c.minVersion, TlsCipherSuites: c.suites})
+		if (err != nil) != c.err {
+			t.Errorf("case %d: expected error: %t, got: %v", i, c.err, err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if cfg.MinVersion != c.expect {
+			t.Errorf("case %d: expected min version %x, got: %x", i, c.expect, cfg.MinVersion)
+		}
+		if len(cfg.NextProtos) == 0 || cfg.NextProtos[0] != "h2" {
+			t.Errorf("case %d: expected HTTP/2 to be offered, got: %v", i, cfg.NextProtos)
+		}
+		if len(c.suites) > 1 && len(cfg.CipherSuites) != len(c.suites) {
+			t.Errorf("case %d: expected %d cipher suites, got: %d", i, len(c.suites), len(cfg.CipherSuites))
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+)
+
+// version is the release version of this server
+const version = "0.1.0"
+
+// userAgentTransport wraps an http.RoundTripper, setting the User-Agent of
+// requests that don't set their own. some servers refuse requests with Go's
+// default user agent
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// newUserAgentTransport wraps base, sending userAgent with every request.
+// a nil base uses http.DefaultTransport
+func newUserAgentTransport(base http.RoundTripper, userAgent string) *userAgentTransport {
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	return &userAgentTransport{base: base, userAgent: userAgent}
+}
+
+// RoundTrip implements the http.RoundTripper interface
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.userAgent == "" || req.Header.Get("User-Agent") != "" {
+		return t.base.RoundTrip(req)
+	}
+	// RoundTrippers mustn't modify the request they're given
+	r := req.Clone(req.Context())
+	r.Header.Set("User-Agent", t.userAgent)
+	return t.base.RoundTrip(r)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestUserAgentTransport(t *testing.T) {
+	var got string
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.Header.Get("User-Agent")
+	}))
+	defer s.Close()
+
+	client := &http.Client{Transport: newUserAgentTransport(nil, "task-mgmt/test")}
+
+	req, err := http.NewRequest("GET", s.URL, nil)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if got != "task-mgmt/test" {
+		t.Errorf("expected user agent 'task-mgmt/test', got: '%s'", got)
+	}
+	if req.Header.Get("User-Agent") != "" {
+		t.Errorf("expected the original request to be left unmodified")
+	}
+
+	// requests that set their own user agent keep it
+	req.Header.Set("User-Agent", "custom")
+	res, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	res.Body.Close()
+	if got != "custom" {
+		t.Errorf("expected user agent 'custom', got: '%s'", got)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/datatogether/task_mgmt/source"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+)
+
+// RecordWorkerHeartbeat notes that workerId was alive at time t
+func RecordWorkerHeartbeat(db sqlExecable, workerId string, t time.Time) error {
+	_, err := db.Exec(qWorkerHeartbeatUpsert, workerId, t.In(time.UTC))
+	return err
+}
+
+// RequestTaskCancel asks the worker running taskId to stop, as of time t.
+// Workers learn of cancel requests from their heartbeat responses
+func RequestTaskCancel(db sqlExecable, taskId string, t time.Time) error {
+	_, err := db.Exec(qTaskCancelRequestUpsert, taskId, t.In(time.UTC))
+	return err
+}
+
+// WorkerCancelRequests returns the ids of workerId's in-flight tasks that
+// have been asked to cancel
+func WorkerCancelRequests(db sqlQueryable, workerId string) ([]string, error) {
+	rows, err := db.Query(qWorkerTasksCancelRequested, workerId)
+	if err != nil {
+		return nil, err
+	}
+	return scanStrings(rows)
+}
+
+// SweepStaleWorkers finds workers that haven't sent a heartbeat since before,
+// returning their in-flight tasks to the queue. Stale workers are forgotten
+// until they send another heartbeat. It returns the ids of requeued tasks
+func SweepStaleWorkers(db sqlQueryExecable, before time.Time) ([]string, error) {
+	rows, err := db.Query(qWorkerHeartbeatsDeleteStale, before.In(time.UTC))
+	if err != nil {
+		return nil, err
+	}
+	workers, err := scanStrings(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	requeued := []string{}
+	now := time.Now().Round(time.Second).In(time.UTC)
+	for _, workerId := range workers {
+		rows, err := db.Query(qWorkerTasksRequeue, workerId, now)
+		if err != nil {
+			return requeued, err
+		}
+		ids, err := scanStrings(rows)
+		if err != nil {
+			return requeued, err
+		}
+		if len(ids) > 0 {
+			log.Infof("worker %s is stale, requeued tasks: %v", workerId, ids)
+		}
+		requeued = append(requeued, ids...)
+	}
+
+	return requeued, nil
+}
+
+// sweepWorkers calls SweepStaleWorkers every interval, requeuing tasks held by
+// workers that haven't sent a heartbeat within timeout
+func sweepWorkers(interval, timeout time.Duration) {
+	for range time.Tick(interval) {
+		// forgetting stale workers & requeuing their tasks happen together
+		err := WithTx(context.Background(), appDB, func(tx *sql.Tx) error {
+			_, err := SweepStaleWorkers(newQueryLogger(tx), time.Now().Add(-timeout))
+			return err
+		})
+		if err != nil {
+			log.Infoln("error sweeping stale workers:", err)
+		}
+	}
+}
+
+// sendHeartbeats records a heartbeat for this server's worker id every interval,
+// calling cancel with each of this worker's tasks that's been asked to cancel
+func sendHeartbeats(interval time.Duration, cancel func(taskId string)) {
+	for {
+		heartbeat(newQueryLogger(appDB), workerId(), cancel)
+		time.Sleep(interval)
+	}
+}
+
+// heartbeat records a single heartbeat for workerId, then passes each of
+// it's tasks with a pending cancel request to cancel
+func heartbeat(db sqlQueryExecable, workerId string, cancel func(taskId string)) {
+	if err := RecordWorkerHeartbeat(db, workerId, time.Now()); err != nil {
+		log.Infoln("error recording worker heartbeat:", err)
+	}
+	ids, err := WorkerCancelRequests(db, workerId)
+	if err != nil {
+		log.Infoln("error reading cancel requests:", err)
+		return
+	}
+	for _, id := range ids {
+		cancel(id)
+	}
+}
+
+// archiveTasks moves tasks that finished more than olderThan ago to the
+// archive every interval
+func archiveTasks(interval, olderThan time.Duration) {
+	for range time.Tick(interval) {
+		ids, err := tasks.ArchiveTasks(newQueryLogger(appDB), time.Now().Add(-olderThan))
+		if err != nil {
+			log.Infoln("error archiving tasks:", err)
+			continue
+		}
+		if len(ids) > 0 {
+			log.Infof("archived %d tasks", len(ids))
+		}
+	}
+}
+
+// CheckSourcesDrift re-fetches a random sample of up to n sources, recording
+// any that no longer match their checksum. It returns the ids of sources
+// that have newly drifted. sources that can't be fetched are skipped
+func CheckSourcesDrift(db sqlQueryable, store datastore.Datastore, n int, fetch source.FetchFunc) ([]string, error) {
+	sources, err := source.SampleChecksummedSources(db, n)
+	if err != nil {
+		return nil, err
+	}
+
+	drifted := []string{}
+	for _, s := range sources {
+		changed, err := s.CheckDrift(fetch)
+		if err != nil {
+			log.Infoln("error checking source drift:", err)
+			continue
+		}
+		if !changed {
+			continue
+		}
+		if err := s.Save(store); err != nil {
+			return drifted, err
+		}
+		if s.Drifted != nil {
+			log.Warnf("source %s no longer matches checksum %s: %s", s.Id, s.Checksum, s.Url)
+			drifted = append(drifted, s.Id)
+		}
+	}
+	return drifted, nil
+}
+
+// checkSourceDrift checks a sample of sampleSize sources for drift every interval
+func checkSourceDrift(interval time.Duration, sampleSize int) {
+	for range time.Tick(interval) {
+		if _, err := CheckSourcesDrift(newQueryLogger(appDB), store, sampleSize, httpFetch); err != nil {
+			log.Infoln("error checking source drift:", err)
+		}
+	}
+}
+
+// httpFetch GETs url, erroring on responses other than 200 OK
+func httpFetch(url string) (io.ReadCloser, error) {
+	res, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		res.Body.Close()
+		return nil, fmt.Errorf("unexpected response status: %s", res.Status)
+	}
+	return res.Body, nil
+}
+
+// scanStrings reads a single string column from each row
+func scanStrings(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	strs := []string{}
+	for rows.Next() {
+		var s string
+		if err := rows.Scan(&s); err != nil {
+			return nil, err
+		}
+		strs = append(strs, s)
+	}
+	return strs, rows.Err()
+}
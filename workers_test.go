@@ -0,0 +1,299 @@
+package main
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/datatogether/task_mgmt/source"
+	"github.com/datatogether/task_mgmt/tasks"
+	"github.com/ipfs/go-datastore"
+	"github.com/streadway/amqp"
+)
+
+func TestSweepStaleWorkers(t *testing.T) {
+	defer resetTestData(appDB, "tasks", "worker_heartbeats")
+	if err := resetTestData(appDB, "worker_heartbeats"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	id := "57220705-4954-4a42-9e02-e6aa53b6908e"
+	if _, err := appDB.Exec("UPDATE tasks SET enqueued = $2, started = $2, worker_id = 'test_worker' WHERE id = $1", id, time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := RecordWorkerHeartbeat(appDB, "live_worker", time.Now()); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	requeued, err := SweepStaleWorkers(appDB, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(requeued) != 1 || requeued[0] != id {
+		t.Errorf("expected task %s to be requeued, got: %v", id, requeued)
+	}
+
+	task := &tasks.Task{Id: id}
+	if err := task.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if task.Started != nil || task.WorkerId != "" {
+		t.Errorf("expected requeued task to have no start time or worker. started: %v, worker: %s", task.Started, task.WorkerId)
+	}
+	if status := task.StatusString(); status != tasks.StatusQueued {
+		t.Errorf("expected requeued task to be queued, got: %s", status)
+	}
+
+	// stale workers are forgotten once swept, live workers are left alone
+	requeued, err = SweepStaleWorkers(appDB, time.Now().Add(-time.Minute))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(requeued) != 0 {
+		t.Errorf("expected second sweep to requeue nothing, got: %v", requeued)
+	}
+	var count int
+	if err := appDB.QueryRow("SELECT count(1) FROM worker_heartbeats WHERE worker_id = 'live_worker'").Scan(&count); err != nil {
+		t.Fatal(err.Error())
+	}
+	if count != 1 {
+		t.Errorf("expected live worker's heartbeat to remain")
+	}
+}
+
+func TestWorkerHeartbeatHandler(t *testing.T) {
+	defer resetTestData(appDB, "worker_heartbeats")
+	prev := currentConfig()
+	c := *prev
+	c.WorkerSecret = "secret"
+	setConfig(&c)
+	defer setConfig(prev)
+
+	for _, token := range []string{"wrong", "secret"} {
+		req := httptest.NewRequest("POST", "/workers/test_worker/heartbeat", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		WorkerHandler(rr, req)
+
+		expect := http.StatusUnauthorized
+		if token == "secret" {
+			expect = http.StatusOK
+		}
+		if rr.Code != expect {
+			t.Errorf("token '%s': expected status %d, got: %d", token, expect, rr.Code)
+		}
+	}
+
+	var lastSeen time.Time
+	if err := appDB.QueryRow("SELECT last_seen FROM worker_heartbeats WHERE worker_id = 'test_worker'").Scan(&lastSeen); err != nil {
+		t.Fatal(err.Error())
+	}
+	if time.Since(lastSeen) > time.Minute {
+		t.Errorf("expected heartbeat to update last_seen, got: %s", lastSeen)
+	}
+}
+
+func TestCancelRunningTask(t *testing.T) {
+	defer resetTestData(appDB, "tasks")
+	b := blockingTaskable{started: make(chan struct{}), release: make(chan struct{})}
+	tasks.RegisterTaskdef("test.blocking", func() tasks.Taskable { return &blockingTaskable{b.started, b.release} })
+	defer close(b.release)
+
+	now := time.Now()
+	task := &tasks.Task{Type: "test.blocking", Enqueued: &now}
+	if err := task.Save(store); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	msgs := make(chan amqp.Delivery, 1)
+	ack := &recordingAcknowledger{}
+	msgs <- amqp.Delivery{Acknowledger: ack, CorrelationId: task.Id}
+	q := newTaskQueue(store, msgs)
+	go q.run()
+	defer q.Shutdown(context.Background())
+
+	select {
+	case <-b.started:
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for task to start")
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("POST", "/tasks/"+task.Id+"/cancel", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "cancel requested") {
+		t.Fatalf("expected cancelling a running task to request a cancel, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	// the worker's next heartbeat stops the run
+	heartbeat(newQueryLogger(appDB), workerId(), func(taskId string) { q.Cancel(taskId) })
+	waitForAck(t, ack)
+
+	cancelled := &tasks.Task{Id: task.Id}
+	if err := cancelled.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if cancelled.Failed == nil || cancelled.Error != tasks.CancelledError {
+		t.Errorf("expected cancelled task to fail with error '%s', got: '%s'", tasks.CancelledError, cancelled.Error)
+	}
+	ids, err := WorkerCancelRequests(appDB, workerId())
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ids) != 0 {
+		t.Errorf("expected no pending cancel requests once the task is cancelled, got: %v", ids)
+	}
+}
+
+func TestArchiveTasks(t *testing.T) {
+	defer resetTestData(appDB, "tasks", "tasks_archive")
+	if err := resetTestData(appDB, "tasks_archive"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	old := time.Date(2017, 1, 2, 0, 0, 0, 0, time.UTC)
+	finished := "1f4b7c9a-2d3e-4f5a-8b6c-7d8e9f0a1b2c"
+	failed := "2a5c8d0b-3e4f-4a6b-9c7d-8e9f0a1b2c3d"
+	recent := "3b6d9e1c-4f5a-4b7c-8d8e-9f0a1b2c3d4e"
+	if _, err := appDB.Exec(`INSERT INTO tasks (id, created, updated, title, type, enqueued, started, succeeded, failed) VALUES
+		($1, $4, $4, 'old finished', 'ipfs.add', $4, $4, $4, null),
+		($2, $4, $4, 'old failed', 'ipfs.add', $4, $4, null, $4),
+		($3, $5, $5, 'recent finished', 'ipfs.add', $5, $5, $5, null)`,
+		finished, failed, recent, old, time.Now().In(time.UTC)); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	if _, err := AppendTaskLogs(appDB, finished, []string{"done"}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if err := tasks.AddTaskArtifacts(appDB, finished, []*tasks.TaskArtifact{{Name: "output", Hash: "sha256:abc"}}); err != nil {
+		t.Fatal(err.Error())
+	}
+	if _, err := AddTaskNote(appDB, finished, "admin", "checked"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	ids, err := tasks.ArchiveTasks(appDB, time.Now().Add(-24*time.Hour))
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(ids) != 2 {
+		t.Fatalf("expected 2 tasks to be archived, got: %v", ids)
+	}
+
+	for _, id := range []string{finished, failed} {
+		if err := (&tasks.Task{Id: id}).Read(store); err != datastore.ErrNotFound {
+			t.Errorf("expected archived task %s to be removed from tasks, got: %v", id, err)
+		}
+		task, err := tasks.ReadArchivedTask(appDB, id)
+		if err != nil {
+			t.Errorf("error reading archived task %s: %s", id, err.Error())
+			continue
+		}
+		if task.Id != id || task.Title == "" {
+			t.Errorf("expected archived task %s to keep it's fields, got: %v", id, task)
+		}
+	}
+
+	// logs, artifacts & notes are archived with their task
+	task, err := tasks.ReadArchivedTask(appDB, finished)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(task.Artifacts) != 1 || task.Artifacts[0].Name != "output" {
+		t.Errorf("expected archived task to keep it's artifacts, got: %v", task.Artifacts)
+	}
+	logs, err := ReadTaskLogs(appDB, finished, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(logs) != 1 || logs[0].Line != "done" {
+		t.Errorf("expected archived task to keep it's logs, got: %v", logs)
+	}
+	notes, err := ReadTaskNotes(appDB, finished, 10, 0)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(notes) != 1 || notes[0].Body != "checked" {
+		t.Errorf("expected archived task to keep it's notes, got: %v", notes)
+	}
+	var live int
+	if err := appDB.QueryRow(`SELECT
+		(SELECT count(1) FROM task_logs WHERE task_id = $1) +
+		(SELECT count(1) FROM task_artifacts WHERE task_id = $1) +
+		(SELECT count(1) FROM task_notes WHERE task_id = $1)`, finished).Scan(&live); err != nil {
+		t.Fatal(err.Error())
+	}
+	if live != 0 {
+		t.Errorf("expected archived task's rows to be removed from the live tables, got: %d", live)
+	}
+
+	rr := httptest.NewRecorder()
+	TaskHandler(rr, httptest.NewRequest("GET", "/tasks/"+finished+"/logs", nil))
+	if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), "done") {
+		t.Errorf("expected archived task logs to be readable, got: %d %s", rr.Code, rr.Body.String())
+	}
+
+	prev := currentConfig()
+	c := *prev
+	c.AdminApiKey = "admin_key"
+	setConfig(&c)
+	defer setConfig(prev)
+	req := httptest.NewRequest("POST", "/tasks/"+finished+"/notes", strings.NewReader(`{"body":"late"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer admin_key")
+	rr = httptest.NewRecorder()
+	TaskHandler(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected adding a note to an archived task to return %d, got: %d", http.StatusNotFound, rr.Code)
+	}
+
+	// unfinished & recently finished tasks stay put
+	for _, id := range []string{recent, "57220705-4954-4a42-9e02-e6aa53b6908e"} {
+		if err := (&tasks.Task{Id: id}).Read(store); err != nil {
+			t.Errorf("expected task %s to remain in tasks, got: %v", id, err)
+		}
+	}
+}
+
+func TestCheckSourcesDrift(t *testing.T) {
+	defer resetTestData(appDB, "sources")
+	if err := resetTestData(appDB, "sources"); err != nil {
+		t.Fatal(err.Error())
+	}
+
+	// test sources have checksums of zim files, which this content won't match
+	content := "not a zim file"
+	fetch := func(url string) (io.ReadCloser, error) {
+		return ioutil.NopCloser(strings.NewReader(content)), nil
+	}
+
+	drifted, err := CheckSourcesDrift(appDB, store, 10, fetch)
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(drifted) != 2 {
+		t.Errorf("expected both test sources to drift, got: %v", drifted)
+	}
+
+	s := &source.Source{Id: "bac6f89b-703e-4751-8109-b14d604df746"}
+	if err := s.Read(store); err != nil {
+		t.Fatal(err.Error())
+	}
+	if s.Drifted == nil {
+		t.Errorf("expected drifted source to be flagged")
+	}
+
+	// sources that have already drifted aren't reported again
+	content = "still not a zim file"
+	if drifted, err = CheckSourcesDrift(appDB, store, 10, fetch); err != nil {
+		t.Fatal(err.Error())
+	}
+	if len(drifted) != 0 {
+		t.Errorf("expected already drifted sources not to be reported, got: %v", drifted)
+	}
+}